@@ -2,14 +2,16 @@ package service
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"net/http"
+	"errors"
 	"time"
 
+	"gophermart/internal/service/accrual"
 	"gophermart/internal/service/storage"
 )
 
+// defaultAccrualProvider serves all orders unless providers are configured
+const defaultAccrualProvider = "default"
+
 var statusesToProcess = []storage.Status{
 	storage.StatusNew,
 	storage.StatusRegistered,
@@ -20,7 +22,7 @@ func (s *Service) processOrders(ctx context.Context) {
 	s.log.Infof("accrual processor started")
 
 	for {
-		time.Sleep(1 * time.Second)
+		time.Sleep(s.config.AccrualPoll)
 
 		select {
 		case <-ctx.Done():
@@ -46,49 +48,70 @@ func (s *Service) processOrders(ctx context.Context) {
 }
 
 func (s *Service) processOrder(ctx context.Context, order storage.Order) {
-	url := fmt.Sprintf("%s/api/orders/%s", s.config.AccrualAddress, order.Number)
-
-	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		s.log.Errorf("accrual processor failed create request for order %s: %s", order.Number, err)
+	processedOrder, ok := s.fetchAccrualOrder(ctx, order)
+	if !ok {
 		return
 	}
 
-	response, err := s.client.Do(request)
-	if err != nil {
-		s.log.Errorf("accrual processor failed to process order %s: %s", order.Number, err)
-		return
+	err := s.applyAccrualOrder(ctx, processedOrder)
+	if err != nil && !errors.Is(err, storage.ErrOrderAlreadyProcessed) && !errors.Is(err, storage.ErrOrderNotChanged) {
+		s.log.Errorf("accrual processor failed to update order %s in DB: %s", order.Number, err)
 	}
-	defer response.Body.Close()
+}
 
-	if response.StatusCode == http.StatusInternalServerError {
-		s.log.Errorf("accrual system failed to process order %s", order.Number)
-		return
+// applyAccrualOrder records a result of the accrual system whether it was
+// polled or pushed; results for orders in a final status are rejected and
+// results repeating what the order has are ignored
+func (s *Service) applyAccrualOrder(ctx context.Context, accrualOrder storage.AccrualOrder) error {
+	updated, err := s.db.UpdateOrder(ctx, accrualOrder)
+	if err != nil {
+		return err
 	}
 
-	if response.StatusCode == http.StatusNoContent {
-		s.log.Infof("accrual system has no order %s", order.Number)
-		return
+	s.log.Infof("successfully updated order %s status", updated.Number)
+
+	if updated.Status == storage.StatusProcessed {
+		s.rewardReferral(ctx, updated.RegisteredBy)
 	}
 
-	if response.StatusCode == http.StatusTooManyRequests {
-		s.log.Infof("accrual system is overloaded")
-		time.Sleep(5 * time.Second)
-		return
+	s.publishOrderUpdate(ctx, updated)
+
+	return nil
+}
+
+// accrualProvider is where the order is checked; orders uploaded before
+// providers were configurable or whose provider is gone are routed anew
+func (s *Service) accrualProvider(order storage.Order) (*accrual.Provider, error) {
+	if provider, ok := s.accrual.Get(order.Provider); ok {
+		return provider, nil
 	}
 
-	processedOrder := storage.AccrualOrder{}
-	err = json.NewDecoder(response.Body).Decode(&processedOrder)
+	return s.accrual.Route(order.Number, "")
+}
+
+// fetchAccrualOrder asks the accrual system about the order; failures are logged
+func (s *Service) fetchAccrualOrder(ctx context.Context, order storage.Order) (storage.AccrualOrder, bool) {
+	provider, err := s.accrualProvider(order)
 	if err != nil {
-		s.log.Errorf("accrual processor failed to parse processed order %s: %s", order.Number, err)
-		return
+		s.log.Errorf("accrual processor failed to route order %s: %s", order.Number, err)
+		return storage.AccrualOrder{}, false
 	}
 
-	err = s.db.UpdateOrder(ctx, processedOrder)
-	if err != nil {
-		s.log.Errorf("accrual processor failed to update order %s in DB: %s", order.Number, err)
-		return
+	accrualOrder := storage.AccrualOrder{}
+	err = provider.Fetch(ctx, order.Number, &accrualOrder)
+
+	switch {
+	case err == nil:
+		return accrualOrder, true
+	case errors.Is(err, accrual.ErrNotRegistered):
+		s.log.Infof("accrual system %s has no order %s", provider.Name(), order.Number)
+	case errors.Is(err, accrual.ErrOverloaded):
+		s.log.Infof("accrual system %s is overloaded", provider.Name())
+	case errors.Is(err, accrual.ErrRateLimited):
+		// The order is checked on one of the next polls
+	default:
+		s.log.Errorf("accrual processor failed to process order %s at %s: %s", order.Number, provider.Name(), err)
 	}
 
-	s.log.Infof("successfully updated order %s status", order.Number)
+	return storage.AccrualOrder{}, false
 }
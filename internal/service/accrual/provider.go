@@ -0,0 +1,168 @@
+// Package accrual talks to the accrual systems computing points for orders.
+// Several systems may be configured; every order is routed to one of them
+// by its number or by the partner who uploaded it.
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"gophermart/internal/service/ordernum"
+)
+
+const (
+	requestTimeout = 5 * time.Second
+
+	// defaultRetryAfter is how long to back off when an overloaded
+	// provider does not say
+	defaultRetryAfter = 5 * time.Second
+)
+
+var (
+	ErrNotRegistered = errors.New("order is not registered in accrual system")
+	ErrOverloaded    = errors.New("accrual system is overloaded")
+	ErrRateLimited   = errors.New("accrual system rate limit is reached")
+)
+
+// Provider is a single accrual system with its own client, credentials,
+// request rate and order number scheme
+type Provider struct {
+	config    Config
+	client    *http.Client
+	limiter   *limiter
+	validator ordernum.Validator
+}
+
+func NewProvider(cfg Config) (*Provider, error) {
+	validator, err := ordernum.New(cfg.Validation)
+	if err != nil {
+		return nil, fmt.Errorf("bad validation of %s: %w", cfg.Name, err)
+	}
+
+	return &Provider{
+		config:    cfg,
+		client:    &http.Client{Timeout: requestTimeout},
+		limiter:   newLimiter(cfg.RateLimit),
+		validator: validator,
+	}, nil
+}
+
+func (p *Provider) Name() string {
+	return p.config.Name
+}
+
+// CallbackSecret is what results pushed by the provider are signed with
+func (p *Provider) CallbackSecret() string {
+	return p.config.CallbackSecret
+}
+
+// Valid checks the order number against the scheme of the provider
+func (p *Provider) Valid(number string) bool {
+	return p.validator.Valid(number)
+}
+
+// Fetch decodes what the provider knows about the order into v. It returns
+// ErrNotRegistered if the provider has no such order. Without making
+// a request it returns ErrOverloaded while the provider asked to back off
+// and ErrRateLimited until the rate limit allows the next request; it never
+// waits, so a slow provider does not hold up polling of the others.
+func (p *Provider) Fetch(ctx context.Context, number string, v interface{}) error {
+	err := p.limiter.reserve(time.Now())
+	if err != nil {
+		return err
+	}
+
+	uri := fmt.Sprintf("%s/api/orders/%s", p.config.Address, url.PathEscape(number))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if p.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.Token)
+	} else if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNoContent:
+		return ErrNotRegistered
+	case http.StatusTooManyRequests:
+		p.limiter.pause(time.Now().Add(retryAfter(resp.Header.Get("Retry-After"))))
+		return ErrOverloaded
+	default:
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, p.config.Name)
+	}
+}
+
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds <= 0 {
+		return defaultRetryAfter
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// limiter spaces requests evenly and rejects all of them while the provider
+// asks to back off
+type limiter struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	next        time.Time
+	pausedUntil time.Time
+}
+
+// newLimiter allows rate requests per second, zero is unlimited
+func newLimiter(rate float64) *limiter {
+	l := &limiter{}
+	if rate > 0 {
+		l.interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return l
+}
+
+// reserve takes the slot of a request made at now, requests made before
+// the next slot are rejected rather than queued
+func (l *limiter) reserve(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.pausedUntil) {
+		return ErrOverloaded
+	}
+
+	if now.Before(l.next) {
+		return ErrRateLimited
+	}
+	l.next = now.Add(l.interval)
+
+	return nil
+}
+
+func (l *limiter) pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
@@ -0,0 +1,67 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		require.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/api/orders/12345678903":
+			w.Write([]byte(`{"order": "12345678903", "status": "PROCESSED", "accrual": 500}`))
+		case "/api/orders/79927398713":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewProvider(Config{Name: "main", Address: server.URL, Token: "secret"})
+	require.NoError(t, err)
+
+	order := struct {
+		Order   string  `json:"order"`
+		Status  string  `json:"status"`
+		Accrual float32 `json:"accrual"`
+	}{}
+	require.NoError(t, provider.Fetch(context.Background(), "12345678903", &order))
+	require.Equal(t, "PROCESSED", order.Status)
+	require.Equal(t, float32(500), order.Accrual)
+
+	require.ErrorIs(t, provider.Fetch(context.Background(), "4561261212345467", &order), ErrNotRegistered)
+	require.ErrorIs(t, provider.Fetch(context.Background(), "79927398713", &order), ErrOverloaded)
+
+	// Backing off, no more requests are sent
+	require.ErrorIs(t, provider.Fetch(context.Background(), "12345678903", &order), ErrOverloaded)
+	require.Equal(t, 3, requests)
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(2)
+
+	require.NoError(t, l.reserve(now))
+	require.ErrorIs(t, l.reserve(now.Add(100*time.Millisecond)), ErrRateLimited)
+	require.NoError(t, l.reserve(now.Add(500*time.Millisecond)))
+
+	l.pause(now.Add(time.Minute))
+
+	require.ErrorIs(t, l.reserve(now.Add(time.Second)), ErrOverloaded)
+	require.NoError(t, l.reserve(now.Add(time.Minute)))
+
+	unlimited := newLimiter(0)
+	require.NoError(t, unlimited.reserve(now))
+	require.NoError(t, unlimited.reserve(now))
+}
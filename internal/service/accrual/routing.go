@@ -0,0 +1,161 @@
+package accrual
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gophermart/internal/service/ordernum"
+)
+
+var (
+	ErrInvalidProviders = errors.New("invalid accrual providers")
+	ErrNoProvider       = errors.New("no accrual provider for order")
+)
+
+// Config describes a provider and the orders routed to it. A provider
+// takes an order when it matches every rule kind given: one of Prefixes,
+// one of Lengths and one of Partners. A provider without rules takes any.
+type Config struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// Token is sent as a bearer token, otherwise Username and Password
+	// are sent as basic auth when set
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// RateLimit is how many requests per second the provider accepts;
+	// zero is unlimited
+	RateLimit float64 `json:"rate_limit"`
+	// Validation lists order number schemes, Luhn is used when empty
+	Validation []ordernum.Spec `json:"validation"`
+	// CallbackSecret signs results the provider pushes; without it the
+	// provider is only polled
+	CallbackSecret string `json:"callback_secret"`
+
+	Prefixes []string `json:"prefixes"`
+	Lengths  []int    `json:"lengths"`
+	Partners []string `json:"partners"`
+}
+
+func (c Config) matches(number, partner string) bool {
+	return c.matchesPrefix(number) && c.matchesLength(number) && c.matchesPartner(partner)
+}
+
+func (c Config) matchesPrefix(number string) bool {
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+
+	return len(c.Prefixes) == 0
+}
+
+func (c Config) matchesLength(number string) bool {
+	for _, length := range c.Lengths {
+		if len(number) == length {
+			return true
+		}
+	}
+
+	return len(c.Lengths) == 0
+}
+
+func (c Config) matchesPartner(partner string) bool {
+	for _, name := range c.Partners {
+		if partner != "" && name == partner {
+			return true
+		}
+	}
+
+	return len(c.Partners) == 0
+}
+
+// Parse reads a JSON array of provider configs, e.g.
+// [{"name":"main","address":"http://localhost:8080"}]
+func Parse(s string) ([]Config, error) {
+	configs := []Config{}
+	if err := json.Unmarshal([]byte(s), &configs); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProviders, err)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%w: none configured", ErrInvalidProviders)
+	}
+
+	names := map[string]bool{}
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("%w: provider without a name", ErrInvalidProviders)
+		}
+
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("%w: %s is defined twice", ErrInvalidProviders, cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		address, err := url.Parse(cfg.Address)
+		if err != nil || address.Scheme == "" || address.Host == "" {
+			return nil, fmt.Errorf("%w: bad address of %s", ErrInvalidProviders, cfg.Name)
+		}
+
+		if cfg.RateLimit < 0 {
+			return nil, fmt.Errorf("%w: bad rate limit of %s", ErrInvalidProviders, cfg.Name)
+		}
+	}
+
+	return configs, nil
+}
+
+// Providers routes orders to the first matching provider in config order
+type Providers struct {
+	list   []*Provider
+	byName map[string]*Provider
+}
+
+func NewProviders(configs []Config) (*Providers, error) {
+	providers := &Providers{byName: map[string]*Provider{}}
+
+	for _, cfg := range configs {
+		provider, err := NewProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		providers.list = append(providers.list, provider)
+		providers.byName[cfg.Name] = provider
+	}
+
+	return providers, nil
+}
+
+// Route picks a provider for an order uploaded by partner, which is empty
+// for orders uploaded by users themselves
+func (p *Providers) Route(number, partner string) (*Provider, error) {
+	for _, provider := range p.list {
+		if provider.config.matches(number, partner) {
+			return provider, nil
+		}
+	}
+
+	return nil, ErrNoProvider
+}
+
+func (p *Providers) Get(name string) (*Provider, bool) {
+	provider, ok := p.byName[name]
+	return provider, ok
+}
+
+// AcceptCallbacks reports whether any provider may push results
+func (p *Providers) AcceptCallbacks() bool {
+	for _, provider := range p.list {
+		if provider.CallbackSecret() != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,101 @@
+package accrual
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gophermart/internal/service/ordernum"
+)
+
+func TestParse(t *testing.T) {
+	configs, err := Parse(`[
+		{"name": "shop2", "address": "https://accrual.shop2.example", "token": "secret", "rate_limit": 5, "prefixes": ["42"]},
+		{"name": "main", "address": "http://localhost:8080"}
+	]`)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	require.Equal(t, "shop2", configs[0].Name)
+	require.Equal(t, []string{"42"}, configs[0].Prefixes)
+	require.Equal(t, float64(5), configs[0].RateLimit)
+
+	for _, invalid := range []string{
+		``,
+		`[]`,
+		`[{"address": "http://localhost:8080"}]`,
+		`[{"name": "main", "address": "localhost"}]`,
+		`[{"name": "main", "address": "http://a"}, {"name": "main", "address": "http://b"}]`,
+		`[{"name": "main", "address": "http://a", "rate_limit": -1}]`,
+	} {
+		_, err := Parse(invalid)
+		require.True(t, errors.Is(err, ErrInvalidProviders), invalid)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	providers, err := NewProviders([]Config{
+		{Name: "partner", Address: "http://partner", Partners: []string{"acme"}},
+		{Name: "shop2", Address: "http://shop2", Prefixes: []string{"42", "43"}, Lengths: []int{12}},
+		{Name: "main", Address: "http://main"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		number   string
+		partner  string
+		provider string
+	}{
+		{"4200000000000", "acme", "partner"},
+		{"420000000000", "", "shop2"},
+		{"430000000000", "other", "shop2"},
+		{"4200000000000", "", "main"},
+		{"120000000000", "", "main"},
+	}
+
+	for _, tt := range tests {
+		provider, err := providers.Route(tt.number, tt.partner)
+		require.NoError(t, err)
+		require.Equal(t, tt.provider, provider.Name(), tt.number)
+	}
+
+	providers, err = NewProviders([]Config{{Name: "shop2", Address: "http://shop2", Prefixes: []string{"42"}}})
+	require.NoError(t, err)
+
+	_, err = providers.Route("12345678903", "")
+	require.ErrorIs(t, err, ErrNoProvider)
+
+	_, ok := providers.Get("shop2")
+	require.True(t, ok)
+
+	_, ok = providers.Get("main")
+	require.False(t, ok)
+
+	require.False(t, providers.AcceptCallbacks())
+
+	providers, err = NewProviders([]Config{
+		{Name: "shop2", Address: "http://shop2", Prefixes: []string{"42"}},
+		{Name: "main", Address: "http://main", CallbackSecret: "secret"},
+	})
+	require.NoError(t, err)
+
+	require.True(t, providers.AcceptCallbacks())
+}
+
+func TestProviderValidation(t *testing.T) {
+	providers, err := NewProviders([]Config{
+		{Name: "iban", Address: "http://iban", Validation: []ordernum.Spec{{Scheme: "mod97"}}},
+		{Name: "main", Address: "http://main"},
+	})
+	require.NoError(t, err)
+
+	iban, _ := providers.Get("iban")
+	require.True(t, iban.Valid("WEST12345698765432GB82"))
+	require.False(t, iban.Valid("12345678903"))
+
+	main, _ := providers.Get("main")
+	require.True(t, main.Valid("12345678903"))
+
+	_, err = NewProviders([]Config{{Name: "main", Address: "http://main", Validation: []ordernum.Spec{{Scheme: "crc"}}}})
+	require.ErrorIs(t, err, ordernum.ErrInvalidScheme)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/signature"
+	"gophermart/internal/service/storage"
+)
+
+const (
+	accrualSignatureHeader = "X-Accrual-Signature"
+	accrualCallbackActor   = "accrual_callback"
+
+	// accrualSignatureTolerance is how old a signed callback may be
+	accrualSignatureTolerance = 5 * time.Minute
+)
+
+// Outcomes of a pushed accrual result
+const (
+	accrualApplied  = "applied"
+	accrualIgnored  = "ignored"
+	accrualNotFound = "not_found"
+	accrualRejected = "rejected"
+	accrualFailed   = "error"
+)
+
+type accrualCallbackResult struct {
+	Order  string `json:"order"`
+	Result string `json:"result"`
+}
+
+// parseAccrualOrders accepts a single result or a batch of them
+func parseAccrualOrders(body []byte) ([]storage.AccrualOrder, error) {
+	body = bytes.TrimSpace(body)
+
+	if bytes.HasPrefix(body, []byte("[")) {
+		orders := []storage.AccrualOrder{}
+		err := json.Unmarshal(body, &orders)
+
+		return orders, err
+	}
+
+	order := storage.AccrualOrder{}
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+
+	return []storage.AccrualOrder{order}, nil
+}
+
+// handleAccrualCallback applies results pushed by the accrual system the same
+// way polled ones are; orders missed here are still picked up by polling.
+// Providers are told apart by the path, the single accrual system configured
+// without ACCRUAL_PROVIDERS may omit it. Results are only accepted for orders
+// routed to the provider.
+func (s *Service) handleAccrualCallback() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		name := chi.URLParam(r, "provider")
+		if name == "" {
+			name = defaultAccrualProvider
+		}
+
+		provider, ok := s.accrual.Get(name)
+		if !ok || provider.CallbackSecret() == "" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": "error", "message": "unknown accrual provider"}`))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.log.Errorf("failed to read request body due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to read payload"}`))
+			return
+		}
+
+		err = signature.Verify(provider.CallbackSecret(), r.Header.Get(accrualSignatureHeader), body, time.Now(), accrualSignatureTolerance)
+		if err != nil {
+			s.log.Infof("rejected accrual callback of %s due to: %s", name, err)
+
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "message": "invalid signature"}`))
+			return
+		}
+
+		orders, err := parseAccrualOrders(body)
+		if err != nil {
+			s.log.Errorf("failed to parse accrual orders from payload due to: %s", err)
+
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		ctx := storage.WithAuditActor(r.Context(), accrualCallbackActor+":"+name)
+
+		results := make([]accrualCallbackResult, 0, len(orders))
+		for _, order := range orders {
+			result := accrualApplied
+			order.Provider = name
+
+			err := s.applyAccrualOrder(ctx, order)
+			switch {
+			case err == nil:
+			case errors.Is(err, storage.ErrOrderAlreadyProcessed), errors.Is(err, storage.ErrOrderNotChanged):
+				result = accrualIgnored
+			case errors.Is(err, storage.ErrOrderDoesNotExist):
+				result = accrualNotFound
+			case errors.Is(err, storage.ErrOrderOtherProvider):
+				s.log.Warnf("accrual provider %s pushed result for order %s routed elsewhere", name, order.Order)
+				result = accrualRejected
+			default:
+				s.log.Errorf("failed to apply accrual result for order %s due to: %s", order.Order, err)
+				result = accrualFailed
+			}
+
+			results = append(results, accrualCallbackResult{Order: order.Order, Result: result})
+		}
+
+		response, err := json.Marshal(results)
+		if err != nil {
+			s.log.Errorf("failed to serialize accrual callback results due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to serialize results"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	})
+}
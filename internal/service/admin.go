@@ -0,0 +1,508 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/storage"
+)
+
+const (
+	adminSearchDefaultLimit = 50
+	adminSearchMaxLimit     = 200
+)
+
+type (
+	roleUpdate struct {
+		Role storage.Role `json:"role"`
+	}
+
+	balanceAdjustmentRequest struct {
+		Amount float32 `json:"amount"`
+		Reason string  `json:"reason"`
+	}
+
+	adminActionRequest struct {
+		Reason string `json:"reason"`
+	}
+
+	adminUserView struct {
+		Login       string       `json:"login"`
+		Email       string       `json:"email,omitempty"`
+		Role        storage.Role `json:"role"`
+		Current     float32      `json:"current"`
+		Withdrawn   float32      `json:"withdrawn"`
+		Held        float32      `json:"held"`
+		Debt        float32      `json:"debt,omitempty"`
+		Tier        string       `json:"tier,omitempty"`
+		Blocked     bool         `json:"blocked"`
+		TOTPEnabled bool         `json:"totp_enabled"`
+	}
+)
+
+func newAdminUserView(user storage.User) adminUserView {
+	return adminUserView{
+		Login:       user.Name,
+		Email:       user.Email,
+		Role:        user.Role,
+		Current:     user.Current,
+		Withdrawn:   user.Withdrawn,
+		Held:        user.Held,
+		Debt:        user.Debt,
+		Tier:        user.Tier,
+		Blocked:     user.Blocked,
+		TOTPEnabled: user.TOTPEnabled,
+	}
+}
+
+// audit records an event which does not change state by itself,
+// state changes are recorded by storage in the same transaction
+func (s *Service) audit(ctx context.Context, action string, target string, details string) {
+	event := storage.NewAuditEvent(ctx, action, target)
+	event.Details = details
+
+	err := s.db.SaveAuditEvent(ctx, event)
+	if err != nil {
+		s.log.Errorf("failed to save audit event %s due to: %s", action, err)
+	}
+}
+
+func queryInt(r *http.Request, name string, defaultValue int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+// bootstrapAdmins grants admin role to users listed in config so the very
+// first operator does not need DB access. It runs until the first grant,
+// which is marked in the audit log; from then on roles are managed through
+// the API only, otherwise whoever registers a listed login later would get
+// the role on the next start.
+func (s *Service) bootstrapAdmins(ctx context.Context) {
+	if len(s.config.AdminUsers) == 0 {
+		return
+	}
+
+	bootstrapped, err := s.db.GetAuditEvents(ctx, storage.AuditFilter{Action: storage.AuditAdminBootstrapped, Limit: 1})
+	if err != nil {
+		s.log.Errorf("failed to check whether admins were bootstrapped: %s", err)
+		return
+	}
+
+	if len(bootstrapped) > 0 {
+		s.log.Infof("admins were bootstrapped already, ADMIN_USERS is ignored")
+		return
+	}
+
+	granted := []string{}
+
+	for _, admin := range s.config.AdminUsers {
+		err := s.db.SetUserRole(ctx, storage.User{
+			Name:               admin,
+			Role:               storage.RoleAdmin,
+			SessionsValidAfter: time.Now(),
+		})
+		if errors.Is(err, storage.ErrUserDoesNotExist) {
+			s.log.Errorf("ADMIN_USERS lists %s who is not registered, skipping", admin)
+			continue
+		}
+
+		if err != nil {
+			s.log.Errorf("failed to grant admin role to %s: %s", admin, err)
+			continue
+		}
+
+		granted = append(granted, admin)
+	}
+
+	if len(granted) == 0 {
+		return
+	}
+
+	s.log.Warnf("granted admin role to %s, ADMIN_USERS will be ignored from now on", strings.Join(granted, ","))
+	s.audit(ctx, storage.AuditAdminBootstrapped, "", strings.Join(granted, ","))
+}
+
+func (s *Service) handleSetUserRole() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		update := roleUpdate{}
+		err := json.NewDecoder(r.Body).Decode(&update)
+		if err != nil || !update.Role.Valid() {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "role must be one of user/support/admin"}`))
+			return
+		}
+
+		// Tokens carry the role, so the old ones have to go
+		err = s.db.SetUserRole(r.Context(), storage.User{
+			Name:               login,
+			Role:               update.Role,
+			SessionsValidAfter: time.Now(),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrUserDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+				return
+			}
+
+			// Nobody would be left to manage roles
+			if errors.Is(err, storage.ErrLastAdmin) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "last admin can not be demoted"}`))
+				return
+			}
+
+			s.log.Errorf("failed to set user role due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to set role"}`))
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "message": "role updated"}`))
+	})
+}
+
+func (s *Service) handleAdminSearchUsers() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		limit := queryInt(r, "limit", adminSearchDefaultLimit)
+		if limit == 0 || limit > adminSearchMaxLimit {
+			limit = adminSearchMaxLimit
+		}
+
+		users, err := s.db.SearchUsers(r.Context(), r.URL.Query().Get("q"), limit, queryInt(r, "offset", 0))
+		if err != nil {
+			s.log.Errorf("failed to search users due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to search users"}`))
+			return
+		}
+
+		views := make([]adminUserView, 0, len(users))
+		for _, user := range users {
+			views = append(views, newAdminUserView(user))
+		}
+
+		res, err := json.Marshal(views)
+		if err != nil {
+			s.log.Errorf("failed to marshal users due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal users"}`))
+			return
+		}
+
+		s.audit(r.Context(), storage.AuditAdminSearchedUsers, "", r.URL.Query().Get("q"))
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminUser() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		user, err := s.db.GetUserByName(r.Context(), login)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+			return
+		}
+
+		res, err := json.Marshal(newAdminUserView(user))
+		if err != nil {
+			s.log.Errorf("failed to marshal user due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal user"}`))
+			return
+		}
+
+		s.audit(r.Context(), storage.AuditAdminViewedUser, login, "")
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminUserOrders() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		orders, err := s.db.GetUserOrders(r.Context(), login, "uploaded_at")
+		if err != nil {
+			s.log.Errorf("failed to get user orders from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get orders"}`))
+			return
+		}
+
+		res, err := json.Marshal(orders)
+		if err != nil {
+			s.log.Errorf("failed to marshal user orders due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal orders"}`))
+			return
+		}
+
+		s.audit(r.Context(), storage.AuditAdminViewedOrders, login, "")
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminUserWithdrawals() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		withdrawals, err := s.db.GetWithdrawals(r.Context(), login, "processed_at")
+		if err != nil {
+			s.log.Errorf("failed to get withdrawals from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get withdrawals"}`))
+			return
+		}
+
+		res, err := json.Marshal(withdrawals)
+		if err != nil {
+			s.log.Errorf("failed to marshal withdrawals due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal withdrawals"}`))
+			return
+		}
+
+		s.audit(r.Context(), storage.AuditAdminViewedWithdrawals, login, "")
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminAdjustBalance() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		request := balanceAdjustmentRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Amount == 0 || strings.TrimSpace(request.Reason) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "non-zero amount and reason are required"}`))
+			return
+		}
+
+		err = s.db.AdjustBalance(r.Context(), storage.BalanceAdjustment{
+			UserName:  login,
+			Amount:    request.Amount,
+			Reason:    request.Reason,
+			Actor:     getUserNameFromRequest(r),
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrUserDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+				return
+			}
+
+			if errors.Is(err, storage.ErrNotEnoughPoints) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "balance can not become negative"}`))
+				return
+			}
+
+			s.log.Errorf("failed to adjust balance due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to adjust balance"}`))
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "message": "balance adjusted"}`))
+	})
+}
+
+func (s *Service) handleAdminSetBlocked(blocked bool) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		request := adminActionRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || strings.TrimSpace(request.Reason) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "reason is required"}`))
+			return
+		}
+
+		if login == getUserNameFromRequest(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "can not change own account"}`))
+			return
+		}
+
+		// Blocking revokes sessions right away
+		err = s.db.SetUserBlocked(r.Context(), storage.User{
+			Name:               login,
+			Blocked:            blocked,
+			BlockReason:        request.Reason,
+			SessionsValidAfter: time.Now(),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrUserDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+				return
+			}
+
+			s.log.Errorf("failed to update user due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to update user"}`))
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "message": "user updated"}`))
+	})
+}
+
+func (s *Service) handleAdminRequeueOrder() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		number := chi.URLParam(r, "number")
+
+		err := s.db.RequeueOrder(r.Context(), number)
+		if err != nil {
+			if errors.Is(err, storage.ErrOrderDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "order not found"}`))
+				return
+			}
+
+			if errors.Is(err, storage.ErrOrderAlreadyProcessed) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "order already processed"}`))
+				return
+			}
+
+			s.log.Errorf("failed to requeue order due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to requeue order"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "success", "message": "order queued for accrual"}`))
+	})
+}
+
+func (s *Service) handleAdminAuditEvents() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+
+		filter := storage.AuditFilter{
+			Actor:  query.Get("actor"),
+			Action: query.Get("action"),
+			Target: query.Get("target"),
+			Limit:  queryInt(r, "limit", adminSearchDefaultLimit),
+			Offset: queryInt(r, "offset", 0),
+		}
+
+		if filter.Limit == 0 || filter.Limit > adminSearchMaxLimit {
+			filter.Limit = adminSearchMaxLimit
+		}
+
+		for name, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if query.Get(name) == "" {
+				continue
+			}
+
+			parsed, err := time.Parse(time.RFC3339, query.Get(name))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status": "error", "message": "from/to must be RFC 3339 timestamps"}`))
+				return
+			}
+
+			*value = parsed
+		}
+
+		events, err := s.db.GetAuditEvents(r.Context(), filter)
+		if err != nil {
+			s.log.Errorf("failed to get audit events due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get audit events"}`))
+			return
+		}
+
+		res, err := json.Marshal(events)
+		if err != nil {
+			s.log.Errorf("failed to marshal audit events due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal audit events"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminVerifyAudit() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		checked, err := s.db.VerifyAuditLog(r.Context())
+		if err != nil {
+			if errors.Is(err, storage.ErrAuditChainBroken) {
+				s.log.Errorf("audit log verification failed: %s", err)
+
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintf(w, `{"status": "error", "message": %q, "checked": %d}`, err.Error(), checked)
+				return
+			}
+
+			s.log.Errorf("failed to verify audit log due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to verify audit log"}`))
+			return
+		}
+
+		fmt.Fprintf(w, `{"status": "success", "message": "audit chain is intact", "checked": %d}`, checked)
+	})
+}
@@ -0,0 +1,295 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/storage"
+)
+
+const (
+	apiKeyHeader    = "X-API-Key"
+	apiKeyKind      = "gm"
+	apiKeyPrefixLen = 8
+
+	scopeOrdersWrite = "orders:write"
+)
+
+var apiKeyScopes = map[string]bool{
+	scopeOrdersWrite: true,
+}
+
+type (
+	apiKeyRequest struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	apiKeyResponse struct {
+		storage.APIKey
+		Key string `json:"key"`
+	}
+
+	partnerOrderRequest struct {
+		Login  string `json:"login"`
+		Number string `json:"number"`
+	}
+)
+
+// newAPIKey generates a key looking like gm_<prefix>_<secret>. The prefix is
+// stored in clear to find the key and to tell keys apart in logs.
+func newAPIKey() (string, string, error) {
+	b := make([]byte, apiKeyPrefixLen/2+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	prefix := hex.EncodeToString(b[:apiKeyPrefixLen/2])
+	secret := base64.RawURLEncoding.EncodeToString(b[apiKeyPrefixLen/2:])
+
+	return apiKeyKind + "_" + prefix + "_" + secret, prefix, nil
+}
+
+func apiKeyPrefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyKind || len(parts[1]) != apiKeyPrefixLen {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// apiKeyRequired authenticates partner requests by API key having scope
+func (s *Service) apiKeyRequired(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			key := r.Header.Get(apiKeyHeader)
+
+			prefix, ok := apiKeyPrefix(key)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "error", "message": "api key required"}`))
+				return
+			}
+
+			apiKey, err := s.db.GetAPIKeyByPrefix(r.Context(), prefix)
+			if err != nil || subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(hashToken(key))) != 1 {
+				s.log.Infof("invalid api key %s used from %s", prefix, clientIP(r))
+
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "error", "message": "invalid api key"}`))
+				return
+			}
+
+			if !apiKey.HasScope(scope) {
+				s.log.Warnf("api key %s lacks scope %s for %s", prefix, scope, r.URL.Path)
+
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"status": "error", "message": "api key lacks required scope"}`))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), contextPartnerKey, apiKey.Name)
+			ctx = storage.WithAuditActor(ctx, "api_key:"+prefix)
+			r = r.WithContext(ctx)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Service) handleAdminCreateAPIKey() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := apiKeyRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || strings.TrimSpace(request.Name) == "" || len(request.Scopes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "name and scopes are required"}`))
+			return
+		}
+
+		for _, scope := range request.Scopes {
+			if !apiKeyScopes[scope] {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status": "error", "message": "unknown scope"}`))
+				return
+			}
+		}
+
+		key, prefix, err := newAPIKey()
+		if err != nil {
+			s.log.Errorf("failed to generate api key due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create api key"}`))
+			return
+		}
+
+		apiKey := storage.APIKey{
+			Prefix:    prefix,
+			Hash:      hashToken(key),
+			Name:      request.Name,
+			Scopes:    strings.Join(request.Scopes, ","),
+			CreatedBy: getUserNameFromRequest(r),
+			CreatedAt: time.Now(),
+		}
+
+		apiKey.ID, err = s.db.SaveAPIKey(r.Context(), apiKey)
+		if err != nil {
+			s.log.Errorf("failed to save api key due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create api key"}`))
+			return
+		}
+
+		// The key is shown only once, only its hash is kept
+		res, err := json.Marshal(apiKeyResponse{apiKey, key})
+		if err != nil {
+			s.log.Errorf("failed to marshal api key due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal api key"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminAPIKeys() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		keys, err := s.db.GetAPIKeys(r.Context())
+		if err != nil {
+			s.log.Errorf("failed to get api keys due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get api keys"}`))
+			return
+		}
+
+		res, err := json.Marshal(keys)
+		if err != nil {
+			s.log.Errorf("failed to marshal api keys due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal api keys"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminRevokeAPIKey() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "invalid api key id"}`))
+			return
+		}
+
+		err = s.db.RevokeAPIKey(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, storage.ErrAPIKeyDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "api key not found"}`))
+				return
+			}
+
+			s.log.Errorf("failed to revoke api key due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to revoke api key"}`))
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "message": "api key revoked"}`))
+	})
+}
+
+// getPartnerFromRequest returns the name of the API key used, if any
+func getPartnerFromRequest(r *http.Request) string {
+	partner, _ := r.Context().Value(contextPartnerKey).(string)
+	return partner
+}
+
+// handlePartnerNewOrder registers an order on behalf of a customer
+func (s *Service) handlePartnerNewOrder() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := partnerOrderRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Login == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "login and number are required"}`))
+			return
+		}
+
+		provider, ok := s.routeOrder(request.Number, getPartnerFromRequest(r))
+		if !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "message": "order number is incorrect"}`))
+			return
+		}
+
+		user, err := s.db.GetUserByName(r.Context(), request.Login)
+		if err != nil || user.Blocked {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+			return
+		}
+
+		err = s.db.SaveOrder(r.Context(), storage.Order{
+			RegisteredBy: user.Name,
+			Number:       request.Number,
+			UploadedAt:   time.Now(),
+			Provider:     provider.Name(),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrOrderAlreadyRegisteredByUser) {
+				w.Write([]byte(`{"status": "success", "message": "order already registered for user"}`))
+				return
+			}
+
+			if errors.Is(err, storage.ErrOrderAlreadyRegisteredBySomeoneElse) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "order already registered by another user"}`))
+				return
+			}
+
+			s.log.Errorf("failed to save order to DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to register order"}`))
+			return
+		}
+
+		s.log.Infof("order %s registered for %s by %s", request.Number, user.Name, storage.AuditInfoFromContext(r.Context()).Actor)
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "success", "message": "order registered"}`))
+	})
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, prefix, err := newAPIKey()
+	require.NoError(t, err)
+
+	parts := strings.SplitN(key, "_", 3)
+	require.Len(t, parts, 3)
+	require.Equal(t, apiKeyKind, parts[0])
+	require.Equal(t, prefix, parts[1])
+	require.Len(t, prefix, apiKeyPrefixLen)
+	require.Len(t, parts[2], 43)
+
+	parsed, ok := apiKeyPrefix(key)
+	require.True(t, ok)
+	require.Equal(t, prefix, parsed)
+
+	other, _, err := newAPIKey()
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+}
+
+func TestAPIKeyPrefix(t *testing.T) {
+	tests := map[string]string{
+		"empty":         "",
+		"no separators": "gm0123abcdsecret",
+		"no secret":     "gm_0123abcd",
+		"wrong kind":    "sk_0123abcd_secret",
+		"short prefix":  "gm_0123abc_secret",
+		"long prefix":   "gm_0123abcde_secret",
+	}
+
+	for name, key := range tests {
+		prefix, ok := apiKeyPrefix(key)
+
+		require.False(t, ok, name)
+		require.Empty(t, prefix, name)
+	}
+
+	// Secrets are base64url and may contain separators themselves
+	prefix, ok := apiKeyPrefix("gm_0123abcd_sec_ret")
+	require.True(t, ok)
+	require.Equal(t, "0123abcd", prefix)
+}
+
+func TestAPIKeyRequiredRejectsMalformedKey(t *testing.T) {
+	s := &Service{}
+
+	handler := s.apiKeyRequired(scopeOrdersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("request with malformed key reached handler")
+	}))
+
+	for _, key := range []string{"", "Bearer token", "gm_short_secret"} {
+		request := httptest.NewRequest(http.MethodPost, "/api/partner/orders", nil)
+		request.Header.Set(apiKeyHeader, key)
+
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		require.Equal(t, http.StatusUnauthorized, response.Code, key)
+	}
+}
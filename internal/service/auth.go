@@ -1,14 +1,121 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"gophermart/internal/service/storage"
+	"gophermart/internal/service/token"
 )
 
+// issueToken creates a new token for user and sets it as a cookie
+func (s *Service) issueToken(w http.ResponseWriter, user storage.User) error {
+	return s.setTokenCookie(w, user.Name, s.config.TokenDuration, token.WithRole(string(user.Role)))
+}
+
+// issueMFAPendingToken creates a short-lived token good only for passing the second factor
+func (s *Service) issueMFAPendingToken(w http.ResponseWriter, user storage.User) error {
+	return s.setTokenCookie(w, user.Name, s.config.MFAPendingDuration, token.WithMFAPending())
+}
+
+func (s *Service) setTokenCookie(w http.ResponseWriter, userName string, duration time.Duration, opts ...token.PayloadOption) error {
+	newToken, _, err := s.tm.CreateToken(userName, duration, opts...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w,
+		&http.Cookie{
+			Name:  "token",
+			Value: newToken,
+			Path:  "/",
+		})
+
+	return nil
+}
+
+// Login failures which are not storage errors
+var (
+	errLoginLocked        = errors.New("account is temporarily locked")
+	errTooManyAttempts    = errors.New("too many failed attempts")
+	errInvalidCreds       = errors.New("login/password pair does not exists")
+	errAccountBlocked     = errors.New("account blocked")
+	errUnknownReferral    = errors.New("unknown referral code")
+	errSecondFactorNeeded = errors.New("second factor required")
+)
+
+// registerUser creates a user with the welcome bonus and links them to
+// the referrer if a code is given; ip and device screen the referral
+func (s *Service) registerUser(ctx context.Context, user storage.User, referralCode, ip, device string) (storage.User, error) {
+	var referrer storage.User
+	if referralCode != "" && s.referralsEnabled() {
+		var err error
+		referrer, err = s.findReferrer(ctx, referralCode)
+		if err != nil {
+			return storage.User{}, errUnknownReferral
+		}
+	}
+
+	user.HashPassword()
+	user.Role = storage.RoleUser
+
+	err := s.db.CreateUser(ctx, user)
+	if err != nil {
+		return storage.User{}, err
+	}
+
+	s.grantWelcomeBonus(ctx, user.Name)
+
+	if referrer.Name != "" {
+		s.createReferral(ctx, referrer.Name, user.Name, ip, device)
+	}
+
+	return user, nil
+}
+
+// checkCredentials is the password step of logging in. Throttled attempts
+// come with how long to wait; every other attempt is reserved as failed.
+// Attempts are not forgiven here as the second factor may still be pending.
+func (s *Service) checkCredentials(ctx context.Context, user storage.User, throttleKeys []string) (storage.User, time.Duration, error) {
+	retryAfter, locked, err := s.reserveLoginAttempt(ctx, throttleKeys)
+	if err != nil {
+		return storage.User{}, 0, err
+	}
+
+	if locked {
+		return storage.User{}, retryAfter, errLoginLocked
+	}
+
+	if retryAfter > 0 {
+		return storage.User{}, retryAfter, errTooManyAttempts
+	}
+
+	user.HashPassword()
+
+	registeredUser, err := s.db.GetUserByCreds(ctx, user)
+	if errors.Is(err, storage.ErrUserDoesNotExist) {
+		s.audit(ctx, storage.AuditUserLoginFailed, user.Name, "")
+
+		return storage.User{}, 0, errInvalidCreds
+	}
+
+	if err != nil {
+		return storage.User{}, 0, err
+	}
+
+	if registeredUser.Blocked {
+		s.log.Warnf("blocked user %s tried to log in", registeredUser.Name)
+		return storage.User{}, 0, errAccountBlocked
+	}
+
+	return registeredUser, 0, nil
+}
+
 func (s *Service) handleRegister() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -32,10 +139,17 @@ func (s *Service) handleRegister() http.HandlerFunc {
 			return
 		}
 
-		user.HashPassword()
+		referral := registerReferral{}
+		json.Unmarshal(body, &referral)
 
-		err = s.db.CreateUser(r.Context(), user)
+		registeredUser, err := s.registerUser(r.Context(), user, referral.Code, clientIP(r), r.Header.Get(deviceHeader))
 		if err != nil {
+			if errors.Is(err, errUnknownReferral) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"status": "error", "message": "unknown referral code"}`))
+				return
+			}
+
 			if errors.Is(err, storage.ErrUserExists) {
 				s.log.Warnf("user %s tried to register but already exists in DB", user.Name)
 
@@ -51,7 +165,7 @@ func (s *Service) handleRegister() http.HandlerFunc {
 			return
 		}
 
-		token, _, err := s.tm.CreateToken(user.Name, s.config.TokenDuration)
+		err = s.issueToken(w, registeredUser)
 		if err != nil {
 			s.log.Errorf("failed to create new token due to: %s", err)
 
@@ -60,13 +174,7 @@ func (s *Service) handleRegister() http.HandlerFunc {
 			return
 		}
 
-		http.SetCookie(w,
-			&http.Cookie{
-				Name:  "token",
-				Value: token,
-			})
-
-		s.log.Infof("user %s successfully registered", user.Name)
+		s.log.Infof("user %s successfully registered", registeredUser.Name)
 
 		w.Write([]byte(`{"status": "success", "message": "authenticated"}`))
 	})
@@ -95,18 +203,58 @@ func (s *Service) handleLogin() http.HandlerFunc {
 			return
 		}
 
-		user.HashPassword()
+		// Nobody is authenticated yet, attempts are attributed to the login
+		r = r.WithContext(storage.WithAuditActor(r.Context(), user.Name))
+
+		registeredUser, retryAfter, err := s.checkCredentials(r.Context(), user, loginThrottleKeys(user.Name, clientIP(r)))
+		if err != nil {
+			switch {
+			case errors.Is(err, errLoginLocked):
+				writeRetryAfter(w, retryAfter)
+				w.WriteHeader(http.StatusLocked)
+			case errors.Is(err, errTooManyAttempts):
+				writeRetryAfter(w, retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+			case errors.Is(err, errInvalidCreds):
+				s.log.Infof("failed login attempt from %s", clientIP(r))
+				w.WriteHeader(http.StatusUnauthorized)
+			case errors.Is(err, errAccountBlocked):
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				s.log.Errorf("failed to check credentials due to: %s", err)
+
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"status": "error", "message": "failed to authenticate"}`))
+				return
+			}
+
+			w.Write([]byte(fmt.Sprintf(`{"status": "error", "message": "%s"}`, err)))
+			return
+		}
+
+		if registeredUser.TOTPEnabled {
+			// Second factor step reserves an attempt of its own
+			s.releaseLoginAttempt(r.Context(), loginThrottleKeys(user.Name, clientIP(r)))
 
-		registeredUser, err := s.db.GetUserByCreds(r.Context(), user)
-		if errors.Is(err, storage.ErrUserDoesNotExist) {
-			s.log.Warnf("user %s tried to log in but not found in DB", user.Name)
+			err = s.issueMFAPendingToken(w, registeredUser)
+			if err != nil {
+				s.log.Errorf("failed to create new token due to: %s", err)
 
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(`{"status": "error", "message": "login/password pair does not exists"}`))
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"status": "error", "message": "failed to create token"}`))
+				return
+			}
+
+			s.log.Infof("user %s passed password check, second factor pending", registeredUser.Name)
+
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"status": "mfa_required", "message": "second factor required"}`))
 			return
 		}
 
-		token, _, err := s.tm.CreateToken(registeredUser.Name, s.config.TokenDuration)
+		s.forgiveLoginAttempts(r.Context(), loginThrottleKeys(user.Name, clientIP(r)))
+
+		err = s.issueToken(w, registeredUser)
 		if err != nil {
 			s.log.Errorf("failed to create new token due to: %s", err)
 
@@ -115,13 +263,8 @@ func (s *Service) handleLogin() http.HandlerFunc {
 			return
 		}
 
-		http.SetCookie(w,
-			&http.Cookie{
-				Name:  "token",
-				Value: token,
-			})
-
 		s.log.Infof("user %s successfully logged in", registeredUser.Name)
+		s.audit(r.Context(), storage.AuditUserLoggedIn, registeredUser.Name, "password")
 
 		w.Write([]byte(`{"status": "success", "message": "authenticated"}`))
 	})
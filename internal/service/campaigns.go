@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gophermart/internal/service/storage"
+)
+
+type (
+	campaignRequest struct {
+		Kind         storage.CampaignKind `json:"kind"`
+		Code         string               `json:"code"`
+		Name         string               `json:"name"`
+		Points       float32              `json:"points"`
+		Budget       float32              `json:"budget"`
+		PerUserLimit int                  `json:"per_user_limit"`
+		StartsAt     *time.Time           `json:"starts_at"`
+		EndsAt       *time.Time           `json:"ends_at"`
+	}
+
+	promoRequest struct {
+		Code string `json:"code"`
+	}
+)
+
+// normalizePromoCode makes codes case insensitive
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// campaign validates the request and fills in defaults
+func (c campaignRequest) campaign(createdBy string, now time.Time) (storage.Campaign, bool) {
+	if c.Kind == "" {
+		c.Kind = storage.CampaignPromo
+	}
+
+	code := normalizePromoCode(c.Code)
+
+	if !c.Kind.Valid() || strings.TrimSpace(c.Name) == "" || c.Points <= 0 || c.Budget < 0 || c.PerUserLimit < 0 {
+		return storage.Campaign{}, false
+	}
+
+	// Promo codes are redeemed by code, welcome bonuses have none
+	if (c.Kind == storage.CampaignPromo) == (code == "") {
+		return storage.Campaign{}, false
+	}
+
+	campaign := storage.Campaign{
+		Kind:         c.Kind,
+		Name:         c.Name,
+		Points:       c.Points,
+		Budget:       c.Budget,
+		PerUserLimit: c.PerUserLimit,
+		StartsAt:     now,
+		EndsAt:       c.EndsAt,
+		CreatedBy:    createdBy,
+		CreatedAt:    now,
+	}
+
+	if code != "" {
+		campaign.Code = &code
+	}
+
+	if campaign.PerUserLimit == 0 {
+		campaign.PerUserLimit = 1
+	}
+
+	if c.StartsAt != nil {
+		campaign.StartsAt = *c.StartsAt
+	}
+
+	if campaign.EndsAt != nil && !campaign.EndsAt.After(campaign.StartsAt) {
+		return storage.Campaign{}, false
+	}
+
+	return campaign, true
+}
+
+// grantWelcomeBonus credits a new user from an active welcome campaign if any.
+// Registration goes on whether the bonus is granted or not.
+func (s *Service) grantWelcomeBonus(ctx context.Context, userName string) {
+	bonus, err := s.db.GrantWelcomeBonus(ctx, userName, time.Now())
+	if err != nil {
+		if !errors.Is(err, storage.ErrCampaignDoesNotExist) {
+			s.log.Warnf("failed to grant welcome bonus to %s: %s", userName, err)
+		}
+		return
+	}
+
+	s.log.Infof("user %s got welcome bonus of %v points", userName, bonus.Points)
+}
+
+func (s *Service) handleAdminCreateCampaign() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := campaignRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "bad or no payload"}`))
+			return
+		}
+
+		campaign, ok := request.campaign(getUserNameFromRequest(r), time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "name, positive points, a code for promo campaigns and a valid window are required"}`))
+			return
+		}
+
+		campaign, err = s.db.CreateCampaign(r.Context(), campaign)
+		if err != nil {
+			if errors.Is(err, storage.ErrCampaignExists) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "promo code is taken"}`))
+				return
+			}
+
+			s.log.Errorf("failed to create campaign due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create campaign"}`))
+			return
+		}
+
+		res, err := json.Marshal(campaign)
+		if err != nil {
+			s.log.Errorf("failed to marshal campaign due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal campaign"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminCampaigns() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		campaigns, err := s.db.GetCampaigns(r.Context())
+		if err != nil {
+			s.log.Errorf("failed to get campaigns due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get campaigns"}`))
+			return
+		}
+
+		res, err := json.Marshal(campaigns)
+		if err != nil {
+			s.log.Errorf("failed to marshal campaigns due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal campaigns"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleRedeemPromo() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		request := promoRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || normalizePromoCode(request.Code) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "code is required"}`))
+			return
+		}
+
+		bonus, err := s.db.RedeemPromo(r.Context(), normalizePromoCode(request.Code), userName, time.Now())
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrCampaignDoesNotExist):
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "unknown promo code"}`))
+			case errors.Is(err, storage.ErrCampaignInactive), errors.Is(err, storage.ErrCampaignBudgetExceeded):
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(`{"status": "error", "message": "promo code is no longer available"}`))
+			case errors.Is(err, storage.ErrCampaignLimitReached):
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "promo code already redeemed"}`))
+			default:
+				s.log.Errorf("failed to redeem promo code due to: %s", err)
+
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"status": "error", "message": "failed to redeem promo code"}`))
+			}
+			return
+		}
+
+		res, err := json.Marshal(bonus)
+		if err != nil {
+			s.log.Errorf("failed to marshal bonus due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal bonus"}`))
+			return
+		}
+
+		s.log.Infof("user %s redeemed promo code %s", userName, bonus.Campaign)
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleBonuses() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		bonuses, err := s.db.GetBonuses(r.Context(), getUserNameFromRequest(r))
+		if err != nil {
+			s.log.Errorf("failed to get bonuses due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get bonuses"}`))
+			return
+		}
+
+		if len(bonuses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		res, err := json.Marshal(bonuses)
+		if err != nil {
+			s.log.Errorf("failed to marshal bonuses due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal bonuses"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
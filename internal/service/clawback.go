@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gophermart/internal/service/storage"
+)
+
+// recheckOrders periodically asks the accrual system again about orders
+// processed within RecheckWindow and applies revised accruals
+func (s *Service) recheckOrders(ctx context.Context) {
+	s.log.Infof("accrual re-verification started")
+
+	ticker := time.NewTicker(s.config.RecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("accrual re-verification stopped")
+			return
+		case <-ticker.C:
+			orders, err := s.db.GetProcessedOrders(ctx, time.Now().Add(-s.config.RecheckWindow))
+			if err != nil {
+				s.log.Errorf("accrual re-verification failed to get orders from DB: %s", err)
+				continue
+			}
+
+			for _, order := range orders {
+				s.recheckOrder(ctx, order)
+			}
+		}
+	}
+}
+
+func (s *Service) recheckOrder(ctx context.Context, order storage.Order) {
+	revised, ok := s.fetchAccrualOrder(ctx, order)
+	if !ok {
+		return
+	}
+
+	// Only a final answer can revise a processed order
+	if revised.Status != storage.StatusProcessed && revised.Status != storage.StatusInvalid {
+		s.log.Warnf("accrual system reports processed order %s as %s", order.Number, revised.Status)
+		return
+	}
+
+	if revised.Status == order.Status && revised.Accrual == order.BaseAccrual {
+		return
+	}
+
+	err := s.db.ReviseOrder(ctx, revised, storage.ClawbackPolicy(s.config.ClawbackPolicy))
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderNotProcessed) {
+			return
+		}
+
+		s.log.Errorf("accrual re-verification failed to revise order %s in DB: %s", order.Number, err)
+		return
+	}
+
+	s.log.Infof("order %s revised: %s %v -> %s %v", order.Number, order.Status, order.BaseAccrual, revised.Status, revised.Accrual)
+}
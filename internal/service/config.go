@@ -9,16 +9,69 @@ import (
 )
 
 type Config struct {
-	RunAddress     string        `env:"RUN_ADDRESS" envDefault:"localhost:8000"`
-	DatabaseDriver string        `env:"DATABASE_DRIVER" envDefault:"sqlx"`
-	DatabaseURI    string        `env:"DATABASE_URI" envDefault:"postgresql://postgres@localhost:5432?sslmode=disable"`
-	AccrualAddress string        `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"http://localhost:8080"`
-	TokenEngine    string        `env:"TOKEN_ENGINE" envDefault:"paseto"`
-	TokenDuration  time.Duration `env:"TOKEN_DURATION" envDefault:"24h"`
-	Key            string        `env:"SECRET" envDefault:"cuzyouwillneverknowthissecretkey"`
-	LogLevel       string        `env:"LOG_LEVEL" envDefault:"error"`
-	LogFormat      string        `env:"LOG_FORMAT" envDefault:"printf"`
-	Debug          bool
+	RunAddress         string        `env:"RUN_ADDRESS" envDefault:"localhost:8000"`
+	GRPCAddress        string        `env:"GRPC_ADDRESS"`
+	DatabaseDriver     string        `env:"DATABASE_DRIVER" envDefault:"sqlx"`
+	DatabaseURI        string        `env:"DATABASE_URI" envDefault:"postgresql://postgres@localhost:5432?sslmode=disable"`
+	AccrualAddress     string        `env:"ACCRUAL_SYSTEM_ADDRESS" envDefault:"http://localhost:8080"`
+	AccrualProviders   string        `env:"ACCRUAL_PROVIDERS"`
+	AccrualPoll        time.Duration `env:"ACCRUAL_POLL_INTERVAL" envDefault:"1s"`
+	AccrualSecret      string        `env:"ACCRUAL_CALLBACK_SECRET"`
+	TokenEngine        string        `env:"TOKEN_ENGINE" envDefault:"paseto-v4"`
+	TokenDuration      time.Duration `env:"TOKEN_DURATION" envDefault:"24h"`
+	Key                string        `env:"SECRET"`
+	KeyRotation        time.Duration `env:"KEY_ROTATION_INTERVAL" envDefault:"168h"`
+	KeyRefresh         time.Duration `env:"KEY_REFRESH_INTERVAL" envDefault:"1m"`
+	ResetTokenTTL      time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"30m"`
+	MFAPendingDuration time.Duration `env:"MFA_PENDING_DURATION" envDefault:"5m"`
+	TOTPIssuer         string        `env:"TOTP_ISSUER" envDefault:"Gophermart"`
+	AdminUsers         []string      `env:"ADMIN_USERS" envSeparator:","`
+	Notifier           string        `env:"NOTIFIER"`
+	NotifyFile         string        `env:"NOTIFY_FILE" envDefault:"notifications.jsonl"`
+	SMTPAddress        string        `env:"SMTP_ADDRESS"`
+	SMTPFrom           string        `env:"SMTP_FROM"`
+	SMTPUsername       string        `env:"SMTP_USERNAME"`
+	SMTPPassword       string        `env:"SMTP_PASSWORD"`
+	OIDCIssuer         string        `env:"OIDC_ISSUER"`
+	OIDCClientID       string        `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret   string        `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL    string        `env:"OIDC_REDIRECT_URL"`
+	HoldTTL            time.Duration `env:"HOLD_TTL" envDefault:"15m"`
+	HoldSweep          time.Duration `env:"HOLD_SWEEP_INTERVAL" envDefault:"1m"`
+	RecheckWindow      time.Duration `env:"ACCRUAL_RECHECK_WINDOW" envDefault:"0"`
+	RecheckInterval    time.Duration `env:"ACCRUAL_RECHECK_INTERVAL" envDefault:"10m"`
+	ClawbackPolicy     string        `env:"CLAWBACK_POLICY" envDefault:"negative"`
+	PointsLifetime     int           `env:"POINTS_LIFETIME_MONTHS" envDefault:"0"`
+	PointsExpirySweep  time.Duration `env:"POINTS_EXPIRY_INTERVAL" envDefault:"1h"`
+	TransferDailyLimit float32       `env:"TRANSFER_DAILY_LIMIT" envDefault:"1000"`
+	Tiers              string        `env:"TIERS"`
+	TierWindow         time.Duration `env:"TIER_WINDOW" envDefault:"8760h"`
+	TierRecalc         time.Duration `env:"TIER_RECALC_INTERVAL" envDefault:"1h"`
+	ReferrerBonus      float32       `env:"REFERRAL_BONUS_REFERRER" envDefault:"0"`
+	RefereeBonus       float32       `env:"REFERRAL_BONUS_REFEREE" envDefault:"0"`
+	EventsHistory      int           `env:"EVENTS_HISTORY" envDefault:"1000"`
+	Publisher          string        `env:"PUBLISHER" envDefault:"inprocess"`
+	PublisherFile      string        `env:"PUBLISHER_FILE" envDefault:"-"`
+	OutboxInterval     time.Duration `env:"OUTBOX_INTERVAL" envDefault:"1s"`
+	WebhookInterval    time.Duration `env:"WEBHOOK_INTERVAL" envDefault:"5s"`
+	WebhookMaxAttempts int           `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"10"`
+	WebhookBackoff     time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"30s"`
+	LogLevel           string        `env:"LOG_LEVEL" envDefault:"error"`
+	LogFormat          string        `env:"LOG_FORMAT" envDefault:"printf"`
+	LoginThrottle      LoginThrottleConfig
+	Debug              bool
+}
+
+// LoginThrottleConfig defines how failed logins slow down further attempts.
+// After FreeAttempts failures every next attempt waits twice as long starting
+// from BaseDelay; after MaxAttempts the login is locked for Lockout.
+// IP addresses are only throttled, never locked, after IPMaxAttempts.
+type LoginThrottleConfig struct {
+	FreeAttempts  int           `env:"LOGIN_FREE_ATTEMPTS" envDefault:"3"`
+	MaxAttempts   int           `env:"LOGIN_MAX_ATTEMPTS" envDefault:"10"`
+	IPMaxAttempts int           `env:"LOGIN_IP_MAX_ATTEMPTS" envDefault:"50"`
+	BaseDelay     time.Duration `env:"LOGIN_BASE_DELAY" envDefault:"1s"`
+	Lockout       time.Duration `env:"LOGIN_LOCKOUT" envDefault:"15m"`
 }
 
 func PrepareConfig() (Config, error) {
@@ -29,12 +82,15 @@ func PrepareConfig() (Config, error) {
 	}
 
 	flag.StringVar(&cfg.RunAddress, "a", cfg.RunAddress, "Socket to listen on")
+	flag.StringVar(&cfg.GRPCAddress, "g", cfg.GRPCAddress, "Socket to serve gRPC API on")
 	flag.StringVar(&cfg.DatabaseURI, "d", cfg.DatabaseURI, "Database URI")
 	flag.StringVar(&cfg.DatabaseDriver, "o", cfg.DatabaseDriver, "Database driver: gorm/sqlx")
 	flag.StringVar(&cfg.AccrualAddress, "r", cfg.AccrualAddress, "Accrual system address")
-	flag.StringVar(&cfg.TokenEngine, "e", cfg.TokenEngine, "Token engine: jwt/paseto")
+	flag.StringVar(&cfg.TokenEngine, "e", cfg.TokenEngine, "Token engine: paseto-v4/jwt-eddsa/jwt/paseto")
 	flag.DurationVar(&cfg.TokenDuration, "t", cfg.TokenDuration, "Token duration")
-	flag.StringVar(&cfg.Key, "k", cfg.Key, "Secret key")
+	flag.StringVar(&cfg.Key, "k", cfg.Key, "Secret key for symmetric jwt/paseto engines, encrypts signing keys of paseto-v4/jwt-eddsa")
+	flag.DurationVar(&cfg.KeyRotation, "R", cfg.KeyRotation, "Signing key rotation interval")
+	flag.StringVar(&cfg.Notifier, "n", cfg.Notifier, "Notifier: log/file/smtp, password reset is off without one")
 	flag.StringVar(&cfg.LogLevel, "l", cfg.LogLevel, "Log level: debug/info/warn/error")
 	flag.StringVar(&cfg.LogFormat, "f", cfg.LogFormat, "Log foramt: json/printf")
 	flag.BoolVar(&cfg.Debug, "D", false, "Debug mode")
@@ -0,0 +1,109 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// it is dropped; the client then reconnects and catches up from history
+const subscriberBuffer = 16
+
+// Event is a change pushed to a single user
+type Event struct {
+	ID   uint64
+	User string
+	Type string
+	Data []byte
+}
+
+type subscriber struct {
+	user string
+	ch   chan Event
+}
+
+// Broker fans events out to subscribers of their user and keeps the latest
+// ones so reconnecting clients can replay what they missed
+type Broker struct {
+	mu          sync.Mutex
+	lastID      uint64
+	history     []Event
+	next        int
+	subscribers map[*subscriber]struct{}
+}
+
+// NewBroker keeps up to historySize latest events of all users. IDs start
+// from the current time so they keep growing across restarts.
+func NewBroker(historySize int) *Broker {
+	return &Broker{
+		lastID:      uint64(time.Now().UnixMicro()),
+		history:     make([]Event, 0, historySize),
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+func (b *Broker) Publish(user string, eventType string, data []byte) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event := Event{ID: b.lastID, User: user, Type: eventType, Data: data}
+
+	if cap(b.history) > 0 {
+		if len(b.history) < cap(b.history) {
+			b.history = append(b.history, event)
+		} else {
+			b.history[b.next] = event
+			b.next = (b.next + 1) % len(b.history)
+		}
+	}
+
+	for sub := range b.subscribers {
+		if sub.user != user {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			// Slow subscriber, it will catch up after reconnecting
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+
+	return event
+}
+
+// Subscribe returns events of user newer than lastID still in history
+// and a channel of further ones. The channel is closed when cancel is
+// called or the subscriber falls behind.
+func (b *Broker) Subscribe(user string, lastID uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	replay := []Event{}
+	if lastID > 0 {
+		for i := range b.history {
+			event := b.history[(b.next+i)%len(b.history)]
+			if event.User == user && event.ID > lastID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	sub := &subscriber{user: user, ch: make(chan Event, subscriberBuffer)}
+	b.subscribers[sub] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+
+	return replay, sub.ch, cancel
+}
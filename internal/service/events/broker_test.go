@@ -0,0 +1,62 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishFansOutPerUser(t *testing.T) {
+	broker := NewBroker(10)
+
+	_, alice, cancel := broker.Subscribe("alice", 0)
+	defer cancel()
+
+	_, bob, cancelBob := broker.Subscribe("bob", 0)
+	defer cancelBob()
+
+	event := broker.Publish("alice", "order", []byte(`{}`))
+
+	require.Equal(t, event, <-alice)
+	require.Empty(t, bob)
+}
+
+func TestSubscribeReplaysHistory(t *testing.T) {
+	broker := NewBroker(3)
+
+	first := broker.Publish("alice", "order", nil)
+	broker.Publish("bob", "order", nil)
+	second := broker.Publish("alice", "balance", nil)
+	third := broker.Publish("alice", "order", nil)
+
+	replay, _, cancel := broker.Subscribe("alice", first.ID)
+	defer cancel()
+	require.Equal(t, []Event{second, third}, replay)
+
+	// The first event is pushed out of history by now
+	replay, _, cancel = broker.Subscribe("alice", first.ID-1)
+	defer cancel()
+	require.Equal(t, []Event{second, third}, replay)
+
+	replay, _, cancel = broker.Subscribe("alice", 0)
+	defer cancel()
+	require.Empty(t, replay)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	broker := NewBroker(0)
+
+	_, ch, cancel := broker.Subscribe("alice", 0)
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		broker.Publish("alice", "order", nil)
+	}
+
+	received := 0
+	for range ch {
+		received++
+	}
+
+	require.Equal(t, subscriberBuffer, received)
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// expirePoints periodically debits lots which outlived PointsLifetime
+func (s *Service) expirePoints(ctx context.Context) {
+	s.log.Infof("points expiration started")
+
+	ticker := time.NewTicker(s.config.PointsExpirySweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("points expiration stopped")
+			return
+		case <-ticker.C:
+			expired, err := s.db.ExpirePoints(ctx, time.Now())
+			if err != nil {
+				s.log.Errorf("points expiration failed to expire points: %s", err)
+				continue
+			}
+
+			if expired > 0 {
+				s.log.Infof("points expiration debited expired points of %d users", expired)
+			}
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"gophermart/internal/service/events"
+	"gophermart/internal/service/pb"
+	"gophermart/internal/service/storage"
+	"gophermart/internal/service/token"
+)
+
+const (
+	grpcAuthMetadata      = "authorization"
+	grpcRequestIDMetadata = "x-request-id"
+	grpcRetryAfterHeader  = "retry-after"
+)
+
+// grpcPublicMethods are served without a token
+var grpcPublicMethods = map[string]bool{
+	pb.Gophermart_Register_FullMethodName: true,
+	pb.Gophermart_Login_FullMethodName:    true,
+}
+
+var pbOrderStatuses = map[storage.Status]pb.OrderStatus{
+	storage.StatusNew:        pb.OrderStatus_ORDER_STATUS_NEW,
+	storage.StatusRegistered: pb.OrderStatus_ORDER_STATUS_REGISTERED,
+	storage.StatusProcessing: pb.OrderStatus_ORDER_STATUS_PROCESSING,
+	storage.StatusInvalid:    pb.OrderStatus_ORDER_STATUS_INVALID,
+	storage.StatusProcessed:  pb.OrderStatus_ORDER_STATUS_PROCESSED,
+}
+
+// grpcServer mirrors the user HTTP API over gRPC
+type grpcServer struct {
+	pb.UnimplementedGophermartServer
+	s *Service
+}
+
+// authenticatedStream carries the context filled in by the auth interceptor
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a authenticatedStream) Context() context.Context {
+	return a.ctx
+}
+
+func (s *Service) serveGRPC(ctx context.Context) {
+	listener, err := net.Listen("tcp", s.config.GRPCAddress)
+	if err != nil {
+		s.log.Fatalf("failed to listen for gRPC due to: %s", err)
+	}
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(s.grpcAuthUnary),
+		grpc.StreamInterceptor(s.grpcAuthStream),
+	)
+	pb.RegisterGophermartServer(server, &grpcServer{s: s})
+
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+
+	s.log.Infof("gophermart gRPC server started at: %s", s.config.GRPCAddress)
+
+	err = server.Serve(listener)
+	if err != nil {
+		s.log.Fatalf("gRPC server crashed due to: %s", err)
+	}
+
+	s.log.Infof("gophermart gRPC server stopped")
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func getUserNameFromContext(ctx context.Context) string {
+	return ctx.Value(contextUserNameKey).(string)
+}
+
+// grpcAuthenticate does for gRPC calls what auditContext and loginRequired
+// do for HTTP requests; the token comes as "authorization: Bearer <token>"
+func (s *Service) grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	ctx = storage.WithAuditInfo(ctx, storage.AuditInfo{
+		RequestID: metadataValue(ctx, grpcRequestIDMetadata),
+		IP:        peerIP(ctx),
+	})
+
+	if grpcPublicMethods[method] {
+		return ctx, nil
+	}
+
+	bearer := metadataValue(ctx, grpcAuthMetadata)
+	if !strings.HasPrefix(bearer, "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "not authenticated")
+	}
+
+	payload, user, err := s.verifyToken(ctx, strings.TrimPrefix(bearer, "Bearer "))
+	if err != nil {
+		if errors.Is(err, errAccountBlocked) {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if payload.MFAPending {
+		return nil, status.Error(codes.Unauthenticated, errSecondFactorNeeded.Error())
+	}
+
+	// Role changes revoke sessions so the claim is always up to date
+	role := storage.Role(payload.Role)
+	if !role.Valid() {
+		role = storage.RoleUser
+	}
+
+	ctx = context.WithValue(ctx, contextUserNameKey, user.Name)
+	ctx = context.WithValue(ctx, contextUserRoleKey, role)
+	ctx = storage.WithAuditActor(ctx, user.Name)
+
+	return ctx, nil
+}
+
+func (s *Service) grpcAuthUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *Service) grpcAuthStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, authenticatedStream{ss, ctx})
+}
+
+func newPBOrder(order storage.Order) *pb.Order {
+	return &pb.Order{
+		Number:     order.Number,
+		Status:     pbOrderStatuses[order.Status],
+		Accrual:    order.Accrual,
+		UploadedAt: timestamppb.New(order.UploadedAt),
+	}
+}
+
+func newPBBalance(balance storage.Balance) *pb.Balance {
+	return &pb.Balance{
+		Current:   balance.Current,
+		Withdrawn: balance.Withdrawn,
+		Held:      balance.Held,
+		Available: balance.Available,
+		Debt:      balance.Debt,
+	}
+}
+
+// newPBOrderEvent decodes an event published for SSE clients
+func newPBOrderEvent(event events.Event) (*pb.OrderEvent, error) {
+	orderEvent := &pb.OrderEvent{Id: event.ID}
+
+	switch event.Type {
+	case eventOrder:
+		order := storage.Order{}
+		if err := json.Unmarshal(event.Data, &order); err != nil {
+			return nil, err
+		}
+
+		orderEvent.Update = &pb.OrderEvent_Order{Order: newPBOrder(order)}
+	case eventBalance:
+		balance := storage.Balance{}
+		if err := json.Unmarshal(event.Data, &balance); err != nil {
+			return nil, err
+		}
+
+		orderEvent.Update = &pb.OrderEvent_Balance{Balance: newPBBalance(balance)}
+	}
+
+	return orderEvent, nil
+}
+
+func (g *grpcServer) newAuthResponse(user storage.User) (*pb.AuthResponse, error) {
+	newToken, payload, err := g.s.tm.CreateToken(user.Name, g.s.config.TokenDuration, token.WithRole(string(user.Role)))
+	if err != nil {
+		g.s.log.Errorf("failed to create new token due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to create token")
+	}
+
+	return &pb.AuthResponse{Token: newToken, ExpiresAt: timestamppb.New(payload.ExpiredAt)}, nil
+}
+
+func (g *grpcServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.AuthResponse, error) {
+	if req.Login == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "login and password are required")
+	}
+
+	user, err := g.s.registerUser(ctx, storage.User{Name: req.Login, Password: req.Password}, req.ReferralCode, peerIP(ctx), req.DeviceId)
+	if err != nil {
+		if errors.Is(err, errUnknownReferral) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if errors.Is(err, storage.ErrUserExists) {
+			g.s.log.Warnf("user %s tried to register but already exists in DB", req.Login)
+			return nil, status.Error(codes.AlreadyExists, "user already exists")
+		}
+
+		g.s.log.Errorf("failed to save user to DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to register user")
+	}
+
+	g.s.log.Infof("user %s successfully registered", user.Name)
+
+	return g.newAuthResponse(user)
+}
+
+// Login takes the second factor in the same call, there is no pending token
+func (g *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.AuthResponse, error) {
+	// Nobody is authenticated yet, attempts are attributed to the login
+	ctx = storage.WithAuditActor(ctx, req.Login)
+
+	throttleKeys := loginThrottleKeys(req.Login, peerIP(ctx))
+
+	user, retryAfter, err := g.s.checkCredentials(ctx, storage.User{Name: req.Login, Password: req.Password}, throttleKeys)
+	if err != nil {
+		switch {
+		case errors.Is(err, errLoginLocked), errors.Is(err, errTooManyAttempts):
+			grpc.SetHeader(ctx, metadata.Pairs(grpcRetryAfterHeader, strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))))
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case errors.Is(err, errInvalidCreds):
+			g.s.log.Infof("failed login attempt from %s", peerIP(ctx))
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		case errors.Is(err, errAccountBlocked):
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		default:
+			g.s.log.Errorf("failed to check credentials due to: %s", err)
+			return nil, status.Error(codes.Internal, "failed to authenticate")
+		}
+	}
+
+	method := "password"
+
+	if user.TOTPEnabled {
+		if req.TotpCode == "" && req.RecoveryCode == "" {
+			g.s.releaseLoginAttempt(ctx, throttleKeys)
+			return nil, status.Error(codes.FailedPrecondition, errSecondFactorNeeded.Error())
+		}
+
+		err = g.s.verifySecondFactor(ctx, user, secondFactor{Code: req.TotpCode, RecoveryCode: req.RecoveryCode})
+		if err != nil {
+			if errors.Is(err, errInvalidSecondFactor) {
+				g.s.log.Infof("failed second factor attempt from %s", peerIP(ctx))
+				g.s.audit(ctx, storage.AuditUserMFAFailed, user.Name, "")
+
+				return nil, status.Error(codes.Unauthenticated, "invalid code")
+			}
+
+			g.s.log.Errorf("failed to verify second factor due to: %s", err)
+			return nil, status.Error(codes.Internal, "failed to authenticate")
+		}
+
+		method = "mfa"
+	}
+
+	// The password alone does not forgive attempts, or every call would
+	// clear the counter before taking another guess at the second factor
+	g.s.forgiveLoginAttempts(ctx, throttleKeys)
+
+	response, err := g.newAuthResponse(user)
+	if err != nil {
+		return nil, err
+	}
+
+	g.s.log.Infof("user %s successfully logged in", user.Name)
+	g.s.audit(ctx, storage.AuditUserLoggedIn, user.Name, method)
+
+	return response, nil
+}
+
+func (g *grpcServer) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	userName := getUserNameFromContext(ctx)
+
+	err := g.s.uploadOrder(ctx, userName, req.Number)
+	if err != nil {
+		if errors.Is(err, errInvalidOrderNumber) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if errors.Is(err, storage.ErrOrderAlreadyRegisteredByUser) {
+			return &pb.UploadOrderResponse{AlreadyUploaded: true}, nil
+		}
+
+		if errors.Is(err, storage.ErrOrderAlreadyRegisteredBySomeoneElse) {
+			g.s.log.Warnf("%s tried to register order %s but someone else already did this earlier", userName, req.Number)
+			return nil, status.Error(codes.AlreadyExists, "order already registered by another user")
+		}
+
+		g.s.log.Errorf("failed to save order to DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to register order")
+	}
+
+	g.s.log.Infof("order %s successfully registered by %s", req.Number, userName)
+
+	return &pb.UploadOrderResponse{}, nil
+}
+
+func (g *grpcServer) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	orders, err := g.s.db.GetUserOrders(ctx, getUserNameFromContext(ctx), "uploaded_at")
+	if err != nil {
+		g.s.log.Errorf("failed to get user orders from DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to get orders")
+	}
+
+	response := &pb.ListOrdersResponse{Orders: make([]*pb.Order, 0, len(orders))}
+	for _, order := range orders {
+		response.Orders = append(response.Orders, newPBOrder(order))
+	}
+
+	return response, nil
+}
+
+func (g *grpcServer) GetBalance(ctx context.Context, req *pb.GetBalanceRequest) (*pb.Balance, error) {
+	balance, err := g.s.db.GetUserBalance(ctx, getUserNameFromContext(ctx))
+	if err != nil {
+		g.s.log.Errorf("failed to get user balance from DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to get balance")
+	}
+
+	return newPBBalance(balance), nil
+}
+
+func (g *grpcServer) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	userName := getUserNameFromContext(ctx)
+
+	err := g.s.withdraw(ctx, storage.Withdrawal{RegisteredBy: userName, Order: req.Order, Sum: req.Sum})
+	if err != nil {
+		if errors.Is(err, errInvalidOrderNumber) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if errors.Is(err, storage.ErrNotEnoughPoints) {
+			g.s.log.Warnf("user %s has not enough points to process withdrawal", userName)
+			return nil, status.Error(codes.FailedPrecondition, "not enough points to withdraw")
+		}
+
+		g.s.log.Errorf("failed to save withdrawal to DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to withdraw")
+	}
+
+	g.s.log.Infof("user %s successfully withdrew some points", userName)
+
+	return &pb.WithdrawResponse{}, nil
+}
+
+func (g *grpcServer) ListWithdrawals(ctx context.Context, req *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	withdrawals, err := g.s.db.GetWithdrawals(ctx, getUserNameFromContext(ctx), "processed_at")
+	if err != nil {
+		g.s.log.Errorf("failed to get withdrawals from DB due to: %s", err)
+		return nil, status.Error(codes.Internal, "failed to get withdrawals")
+	}
+
+	response := &pb.ListWithdrawalsResponse{Withdrawals: make([]*pb.Withdrawal, 0, len(withdrawals))}
+	for _, withdrawal := range withdrawals {
+		response.Withdrawals = append(response.Withdrawals, &pb.Withdrawal{
+			Order:       withdrawal.Order,
+			Sum:         withdrawal.Sum,
+			Refunded:    withdrawal.Refunded,
+			ProcessedAt: timestamppb.New(withdrawal.ProcessedAt),
+		})
+	}
+
+	return response, nil
+}
+
+// WatchOrders streams the same events as the SSE endpoint
+func (g *grpcServer) WatchOrders(req *pb.WatchOrdersRequest, stream pb.Gophermart_WatchOrdersServer) error {
+	userName := getUserNameFromContext(stream.Context())
+
+	replay, updates, cancel := g.s.events.Subscribe(userName, req.LastEventId)
+	defer cancel()
+
+	send := func(event events.Event) error {
+		orderEvent, err := newPBOrderEvent(event)
+		if err != nil {
+			g.s.log.Errorf("failed to decode event %d: %s", event.ID, err)
+			return status.Error(codes.Internal, "failed to decode event")
+		}
+
+		return stream.Send(orderEvent)
+	}
+
+	for _, event := range replay {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-updates:
+			if !ok {
+				g.s.log.Infof("gRPC event stream of %s fell behind and is closed", userName)
+				return status.Error(codes.Unavailable, "event stream fell behind, reconnect with the last event ID")
+			}
+
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,34 +1,63 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
+	"gophermart/internal/service/accrual"
 	"gophermart/internal/service/storage"
-
-	"github.com/theplant/luhn"
 )
 
 func getUserNameFromRequest(r *http.Request) string {
 	return r.Context().Value(contextUserNameKey).(string)
 }
 
-func validLuhn(orderNumber string) bool {
-	orderNum, err := strconv.Atoi(orderNumber)
-	if err != nil {
-		return false
+func getUserRoleFromRequest(r *http.Request) storage.Role {
+	return r.Context().Value(contextUserRoleKey).(storage.Role)
+}
+
+// routeOrder picks the accrual provider serving the order number and
+// checks the number against its scheme; partner is empty for users
+func (s *Service) routeOrder(number, partner string) (*accrual.Provider, bool) {
+	provider, err := s.accrual.Route(number, partner)
+	if err != nil || !provider.Valid(number) {
+		return nil, false
+	}
+
+	return provider, true
+}
+
+var errInvalidOrderNumber = errors.New("order number is incorrect")
+
+// uploadOrder registers the order of user with the provider serving it
+func (s *Service) uploadOrder(ctx context.Context, userName, number string) error {
+	provider, ok := s.routeOrder(number, "")
+	if !ok {
+		return errInvalidOrderNumber
 	}
 
-	if !luhn.Valid(orderNum) {
-		return false
+	return s.db.SaveOrder(ctx, storage.Order{
+		RegisteredBy: userName,
+		Number:       number,
+		UploadedAt:   time.Now(),
+		Provider:     provider.Name(),
+	})
+}
+
+// withdraw pays for a new order with points of user
+func (s *Service) withdraw(ctx context.Context, withdrawal storage.Withdrawal) error {
+	if _, ok := s.routeOrder(withdrawal.Order, ""); !ok {
+		return errInvalidOrderNumber
 	}
 
-	return true
+	withdrawal.ProcessedAt = time.Now()
+
+	return s.db.SaveWithdrawal(ctx, withdrawal)
 }
 
 func (s *Service) handleNewOrder() http.HandlerFunc {
@@ -44,18 +73,13 @@ func (s *Service) handleNewOrder() http.HandlerFunc {
 		}
 
 		orderNumberString := strings.TrimSuffix(string(body), "\n")
-		if !validLuhn(orderNumberString) {
-			http.Error(w, "order number is incorrect", http.StatusUnprocessableEntity)
-			return
-		}
 
-		newOrder := storage.Order{
-			RegisteredBy: userName,
-			Number:       orderNumberString,
-			UploadedAt:   time.Now(),
-		}
+		if err := s.uploadOrder(r.Context(), userName, orderNumberString); err != nil {
+			if errors.Is(err, errInvalidOrderNumber) {
+				http.Error(w, "order number is incorrect", http.StatusUnprocessableEntity)
+				return
+			}
 
-		if err := s.db.SaveOrder(r.Context(), newOrder); err != nil {
 			if errors.Is(err, storage.ErrOrderAlreadyRegisteredByUser) {
 				s.log.Warnf("%s tried to register order %s but already did this earlier", userName, orderNumberString)
 
@@ -161,15 +185,14 @@ func (s *Service) handleWithdrawal() http.HandlerFunc {
 		}
 
 		withdrawal.RegisteredBy = userName
-		withdrawal.ProcessedAt = time.Now()
 
-		if !validLuhn(withdrawal.Order) {
-			http.Error(w, "order number is incorrect", http.StatusUnprocessableEntity)
-			return
-		}
-
-		err = s.db.SaveWithdrawal(r.Context(), withdrawal)
+		err = s.withdraw(r.Context(), withdrawal)
 		if err != nil {
+			if errors.Is(err, errInvalidOrderNumber) {
+				http.Error(w, "order number is incorrect", http.StatusUnprocessableEntity)
+				return
+			}
+
 			if errors.Is(err, storage.ErrNotEnoughPoints) {
 				s.log.Warnf("user %s has not enough points to process withdrawal", userName)
 
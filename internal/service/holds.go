@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/storage"
+)
+
+type holdRequest struct {
+	Order string  `json:"order"`
+	Sum   float32 `json:"sum"`
+}
+
+// releaseHolds periodically returns points of expired holds to their owners
+func (s *Service) releaseHolds(ctx context.Context) {
+	s.log.Infof("hold releaser started")
+
+	ticker := time.NewTicker(s.config.HoldSweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("hold releaser stopped")
+			return
+		case <-ticker.C:
+			released, err := s.db.ReleaseExpiredHolds(ctx, time.Now())
+			if err != nil {
+				s.log.Errorf("hold releaser failed to release expired holds: %s", err)
+				continue
+			}
+
+			if released > 0 {
+				s.log.Infof("hold releaser released %d expired holds", released)
+			}
+		}
+	}
+}
+
+func (s *Service) handleNewHold() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		request := holdRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Sum <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "order and positive sum are required"}`))
+			return
+		}
+
+		if _, ok := s.routeOrder(request.Order, ""); !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "message": "order number is incorrect"}`))
+			return
+		}
+
+		now := time.Now()
+
+		hold, err := s.db.CreateHold(r.Context(), storage.Hold{
+			UserName:  userName,
+			Order:     request.Order,
+			Sum:       request.Sum,
+			CreatedAt: now,
+			ExpiresAt: now.Add(s.config.HoldTTL),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrNotEnoughPoints) {
+				w.WriteHeader(http.StatusPaymentRequired)
+				w.Write([]byte(`{"status": "error", "message": "not enough points to hold"}`))
+				return
+			}
+
+			s.log.Errorf("failed to create hold due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create hold"}`))
+			return
+		}
+
+		res, err := json.Marshal(hold)
+		if err != nil {
+			s.log.Errorf("failed to marshal hold due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal hold"}`))
+			return
+		}
+
+		s.log.Infof("user %s held %v points for order %s", userName, hold.Sum, hold.Order)
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleHolds() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		holds, err := s.db.GetHolds(r.Context(), getUserNameFromRequest(r))
+		if err != nil {
+			s.log.Errorf("failed to get holds from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get holds"}`))
+			return
+		}
+
+		res, err := json.Marshal(holds)
+		if err != nil {
+			s.log.Errorf("failed to marshal holds due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal holds"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
+
+// handleResolveHold confirms a hold into a withdrawal or cancels it
+func (s *Service) handleResolveHold(confirm bool) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "invalid hold id"}`))
+			return
+		}
+
+		resolve := s.db.CancelHold
+		if confirm {
+			resolve = s.db.ConfirmHold
+		}
+
+		err = resolve(r.Context(), userName, id, time.Now())
+		if err != nil {
+			if errors.Is(err, storage.ErrHoldDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "no active hold found"}`))
+				return
+			}
+
+			if errors.Is(err, storage.ErrHoldExpired) {
+				w.WriteHeader(http.StatusGone)
+				w.Write([]byte(`{"status": "error", "message": "hold expired"}`))
+				return
+			}
+
+			s.log.Errorf("failed to resolve hold due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to resolve hold"}`))
+			return
+		}
+
+		if confirm {
+			s.log.Infof("user %s confirmed hold %d", userName, id)
+			w.Write([]byte(`{"status": "success", "message": "withdrawal registered"}`))
+			return
+		}
+
+		s.log.Infof("user %s cancelled hold %d", userName, id)
+		w.Write([]byte(`{"status": "success", "message": "hold cancelled"}`))
+	})
+}
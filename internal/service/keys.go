@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gophermart/internal/service/storage"
+	"gophermart/internal/service/token"
+)
+
+func (s *Service) rotateKeys(ctx context.Context) {
+	s.log.Infof("signing key rotator started")
+
+	ticker := time.NewTicker(s.config.KeyRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("signing key rotator stopped")
+			return
+		case <-ticker.C:
+			err := s.refreshKeys(ctx)
+			if err != nil {
+				s.log.Errorf("signing key rotator failed to refresh keys: %s", err)
+			}
+		}
+	}
+}
+
+// refreshKeys reloads signing keys from DB so every replica shares them,
+// generates a new key when the newest one is due for rotation and drops
+// keys no longer able to have signed an unexpired token. Keys which can
+// not be decrypted, e.g. stored in plaintext by older versions, are skipped.
+func (s *Service) refreshKeys(ctx context.Context) error {
+	storedKeys, err := s.db.GetSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A key signs for KeyRotation at most and its tokens live for TokenDuration
+	retireBefore := time.Now().Add(-s.config.KeyRotation - s.config.KeyRefresh - s.config.TokenDuration)
+
+	keys := []token.SigningKey{}
+	for _, storedKey := range storedKeys {
+		if storedKey.CreatedAt.Before(retireBefore) {
+			continue
+		}
+
+		key, err := s.restoreKey(storedKey)
+		if err != nil {
+			s.log.Errorf("skipping signing key %s: %s", storedKey.ID, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 || time.Since(keys[0].CreatedAt) >= s.config.KeyRotation {
+		newKey, err := token.GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+
+		sealedSeed, err := s.keyCipher.Seal(newKey.ID, newKey.PrivateKey.Seed())
+		if err != nil {
+			return err
+		}
+
+		err = s.db.SaveSigningKey(ctx, storage.SigningKey{
+			ID:        newKey.ID,
+			Seed:      sealedSeed,
+			CreatedAt: newKey.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		s.log.Infof("generated new signing key %s", newKey.ID)
+
+		keys = append([]token.SigningKey{newKey}, keys...)
+	}
+
+	err = s.db.DeleteSigningKeys(ctx, retireBefore)
+	if err != nil {
+		return err
+	}
+
+	s.keys.Replace(keys)
+
+	return nil
+}
+
+func (s *Service) restoreKey(storedKey storage.SigningKey) (token.SigningKey, error) {
+	seed, err := s.keyCipher.Open(storedKey.ID, storedKey.Seed)
+	if err != nil {
+		return token.SigningKey{}, err
+	}
+
+	key, err := token.NewSigningKey(seed, storedKey.CreatedAt)
+	if err != nil {
+		return token.SigningKey{}, fmt.Errorf("failed to restore signing key %s: %w", storedKey.ID, err)
+	}
+
+	return key, nil
+}
+
+func (s *Service) handleJWKS() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		res, err := json.Marshal(s.keys.JWKS())
+		if err != nil {
+			s.log.Errorf("failed to marshal JWKS due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal keys"}`))
+			return
+		}
+
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.config.KeyRefresh.Seconds())))
+
+		w.Write(res)
+	})
+}
@@ -0,0 +1,367 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gophermart/internal/service/storage"
+	"gophermart/internal/service/totp"
+)
+
+const (
+	recoveryCodesCount = 10
+	// Codes from adjacent time steps are accepted to tolerate clock drift
+	totpSkew = 1
+)
+
+var errInvalidSecondFactor = errors.New("invalid second factor")
+
+type (
+	secondFactor struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	totpEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+
+	totpRecoveryCodes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+)
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	hashes := make([]string, 0, recoveryCodesCount)
+
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// verifySecondFactor checks either TOTP code or recovery code and burns it
+func (s *Service) verifySecondFactor(ctx context.Context, user storage.User, factor secondFactor) error {
+	if factor.Code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, factor.Code, time.Now(), totpSkew)
+		if !ok {
+			return errInvalidSecondFactor
+		}
+
+		err := s.db.UseTOTPStep(ctx, user.Name, step)
+		if errors.Is(err, storage.ErrTOTPCodeReused) {
+			return errInvalidSecondFactor
+		}
+
+		return err
+	}
+
+	if factor.RecoveryCode != "" {
+		err := s.db.UseRecoveryCode(ctx, user.Name, hashToken(normalizeRecoveryCode(factor.RecoveryCode)))
+		if errors.Is(err, storage.ErrInvalidRecoveryCode) {
+			return errInvalidSecondFactor
+		}
+
+		if err == nil {
+			s.log.Warnf("user %s used a recovery code", user.Name)
+		}
+
+		return err
+	}
+
+	return errInvalidSecondFactor
+}
+
+func (s *Service) handleTOTPEnroll() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			s.log.Errorf("failed to generate totp secret due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to enroll"}`))
+			return
+		}
+
+		err = s.db.SetTOTPSecret(r.Context(), userName, secret)
+		if err != nil {
+			if errors.Is(err, storage.ErrTOTPAlreadyEnabled) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "two-factor authentication already enabled"}`))
+				return
+			}
+
+			s.log.Errorf("failed to save totp secret due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to enroll"}`))
+			return
+		}
+
+		res, err := json.Marshal(totpEnrollment{
+			Secret: secret,
+			URI:    totp.URI(s.config.TOTPIssuer, userName, secret),
+		})
+		if err != nil {
+			s.log.Errorf("failed to marshal totp enrollment due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to enroll"}`))
+			return
+		}
+
+		s.log.Infof("user %s started totp enrollment", userName)
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleTOTPConfirm() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		factor := secondFactor{}
+		err := json.NewDecoder(r.Body).Decode(&factor)
+		if err != nil || factor.Code == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		user, err := s.db.GetUserByName(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to get user from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to confirm enrollment"}`))
+			return
+		}
+
+		if user.TOTPEnabled {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"status": "error", "message": "two-factor authentication already enabled"}`))
+			return
+		}
+
+		if user.TOTPSecret == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "enrollment not started"}`))
+			return
+		}
+
+		step, ok := totp.Validate(user.TOTPSecret, factor.Code, time.Now(), totpSkew)
+		if !ok {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "message": "invalid code"}`))
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			s.log.Errorf("failed to generate recovery codes due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to confirm enrollment"}`))
+			return
+		}
+
+		err = s.db.EnableTOTP(r.Context(), userName, step, hashes)
+		if err != nil {
+			if errors.Is(err, storage.ErrTOTPAlreadyEnabled) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "two-factor authentication already enabled"}`))
+				return
+			}
+
+			s.log.Errorf("failed to enable totp due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to confirm enrollment"}`))
+			return
+		}
+
+		res, err := json.Marshal(totpRecoveryCodes{codes})
+		if err != nil {
+			s.log.Errorf("failed to marshal recovery codes due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal recovery codes"}`))
+			return
+		}
+
+		s.log.Infof("user %s enabled two-factor authentication", userName)
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleTOTPDisable() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		factor := secondFactor{}
+		err := json.NewDecoder(r.Body).Decode(&factor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		user, err := s.db.GetUserByName(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to get user from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to disable two-factor authentication"}`))
+			return
+		}
+
+		if !user.TOTPEnabled {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"status": "error", "message": "two-factor authentication is not enabled"}`))
+			return
+		}
+
+		err = s.verifySecondFactor(r.Context(), user, factor)
+		if err != nil {
+			if errors.Is(err, errInvalidSecondFactor) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"status": "error", "message": "invalid code"}`))
+				return
+			}
+
+			s.log.Errorf("failed to verify second factor due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to disable two-factor authentication"}`))
+			return
+		}
+
+		err = s.db.DisableTOTP(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to disable totp due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to disable two-factor authentication"}`))
+			return
+		}
+
+		s.log.Infof("user %s disabled two-factor authentication", userName)
+
+		w.Write([]byte(`{"status": "success", "message": "two-factor authentication disabled"}`))
+	})
+}
+
+func (s *Service) handleLoginMFA() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		factor := secondFactor{}
+		err := json.NewDecoder(r.Body).Decode(&factor)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		// Second factor guesses count towards the same limits as passwords
+		throttleKeys := loginThrottleKeys(userName, clientIP(r))
+
+		retryAfter, locked, err := s.reserveLoginAttempt(r.Context(), throttleKeys)
+		if err != nil {
+			s.log.Errorf("failed to check login attempts due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to authenticate"}`))
+			return
+		}
+
+		if locked {
+			writeRetryAfter(w, retryAfter)
+			w.WriteHeader(http.StatusLocked)
+			w.Write([]byte(`{"status": "error", "message": "account is temporarily locked"}`))
+			return
+		}
+
+		if retryAfter > 0 {
+			writeRetryAfter(w, retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"status": "error", "message": "too many failed attempts"}`))
+			return
+		}
+
+		user, err := s.db.GetUserByName(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to get user from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to authenticate"}`))
+			return
+		}
+
+		err = s.verifySecondFactor(r.Context(), user, factor)
+		if err != nil {
+			if errors.Is(err, errInvalidSecondFactor) {
+				s.log.Infof("failed second factor attempt from %s", clientIP(r))
+				s.audit(r.Context(), storage.AuditUserMFAFailed, userName, "")
+
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "error", "message": "invalid code"}`))
+				return
+			}
+
+			s.log.Errorf("failed to verify second factor due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to authenticate"}`))
+			return
+		}
+
+		s.forgiveLoginAttempts(r.Context(), throttleKeys)
+
+		err = s.issueToken(w, user)
+		if err != nil {
+			s.log.Errorf("failed to create new token due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create token"}`))
+			return
+		}
+
+		s.log.Infof("user %s successfully logged in", userName)
+		s.audit(r.Context(), storage.AuditUserLoggedIn, userName, "mfa")
+
+		w.Write([]byte(`{"status": "success", "message": "authenticated"}`))
+	})
+}
@@ -9,6 +9,9 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/go-chi/chi/v5/middleware"
+
+	"gophermart/internal/service/storage"
 	"gophermart/internal/service/token"
 )
 
@@ -18,6 +21,15 @@ const (
 	payloadLimitBytes = 100000
 
 	contextUserNameKey ctxKey = iota
+	contextUserRoleKey
+	contextPartnerKey
+)
+
+var (
+	errExpiredToken   = errors.New("expired token")
+	errInvalidToken   = errors.New("invalid token")
+	errUserNotFound   = errors.New("user not found")
+	errSessionRevoked = errors.New("session revoked")
 )
 
 func (s *Service) logRequest(next http.Handler) http.Handler {
@@ -46,54 +58,154 @@ func (s *Service) logRequest(next http.Handler) http.Handler {
 	})
 }
 
+// authenticate verifies request token and its user. On failure an error
+// response is already written and false is returned.
+func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) (*token.Payload, storage.User, bool) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil {
+		if err == http.ErrNoCookie {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "message": "not authenticated"}`))
+			return nil, storage.User{}, false
+		}
+
+		s.log.Errorf("failed to get token from cookie due to: %s", err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"status": "error", "message": "failed to parse cookies"}`))
+		return nil, storage.User{}, false
+	}
+
+	payload, user, err := s.verifyToken(r.Context(), tokenCookie.Value)
+	if err != nil {
+		if errors.Is(err, errAccountBlocked) {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+
+		w.Write([]byte(fmt.Sprintf(`{"status": "error", "message": "%s"}`, err)))
+		return nil, storage.User{}, false
+	}
+
+	return payload, user, true
+}
+
+// verifyToken checks the token and that its user may still use it
+func (s *Service) verifyToken(ctx context.Context, tokenString string) (*token.Payload, storage.User, error) {
+	payload, err := s.tm.VerifyToken(tokenString)
+	if err != nil {
+		if errors.Is(err, token.ErrExpiredToken) {
+			return nil, storage.User{}, errExpiredToken
+		}
+
+		return nil, storage.User{}, errInvalidToken
+	}
+
+	user, err := s.db.GetUserByName(ctx, payload.Username)
+	if err != nil {
+		return nil, storage.User{}, errUserNotFound
+	}
+
+	if payload.IssuedAt.Before(user.SessionsValidAfter) {
+		return nil, storage.User{}, errSessionRevoked
+	}
+
+	if user.Blocked {
+		return nil, storage.User{}, errAccountBlocked
+	}
+
+	return payload, user, nil
+}
+
 func (s *Service) loginRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "application/json")
 
-		tokenCookie, err := r.Cookie("token")
-		if err != nil {
-			if err == http.ErrNoCookie {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte(`{"status": "error", "message": "not authenticated"}`))
-				return
-			}
-
-			s.log.Errorf("failed to get token from cookie due to: %s", err)
+		payload, user, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
 
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(`{"status": "error", "message": "failed to parse cookies"}`))
+		if payload.MFAPending {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "message": "second factor required"}`))
 			return
 		}
 
-		payload, err := s.tm.VerifyToken(tokenCookie.Value)
-		if err != nil {
-			if errors.Is(err, token.ErrInvalidToken) {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte(`{"status": "error", "message": "invalid token"}`))
-				return
-			}
+		// Role changes revoke sessions so the claim is always up to date
+		role := storage.Role(payload.Role)
+		if !role.Valid() {
+			role = storage.RoleUser
+		}
 
-			if errors.Is(err, token.ErrExpiredToken) {
-				w.WriteHeader(http.StatusUnauthorized)
-				w.Write([]byte(`{"status": "error", "message": "expired token"}`))
-				return
-			}
+		ctx := context.WithValue(r.Context(), contextUserNameKey, user.Name)
+		ctx = context.WithValue(ctx, contextUserRoleKey, role)
+		ctx = storage.WithAuditActor(ctx, user.Name)
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mfaPendingRequired only lets through tokens waiting for the second factor
+func (s *Service) mfaPendingRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+
+		payload, user, ok := s.authenticate(w, r)
+		if !ok {
+			return
 		}
 
-		user, err := s.db.GetUserByName(r.Context(), payload.Username)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(`{"status": "error", "message": "user not found"}`))
+		if !payload.MFAPending {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "no second factor pending"}`))
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), contextUserNameKey, user.Name)
+		ctx = storage.WithAuditActor(ctx, user.Name)
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// requireRole lets through users having one of roles; must follow loginRequired
+func (s *Service) requireRole(roles ...storage.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := getUserRoleFromRequest(r)
+
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			s.log.Warnf("user %s with role %s was denied access to %s", getUserNameFromRequest(r), role, r.URL.Path)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status": "error", "message": "forbidden"}`))
+		})
+	}
+}
+
+// auditContext passes request origin to storage for audit events; must follow RealIP
+func (s *Service) auditContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := storage.WithAuditInfo(r.Context(), storage.AuditInfo{
+			RequestID: middleware.GetReqID(r.Context()),
+			IP:        clientIP(r),
+		})
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (s *Service) limitPayload(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, payloadLimitBytes+1))
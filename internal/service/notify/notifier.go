@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type Notifier interface {
+	Notify(context.Context, Message) error
+}
+
+type Config struct {
+	File         string
+	SMTPAddress  string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+var notifierMap = map[string]func(Config, *zap.SugaredLogger) (Notifier, error){
+	"log":  NewLogNotifier,
+	"file": NewFileNotifier,
+	"smtp": NewSMTPNotifier,
+}
+
+func NewNotifier(kind string, cfg Config, logger *zap.SugaredLogger) (Notifier, error) {
+	notifierCreator, ok := notifierMap[kind]
+	if !ok {
+		return nil, fmt.Errorf(`notifier "%s" is not supported; use "log/file/smtp"`, kind)
+	}
+
+	notifier, err := notifierCreator(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return notifier, nil
+}
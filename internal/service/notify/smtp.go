@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+type SMTPNotifier struct {
+	address string
+	from    string
+	auth    smtp.Auth
+}
+
+func NewSMTPNotifier(cfg Config, logger *zap.SugaredLogger) (Notifier, error) {
+	if cfg.SMTPAddress == "" || cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("smtp notifier requires server address and sender")
+	}
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid smtp address: %w", err)
+		}
+
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+
+	return &SMTPNotifier{cfg.SMTPAddress, cfg.SMTPFrom, auth}, nil
+}
+
+func (n *SMTPNotifier) Notify(ctx context.Context, msg Message) error {
+	if msg.To == "" {
+		return fmt.Errorf("recipient has no address")
+	}
+
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid message header")
+	}
+
+	body := strings.Join([]string{
+		"From: " + n.from,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		msg.Body,
+	}, "\r\n")
+
+	err := smtp.SendMail(n.address, n.auth, n.from, []string{msg.To}, []byte(body))
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startSMTPStub runs a minimal SMTP server accepting a single message
+func startSMTPStub(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP stub")
+
+		data := strings.Builder{}
+		inData := false
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 OK")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				inData = true
+				reply("354 go ahead")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	address, received := startSMTPStub(t)
+
+	notifier, err := NewSMTPNotifier(Config{SMTPAddress: address, SMTPFrom: "noreply@gophermart.local"}, nil)
+	require.NoError(t, err)
+
+	err = notifier.Notify(context.Background(), Message{
+		To:      "user@example.com",
+		Subject: "Password reset",
+		Body:    "reset token: abc",
+	})
+	require.NoError(t, err)
+
+	mail := <-received
+	require.Contains(t, mail, "To: user@example.com")
+	require.Contains(t, mail, "Subject: Password reset")
+	require.Contains(t, mail, "reset token: abc")
+}
+
+func TestSMTPNotifierRejectsHeaderInjection(t *testing.T) {
+	notifier, err := NewSMTPNotifier(Config{SMTPAddress: "127.0.0.1:25", SMTPFrom: "noreply@gophermart.local"}, nil)
+	require.NoError(t, err)
+
+	err = notifier.Notify(context.Background(), Message{
+		To:      "user@example.com\r\nBcc: evil@example.com",
+		Subject: "Password reset",
+	})
+	require.Error(t, err)
+}
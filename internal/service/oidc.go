@@ -0,0 +1,280 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gophermart/internal/service/oidc"
+	"gophermart/internal/service/storage"
+)
+
+const (
+	oidcCookieName = "oidc"
+	oidcCookiePath = "/api/user/oidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// oidcFlow is what has to survive the round trip through the IdP.
+// It is kept in an HttpOnly cookie so any replica can finish the login.
+type oidcFlow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+func (f oidcFlow) String() string {
+	return f.State + "." + f.Nonce + "." + f.Verifier
+}
+
+func parseOIDCFlow(value string) (oidcFlow, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return oidcFlow{}, false
+	}
+
+	return oidcFlow{parts[0], parts[1], parts[2]}, true
+}
+
+func setOIDCFlowCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		// Lax lets the cookie ride along the top-level redirect back from IdP
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oidcUserName picks a login for a user created from ID token claims
+func oidcUserName(claims *oidc.Claims) string {
+	if claims.PreferredUsername != "" {
+		return claims.PreferredUsername
+	}
+
+	if claims.Email != "" && claims.EmailVerified {
+		return claims.Email
+	}
+
+	return ""
+}
+
+// sessionUser returns the user of a valid full session if there is one
+func (s *Service) sessionUser(r *http.Request) (storage.User, bool) {
+	tokenCookie, err := r.Cookie("token")
+	if err != nil {
+		return storage.User{}, false
+	}
+
+	payload, err := s.tm.VerifyToken(tokenCookie.Value)
+	if err != nil || payload.MFAPending {
+		return storage.User{}, false
+	}
+
+	user, err := s.db.GetUserByName(r.Context(), payload.Username)
+	if err != nil || user.Blocked || payload.IssuedAt.Before(user.SessionsValidAfter) {
+		return storage.User{}, false
+	}
+
+	return user, true
+}
+
+func (s *Service) handleOIDCLogin() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, errState := oidc.NewState()
+		nonce, errNonce := oidc.NewState()
+		verifier, challenge, errPKCE := oidc.NewPKCE()
+		if errState != nil || errNonce != nil || errPKCE != nil {
+			s.log.Error("failed to generate oidc flow parameters")
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to start login"}`))
+			return
+		}
+
+		authURL, err := s.oidc.AuthCodeURL(r.Context(), state, nonce, challenge)
+		if err != nil {
+			s.log.Errorf("failed to build oidc authorization url due to: %s", err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"status": "error", "message": "identity provider is unavailable"}`))
+			return
+		}
+
+		setOIDCFlowCookie(w, oidcFlow{state, nonce, verifier}.String(), int(oidcFlowTTL.Seconds()))
+
+		http.Redirect(w, r, authURL, http.StatusFound)
+	})
+}
+
+func (s *Service) handleOIDCCallback() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+
+		flowCookie, err := r.Cookie(oidcCookieName)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "no login in progress"}`))
+			return
+		}
+
+		// Every flow is good for a single callback
+		setOIDCFlowCookie(w, "", -1)
+
+		flow, ok := parseOIDCFlow(flowCookie.Value)
+		if !ok || subtle.ConstantTimeCompare([]byte(flow.State), []byte(query.Get("state"))) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "state mismatch"}`))
+			return
+		}
+
+		if query.Get("error") != "" {
+			s.log.Infof("identity provider rejected login: %s", query.Get("error"))
+
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "error", "message": "identity provider rejected login"}`))
+			return
+		}
+
+		claims, err := s.oidc.Exchange(r.Context(), query.Get("code"), flow.Verifier, flow.Nonce)
+		if err != nil {
+			if errors.Is(err, oidc.ErrInvalidIDToken) {
+				s.log.Warnf("invalid id token from %s: %s", clientIP(r), err)
+
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"status": "error", "message": "invalid id token"}`))
+				return
+			}
+
+			s.log.Errorf("failed to exchange oidc code due to: %s", err)
+
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"status": "error", "message": "failed to complete login"}`))
+			return
+		}
+
+		user, err := s.db.GetUserByIdentity(r.Context(), s.oidc.Issuer(), claims.Subject)
+		if err != nil {
+			user, ok = s.linkOIDCUser(w, r, claims)
+			if !ok {
+				return
+			}
+		}
+
+		if user.Blocked {
+			s.log.Warnf("blocked user %s tried to log in", user.Name)
+
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status": "error", "message": "account blocked"}`))
+			return
+		}
+
+		r = r.WithContext(storage.WithAuditActor(r.Context(), user.Name))
+
+		if user.TOTPEnabled {
+			err = s.issueMFAPendingToken(w, user)
+			if err != nil {
+				s.log.Errorf("failed to create new token due to: %s", err)
+
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"status": "error", "message": "failed to create token"}`))
+				return
+			}
+
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"status": "mfa_required", "message": "second factor required"}`))
+			return
+		}
+
+		err = s.issueToken(w, user)
+		if err != nil {
+			s.log.Errorf("failed to create new token due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create token"}`))
+			return
+		}
+
+		s.log.Infof("user %s successfully logged in", user.Name)
+		s.audit(r.Context(), storage.AuditUserLoggedIn, user.Name, "oidc")
+
+		w.Write([]byte(`{"status": "success", "message": "authenticated"}`))
+	})
+}
+
+// linkOIDCUser attaches a new identity to the logged in user or creates
+// a new passwordless user. Existing accounts are never matched by name
+// or email: whoever controls the IdP account would take them over.
+func (s *Service) linkOIDCUser(w http.ResponseWriter, r *http.Request, claims *oidc.Claims) (storage.User, bool) {
+	identity := storage.UserIdentity{
+		Issuer:    s.oidc.Issuer(),
+		Subject:   claims.Subject,
+		CreatedAt: time.Now(),
+	}
+
+	if user, ok := s.sessionUser(r); ok {
+		identity.UserName = user.Name
+
+		err := s.db.LinkIdentity(storage.WithAuditActor(r.Context(), user.Name), identity)
+		if err != nil {
+			if errors.Is(err, storage.ErrIdentityAlreadyLinked) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "identity is linked to another user"}`))
+				return storage.User{}, false
+			}
+
+			s.log.Errorf("failed to link identity due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to link identity"}`))
+			return storage.User{}, false
+		}
+
+		s.log.Infof("user %s linked identity from %s", user.Name, identity.Issuer)
+
+		return user, true
+	}
+
+	identity.UserName = oidcUserName(claims)
+	if identity.UserName == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"status": "error", "message": "identity provider did not share a username"}`))
+		return storage.User{}, false
+	}
+
+	// Passhash is left empty which no password hashes to
+	user := storage.User{
+		Name:  identity.UserName,
+		Email: claims.Email,
+		Role:  storage.RoleUser,
+	}
+
+	err := s.db.CreateUserWithIdentity(r.Context(), user, identity)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserExists) || errors.Is(err, storage.ErrIdentityAlreadyLinked) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"status": "error", "message": "login is taken; log in with password first to link this identity"}`))
+			return storage.User{}, false
+		}
+
+		s.log.Errorf("failed to create user due to: %s", err)
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"status": "error", "message": "failed to create user"}`))
+		return storage.User{}, false
+	}
+
+	s.log.Infof("user %s successfully registered via %s", user.Name, identity.Issuer)
+
+	s.grantWelcomeBonus(r.Context(), user.Name)
+
+	return user, true
+}
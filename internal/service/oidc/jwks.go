@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+}
+
+// publicKeys converts signing keys of supported types, others are skipped
+func (set jwks) publicKeys() map[string]interface{} {
+	keys := map[string]interface{}{}
+
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		if publicKey := key.publicKey(); publicKey != nil {
+			keys[key.KeyID] = publicKey
+		}
+	}
+
+	return keys
+}
+
+func (k jwk) publicKey() interface{} {
+	switch k.KeyType {
+	case "RSA":
+		n, errN := decodeBigInt(k.N)
+		e, errE := decodeBigInt(k.E)
+		if errN != nil || errE != nil || !e.IsInt64() {
+			return nil
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		curve, ok := curves[k.Curve]
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if !ok || errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil
+		}
+
+		return ed25519.PublicKey(x)
+	}
+
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,208 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClientID    = "gophermart"
+	testRedirectURL = "http://localhost/api/user/oidc/callback"
+)
+
+// stubIdP is a stand-in identity provider issuing RS256 ID tokens
+// for a fixed subject to whoever completes the authorization request
+type stubIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func startStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &stubIdP{key: key, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.handleDiscovery)
+	mux.HandleFunc("/authorize", idp.handleAuthorize)
+	mux.HandleFunc("/token", idp.handleToken)
+	mux.HandleFunc("/jwks", idp.handleJWKS)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *stubIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(discovery{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *stubIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	idp.mu.Lock()
+	idp.codes["code-1"] = query
+	idp.mu.Unlock()
+
+	http.Redirect(w, r, query.Get("redirect_uri")+"?code=code-1&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+}
+
+func (idp *stubIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	idp.mu.Lock()
+	authRequest, ok := idp.codes[r.Form.Get("code")]
+	delete(idp.codes, r.Form.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authRequest.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
+	idToken, _ := idp.sign(authRequest.Get("nonce"), time.Hour)
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (idp *stubIdP) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jwks{Keys: []jwk{{
+		KeyType: "RSA",
+		KeyID:   "rsa-1",
+		Use:     "sig",
+		N:       base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *stubIdP) sign(nonce string, ttl time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+		Nonce:             nonce,
+		Email:             "alice@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "alice",
+	})
+	token.Header["kid"] = "rsa-1"
+
+	return token.SignedString(idp.key)
+}
+
+func newTestProvider(idp *stubIdP) *Provider {
+	return NewProvider(Config{
+		Issuer:      idp.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	}, &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	})
+}
+
+// authorize follows the login redirect and returns code and state from the callback
+func authorize(t *testing.T, client *http.Client, authURL string) (string, string) {
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp := startStubIdP(t)
+	provider := newTestProvider(idp)
+	ctx := context.Background()
+
+	verifier, challenge, err := NewPKCE()
+	require.NoError(t, err)
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	require.NoError(t, err)
+
+	code, state := authorize(t, provider.client, authURL)
+	require.Equal(t, "state-1", state)
+
+	claims, err := provider.Exchange(ctx, code, verifier, "nonce-1")
+	require.NoError(t, err)
+	require.Equal(t, "subject-1", claims.Subject)
+	require.Equal(t, "alice", claims.PreferredUsername)
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := startStubIdP(t)
+	provider := newTestProvider(idp)
+	ctx := context.Background()
+
+	_, challenge, err := NewPKCE()
+	require.NoError(t, err)
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", challenge)
+	require.NoError(t, err)
+
+	code, _ := authorize(t, provider.client, authURL)
+
+	otherVerifier, _, err := NewPKCE()
+	require.NoError(t, err)
+
+	_, err = provider.Exchange(ctx, code, otherVerifier, "nonce-1")
+	require.True(t, errors.Is(err, ErrExchange))
+}
+
+func TestVerify(t *testing.T) {
+	idp := startStubIdP(t)
+	provider := newTestProvider(idp)
+	ctx := context.Background()
+
+	idToken, err := idp.sign("nonce-1", time.Hour)
+	require.NoError(t, err)
+
+	_, err = provider.Verify(ctx, idToken, "nonce-2")
+	require.True(t, errors.Is(err, ErrInvalidIDToken))
+
+	expiredToken, err := idp.sign("nonce-1", -time.Minute)
+	require.NoError(t, err)
+
+	_, err = provider.Verify(ctx, expiredToken, "nonce-1")
+	require.True(t, errors.Is(err, ErrInvalidIDToken))
+
+	otherProvider := NewProvider(Config{Issuer: idp.server.URL, ClientID: "someone-else"}, http.DefaultClient)
+
+	_, err = otherProvider.Verify(ctx, idToken, "nonce-1")
+	require.True(t, errors.Is(err, ErrInvalidIDToken))
+}
@@ -0,0 +1,177 @@
+// Package ordernum checks order numbers against the scheme of the accrual
+// system serving them.
+package ordernum
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidScheme = errors.New("invalid order number scheme")
+
+type Validator interface {
+	Valid(number string) bool
+}
+
+// Spec configures a scheme, e.g. {"scheme": "regex", "pattern": "[A-Z]{2}[0-9]{8}"};
+// Pattern is only used by regex and Prefixes by prefix
+type Spec struct {
+	Scheme   string   `json:"scheme"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+}
+
+var schemeMap = map[string]func(Spec) (Validator, error){
+	"luhn":   NewLuhn,
+	"mod97":  NewMod97,
+	"regex":  NewRegexp,
+	"prefix": NewPrefix,
+}
+
+// New makes a validator accepting numbers valid under every spec;
+// without specs numbers are checked with Luhn
+func New(specs []Spec) (Validator, error) {
+	if len(specs) == 0 {
+		return Luhn{}, nil
+	}
+
+	validators := All{}
+	for _, spec := range specs {
+		validatorCreator, ok := schemeMap[spec.Scheme]
+		if !ok {
+			return nil, fmt.Errorf(`%w: "%s" is not supported; use "luhn/mod97/regex/prefix"`, ErrInvalidScheme, spec.Scheme)
+		}
+
+		validator, err := validatorCreator(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		validators = append(validators, validator)
+	}
+
+	if len(validators) == 1 {
+		return validators[0], nil
+	}
+
+	return validators, nil
+}
+
+// All accepts numbers valid under each of its validators
+type All []Validator
+
+func (a All) Valid(number string) bool {
+	for _, validator := range a {
+		if !validator.Valid(number) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Luhn checks digits of any length against the Luhn checksum
+type Luhn struct{}
+
+func NewLuhn(Spec) (Validator, error) {
+	return Luhn{}, nil
+}
+
+func (Luhn) Valid(number string) bool {
+	if number == "" {
+		return false
+	}
+
+	sum := 0
+	double := false
+
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+
+		sum += digit
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// Mod97 checks ISO 7064 MOD 97-10 check digits as used by IBAN: the number,
+// letters read as 10 to 35, must leave a remainder of 1 when divided by 97
+type Mod97 struct{}
+
+func NewMod97(Spec) (Validator, error) {
+	return Mod97{}, nil
+}
+
+func (Mod97) Valid(number string) bool {
+	if len(number) < 3 {
+		return false
+	}
+
+	remainder := 0
+
+	for _, c := range strings.ToUpper(number) {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		default:
+			return false
+		}
+	}
+
+	return remainder == 1
+}
+
+// Regexp accepts numbers matching the pattern as a whole
+type Regexp struct {
+	re *regexp.Regexp
+}
+
+func NewRegexp(spec Spec) (Validator, error) {
+	re, err := regexp.Compile(`^(?:` + spec.Pattern + `)$`)
+	if err != nil || spec.Pattern == "" {
+		return nil, fmt.Errorf("%w: bad pattern %q", ErrInvalidScheme, spec.Pattern)
+	}
+
+	return Regexp{re}, nil
+}
+
+func (r Regexp) Valid(number string) bool {
+	return r.re.MatchString(number)
+}
+
+// Prefix accepts numbers starting with one of the prefixes
+type Prefix []string
+
+func NewPrefix(spec Spec) (Validator, error) {
+	if len(spec.Prefixes) == 0 {
+		return nil, fmt.Errorf("%w: no prefixes given", ErrInvalidScheme)
+	}
+
+	return Prefix(spec.Prefixes), nil
+}
+
+func (p Prefix) Valid(number string) bool {
+	for _, prefix := range p {
+		if strings.HasPrefix(number, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package ordernum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"79927398713", true},
+		{"12345678903", true},
+		{"12345678900", false},
+		{"0", true},
+		{"", false},
+		{"7992739871a", false},
+		{"-79927398713", false},
+		// Longer than any integer type holds
+		{"12345678901234567890123456789012345678902", true},
+		{"12345678901234567890123456789012345678901", false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.valid, Luhn{}.Valid(tt.number), tt.number)
+	}
+}
+
+func TestMod97(t *testing.T) {
+	// IBAN with the country code and check digits moved to the end
+	require.True(t, Mod97{}.Valid("WEST12345698765432GB82"))
+	require.True(t, Mod97{}.Valid("west12345698765432gb82"))
+	require.False(t, Mod97{}.Valid("WEST12345698765432GB83"))
+	require.False(t, Mod97{}.Valid("WEST-12345698765432GB82"))
+	require.False(t, Mod97{}.Valid("1"))
+}
+
+func TestNew(t *testing.T) {
+	validator, err := New(nil)
+	require.NoError(t, err)
+	require.Equal(t, Luhn{}, validator)
+
+	validator, err = New([]Spec{{Scheme: "regex", Pattern: "[A-Z]{2}[0-9]+"}})
+	require.NoError(t, err)
+	require.True(t, validator.Valid("AB123"))
+	require.False(t, validator.Valid("xAB123"))
+	require.False(t, validator.Valid("AB123x"))
+
+	validator, err = New([]Spec{{Scheme: "prefix", Prefixes: []string{"42", "43"}}, {Scheme: "luhn"}})
+	require.NoError(t, err)
+	require.True(t, validator.Valid("4200000000000000000000000000000000000000002"))
+	require.False(t, validator.Valid("4200000000000000000000000000000000000000003"))
+	require.False(t, validator.Valid("12345678903"))
+
+	for _, specs := range [][]Spec{
+		{{Scheme: "crc"}},
+		{{Scheme: "regex"}},
+		{{Scheme: "regex", Pattern: "("}},
+		{{Scheme: "prefix"}},
+	} {
+		_, err := New(specs)
+		require.ErrorIs(t, err, ErrInvalidScheme)
+	}
+}
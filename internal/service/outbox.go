@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gophermart/internal/service/publisher"
+)
+
+const (
+	// outboxBatch is how many messages are relayed per tick
+	outboxBatch = 100
+	// outboxLease keeps other replicas from relaying while a batch is
+	// published; after a failure the relay resumes once it runs out
+	outboxLease = time.Minute
+)
+
+// relayOutbox hands domain events written by storage to the publisher in
+// the order they were recorded. A failed message stops the batch so later
+// events are not published ahead of it. Every replica runs a relay, but
+// only one of them holds a claim on the outbox at a time.
+func (s *Service) relayOutbox(ctx context.Context) {
+	s.log.Infof("outbox relay started")
+
+	ticker := time.NewTicker(s.config.OutboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("outbox relay stopped")
+			return
+		case <-ticker.C:
+			messages, err := s.db.ClaimOutboxMessages(ctx, time.Now(), outboxBatch, outboxLease)
+			if err != nil {
+				s.log.Errorf("outbox relay failed to get messages: %s", err)
+				continue
+			}
+
+			for _, msg := range messages {
+				err = s.publisher.Publish(ctx, publisher.Message{
+					ID:        msg.ID,
+					Type:      msg.Type,
+					Key:       msg.Key,
+					Payload:   json.RawMessage(msg.Payload),
+					CreatedAt: msg.CreatedAt,
+				})
+				if err != nil {
+					s.log.Errorf("outbox relay failed to publish message %d: %s", msg.ID, err)
+					break
+				}
+
+				err = s.db.MarkOutboxPublished(ctx, msg.ID, time.Now())
+				if err != nil {
+					s.log.Errorf("outbox relay failed to mark message %d published: %s", msg.ID, err)
+					break
+				}
+			}
+		}
+	}
+}
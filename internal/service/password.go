@@ -0,0 +1,222 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gophermart/internal/service/notify"
+	"gophermart/internal/service/storage"
+)
+
+type (
+	passwordChangeRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	passwordResetRequest struct {
+		Login string `json:"login"`
+	}
+
+	passwordReset struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+)
+
+func newResetToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	resetToken := base64.RawURLEncoding.EncodeToString(b)
+
+	return resetToken, hashToken(resetToken), nil
+}
+
+// hashToken hashes high-entropy secrets such as reset tokens or recovery codes before storing
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Service) handlePasswordChange() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		request := passwordChangeRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.NewPassword == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		current := storage.User{Name: userName, Password: request.CurrentPassword}
+		current.HashPassword()
+
+		registeredUser, err := s.db.GetUserByCreds(r.Context(), current)
+		if errors.Is(err, storage.ErrUserDoesNotExist) {
+			s.log.Warnf("user %s provided wrong current password", userName)
+
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"status": "error", "message": "current password is wrong"}`))
+			return
+		}
+
+		user := storage.User{
+			Name:     userName,
+			Password: request.NewPassword,
+			// Every token issued before this moment is revoked
+			SessionsValidAfter: time.Now(),
+		}
+		user.HashPassword()
+
+		err = s.db.UpdatePassword(r.Context(), user)
+		if err != nil {
+			s.log.Errorf("failed to update password due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to change password"}`))
+			return
+		}
+
+		// Keep the current session alive with a fresh token
+		err = s.issueToken(w, registeredUser)
+		if err != nil {
+			s.log.Errorf("failed to create new token due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create token"}`))
+			return
+		}
+
+		s.log.Infof("user %s successfully changed password", userName)
+
+		w.Write([]byte(`{"status": "success", "message": "password changed"}`))
+	})
+}
+
+func (s *Service) handlePasswordResetRequest() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := passwordResetRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Login == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		// The response is the same whether the user exists or not
+		accepted := func() {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"status": "success", "message": "reset instructions sent if user exists"}`))
+		}
+
+		user, err := s.db.GetUserByName(r.Context(), request.Login)
+		if err != nil {
+			s.log.Infof("password reset requested for unknown user")
+
+			accepted()
+			return
+		}
+
+		// Login is not an address, there is nowhere to send the token
+		if user.Email == "" {
+			s.log.Infof("password reset requested for user %s without email", user.Name)
+
+			accepted()
+			return
+		}
+
+		resetToken, tokenHash, err := newResetToken()
+		if err != nil {
+			s.log.Errorf("failed to generate reset token due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to request password reset"}`))
+			return
+		}
+
+		expiresAt := time.Now().Add(s.config.ResetTokenTTL)
+
+		err = s.db.SavePasswordReset(r.Context(), storage.PasswordReset{
+			UserName:  user.Name,
+			TokenHash: tokenHash,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			s.log.Errorf("failed to save password reset to DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to request password reset"}`))
+			return
+		}
+
+		err = s.notify.Notify(r.Context(), notify.Message{
+			To:      user.Email,
+			Subject: "Gophermart password reset",
+			Body: fmt.Sprintf(
+				"Use this token to reset your password: %s\nIt is valid until %s.",
+				resetToken,
+				expiresAt.Format(time.RFC3339),
+			),
+		})
+		if err != nil {
+			s.log.Errorf("failed to deliver password reset for user %s due to: %s", user.Name, err)
+		}
+
+		accepted()
+	})
+}
+
+func (s *Service) handlePasswordReset() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := passwordReset{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Token == "" || request.NewPassword == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "failed to parse payload"}`))
+			return
+		}
+
+		user := storage.User{
+			Password:           request.NewPassword,
+			SessionsValidAfter: time.Now(),
+		}
+		user.HashPassword()
+
+		userName, err := s.db.ResetPassword(r.Context(), hashToken(request.Token), user)
+		if err != nil {
+			if errors.Is(err, storage.ErrInvalidResetToken) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status": "error", "message": "reset token is invalid or expired"}`))
+				return
+			}
+
+			s.log.Errorf("failed to reset password due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to reset password"}`))
+			return
+		}
+
+		s.log.Infof("user %s successfully reset password", userName)
+
+		w.Write([]byte(`{"status": "success", "message": "password changed"}`))
+	})
+}
@@ -0,0 +1,54 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Handler consumes messages of an in-process publisher; an error makes
+// the relay retry the message later
+type Handler func(context.Context, Message) error
+
+// InProcessPublisher hands messages to handlers subscribed to their type
+// within the same process, "*" subscribes to every type
+type InProcessPublisher struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+	log      *zap.SugaredLogger
+}
+
+func NewInProcessPublisher(cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	return &InProcessPublisher{handlers: map[string][]Handler{}, log: logger}, nil
+}
+
+func (p *InProcessPublisher) Subscribe(messageType string, handler Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handlers[messageType] = append(p.handlers[messageType], handler)
+}
+
+func (p *InProcessPublisher) Publish(ctx context.Context, msg Message) error {
+	p.mu.RLock()
+	handlers := append(append([]Handler{}, p.handlers[msg.Type]...), p.handlers["*"]...)
+	p.mu.RUnlock()
+
+	for _, handler := range handlers {
+		err := handler(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(handlers) == 0 {
+		p.log.Debugf("message %d of type %s has no subscribers", msg.ID, msg.Type)
+	}
+
+	return nil
+}
+
+func (p *InProcessPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// JSONLPublisher writes every message as a JSON line to a file or stdout,
+// meant for piping into log shippers or for local debugging
+type JSONLPublisher struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+func NewJSONLPublisher(cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	if cfg.File == "" || cfg.File == "-" {
+		return &JSONLPublisher{out: nopCloser{os.Stdout}}, nil
+	}
+
+	file, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open events file: %w", err)
+	}
+
+	return &JSONLPublisher{out: file}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (p *JSONLPublisher) Publish(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err = p.out.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	return nil
+}
+
+func (p *JSONLPublisher) Close() error {
+	return p.out.Close()
+}
@@ -0,0 +1,51 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Message is a domain event relayed from the outbox. Key identifies the
+// aggregate so brokers can keep events of one user in order.
+type Message struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Publisher ships messages to other services. Delivery is at least once:
+// a message is published again if the relay fails before marking it done.
+type Publisher interface {
+	Publish(context.Context, Message) error
+	Close() error
+}
+
+type Config struct {
+	// File is where the jsonl publisher appends messages, "-" is stdout
+	File string
+}
+
+var publisherMap = map[string]func(Config, *zap.SugaredLogger) (Publisher, error){
+	"inprocess": NewInProcessPublisher,
+	"jsonl":     NewJSONLPublisher,
+}
+
+func NewPublisher(kind string, cfg Config, logger *zap.SugaredLogger) (Publisher, error) {
+	publisherCreator, ok := publisherMap[kind]
+	if !ok {
+		return nil, fmt.Errorf(`publisher "%s" is not supported; use "inprocess/jsonl"`, kind)
+	}
+
+	publisher, err := publisherCreator(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return publisher, nil
+}
@@ -0,0 +1,69 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestInProcessPublisher(t *testing.T) {
+	p, err := NewPublisher("inprocess", Config{}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	inProcess := p.(*InProcessPublisher)
+
+	received := []string{}
+	inProcess.Subscribe("OrderProcessed", func(ctx context.Context, msg Message) error {
+		received = append(received, "processed")
+		return nil
+	})
+	inProcess.Subscribe("*", func(ctx context.Context, msg Message) error {
+		received = append(received, "any:"+msg.Type)
+		return nil
+	})
+
+	require.NoError(t, p.Publish(context.Background(), Message{Type: "OrderProcessed"}))
+	require.NoError(t, p.Publish(context.Background(), Message{Type: "UserRegistered"}))
+	require.Equal(t, []string{"processed", "any:OrderProcessed", "any:UserRegistered"}, received)
+
+	failure := errors.New("handler failed")
+	inProcess.Subscribe("PointsWithdrawn", func(ctx context.Context, msg Message) error {
+		return failure
+	})
+	require.ErrorIs(t, p.Publish(context.Background(), Message{Type: "PointsWithdrawn"}), failure)
+}
+
+func TestJSONLPublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	p, err := NewPublisher("jsonl", Config{File: path}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	msg := Message{
+		ID:        1,
+		Type:      "UserRegistered",
+		Key:       "alice",
+		Payload:   []byte(`{"user":"alice"}`),
+		CreatedAt: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, p.Publish(context.Background(), msg))
+	require.NoError(t, p.Publish(context.Background(), msg))
+	require.NoError(t, p.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	line := `{"id":1,"type":"UserRegistered","key":"alice","payload":{"user":"alice"},"created_at":"2024-01-01T00:00:00Z"}` + "\n"
+	require.Equal(t, line+line, string(content))
+}
+
+func TestUnknownPublisher(t *testing.T) {
+	_, err := NewPublisher("kafka", Config{}, zap.NewNop().Sugar())
+	require.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gophermart/internal/service/storage"
+)
+
+// deviceHeader is an optional client supplied device fingerprint
+const deviceHeader = "X-Device-ID"
+
+type (
+	// registerReferral is the optional part of registration payload
+	registerReferral struct {
+		Code string `json:"referral_code"`
+	}
+
+	referralResponse struct {
+		Code      string             `json:"code"`
+		Referrals []storage.Referral `json:"referrals"`
+	}
+)
+
+func (s *Service) referralsEnabled() bool {
+	return s.config.ReferrerBonus > 0 || s.config.RefereeBonus > 0
+}
+
+// newReferralCode makes a short code easy to read out and type
+func newReferralCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.EncodeToString(b), nil
+}
+
+// normalizeReferralCode makes codes case insensitive
+func normalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// findReferrer resolves a referral code to an active user
+func (s *Service) findReferrer(ctx context.Context, code string) (storage.User, error) {
+	referrer, err := s.db.GetUserByReferralCode(ctx, normalizeReferralCode(code))
+	if err != nil {
+		return storage.User{}, err
+	}
+
+	if referrer.Blocked {
+		return storage.User{}, storage.ErrReferralCodeInvalid
+	}
+
+	return referrer, nil
+}
+
+// createReferral links a new user to the referrer. Registration goes on
+// whether the referral is accepted or not.
+func (s *Service) createReferral(ctx context.Context, referrer, referee, ip, device string) {
+	referral, err := s.db.CreateReferral(ctx, storage.Referral{
+		Referrer:  referrer,
+		Referee:   referee,
+		IP:        ip,
+		Device:    device,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		s.log.Warnf("failed to save referral of %s by %s: %s", referee, referrer, err)
+		return
+	}
+
+	if referral.Status == storage.ReferralRejected {
+		s.log.Warnf("referral of %s by %s rejected: %s", referee, referrer, referral.Reason)
+		return
+	}
+
+	s.log.Infof("user %s was referred by %s", referee, referrer)
+}
+
+// rewardReferral pays out the referral of user once their order is processed;
+// users who were not referred or already rewarded are skipped
+func (s *Service) rewardReferral(ctx context.Context, userName string) {
+	if !s.referralsEnabled() {
+		return
+	}
+
+	err := s.db.RewardReferral(ctx, userName, s.config.ReferrerBonus, s.config.RefereeBonus, time.Now())
+	if err != nil {
+		if !errors.Is(err, storage.ErrReferralDoesNotExist) {
+			s.log.Errorf("failed to reward referral of %s: %s", userName, err)
+		}
+		return
+	}
+
+	s.log.Infof("referral of %s is resolved", userName)
+}
+
+func (s *Service) handleReferral() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		candidate, err := newReferralCode()
+		if err != nil {
+			s.log.Errorf("failed to generate referral code due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get referral code"}`))
+			return
+		}
+
+		code, err := s.db.GetReferralCode(r.Context(), userName, candidate)
+		if err != nil {
+			s.log.Errorf("failed to get referral code due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get referral code"}`))
+			return
+		}
+
+		referrals, err := s.db.GetReferrals(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to get referrals due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get referrals"}`))
+			return
+		}
+
+		res, err := json.Marshal(referralResponse{Code: code, Referrals: referrals})
+		if err != nil {
+			s.log.Errorf("failed to marshal referrals due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal referrals"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/storage"
+)
+
+type refundRequest struct {
+	Order  string  `json:"order"`
+	Sum    float32 `json:"sum"`
+	Reason string  `json:"reason"`
+}
+
+// handleRefundWithdrawal returns points of a withdrawal for a cancelled order.
+// Zero sum refunds everything left.
+func (s *Service) handleRefundWithdrawal() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := refundRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Order == "" || request.Sum < 0 || strings.TrimSpace(request.Reason) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "order, non-negative sum and reason are required"}`))
+			return
+		}
+
+		login := chi.URLParam(r, "login")
+
+		refund, err := s.db.RefundWithdrawal(r.Context(), storage.Refund{
+			UserName:  login,
+			Order:     request.Order,
+			Sum:       request.Sum,
+			Reason:    request.Reason,
+			Actor:     storage.AuditInfoFromContext(r.Context()).Actor,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrUserDoesNotExist) || errors.Is(err, storage.ErrWithdrawalDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "withdrawal not found"}`))
+				return
+			}
+
+			if errors.Is(err, storage.ErrRefundExceedsWithdrawal) {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"status": "error", "message": "refund exceeds what is left of withdrawal"}`))
+				return
+			}
+
+			s.log.Errorf("failed to refund withdrawal due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to refund withdrawal"}`))
+			return
+		}
+
+		res, err := json.Marshal(refund)
+		if err != nil {
+			s.log.Errorf("failed to marshal refund due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal refund"}`))
+			return
+		}
+
+		s.log.Infof("refunded %v points of order %s to %s", refund.Sum, refund.Order, login)
+
+		w.Write(res)
+	})
+}
@@ -3,6 +3,8 @@ package service
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+
+	"gophermart/internal/service/storage"
 )
 
 func (s *Service) setupRouter() {
@@ -10,6 +12,7 @@ func (s *Service) setupRouter() {
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	r.Use(s.auditContext)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Compress(5))
@@ -18,22 +21,115 @@ func (s *Service) setupRouter() {
 		r.Use(s.logRequest)
 	}
 
+	r.Get("/.well-known/jwks.json", s.handleJWKS())
+
 	r.Route("/api/user", func(r chi.Router) {
 		r.Post("/register", s.handleRegister())
 		r.Post("/login", s.handleLogin())
+		r.With(s.mfaPendingRequired).Post("/login/mfa", s.handleLoginMFA())
+
+		if s.oidc != nil {
+			r.Get("/oidc/login", s.handleOIDCLogin())
+			r.Get("/oidc/callback", s.handleOIDCCallback())
+		}
+
+		if s.notify != nil {
+			r.Route("/password/reset", func(r chi.Router) {
+				r.Post("/request", s.handlePasswordResetRequest())
+				r.Post("/", s.handlePasswordReset())
+			})
+		}
 
 		r.Group(func(r chi.Router) {
 			r.Use(s.loginRequired)
 
+			r.Post("/password", s.handlePasswordChange())
+
+			r.Route("/2fa", func(r chi.Router) {
+				r.Post("/enroll", s.handleTOTPEnroll())
+				r.Post("/confirm", s.handleTOTPConfirm())
+				r.Post("/disable", s.handleTOTPDisable())
+			})
+
 			r.Post("/orders", s.handleNewOrder())
 			r.Get("/orders", s.handleOrders())
+			r.Get("/orders/events", s.handleOrderEvents())
 
 			r.Route("/balance", func(r chi.Router) {
 				r.Get("/", s.handleBalance())
 				r.Post("/withdraw", s.handleWithdrawal())
+				r.Post("/transfer", s.handleTransfer())
+				r.Get("/transfers", s.handleTransfers())
+				r.Get("/bonuses", s.handleBonuses())
+				r.Get("/statement", s.handleStatement())
+
+				r.Route("/holds", func(r chi.Router) {
+					r.Get("/", s.handleHolds())
+					r.Post("/", s.handleNewHold())
+					r.Post("/{id}/confirm", s.handleResolveHold(true))
+					r.Post("/{id}/cancel", s.handleResolveHold(false))
+				})
 			})
 
 			r.Get("/withdrawals", s.handleWithdrawals())
+			r.Post("/promo", s.handleRedeemPromo())
+
+			if s.referralsEnabled() {
+				r.Get("/referral", s.handleReferral())
+			}
+
+			if s.tiers != nil {
+				r.Get("/tier", s.handleTier())
+			}
+		})
+	})
+
+	// Providers without a callback secret are only polled
+	if s.accrual.AcceptCallbacks() {
+		r.Post("/internal/accrual/callback", s.handleAccrualCallback())
+		r.Post("/internal/accrual/callback/{provider}", s.handleAccrualCallback())
+	}
+
+	r.Route("/api/partner", func(r chi.Router) {
+		r.With(s.apiKeyRequired(scopeOrdersWrite)).Post("/orders", s.handlePartnerNewOrder())
+	})
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(s.loginRequired)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireRole(storage.RoleSupport, storage.RoleAdmin))
+
+			r.Get("/users", s.handleAdminSearchUsers())
+			r.Get("/users/{login}", s.handleAdminUser())
+			r.Get("/users/{login}/orders", s.handleAdminUserOrders())
+			r.Get("/users/{login}/withdrawals", s.handleAdminUserWithdrawals())
+			r.Post("/users/{login}/unlock", s.handleUnlockUser())
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireRole(storage.RoleAdmin))
+
+			r.Put("/users/{login}/role", s.handleSetUserRole())
+			r.Post("/users/{login}/balance", s.handleAdminAdjustBalance())
+			r.Post("/users/{login}/refunds", s.handleRefundWithdrawal())
+			r.Post("/users/{login}/block", s.handleAdminSetBlocked(true))
+			r.Post("/users/{login}/unblock", s.handleAdminSetBlocked(false))
+			r.Post("/orders/{number}/requeue", s.handleAdminRequeueOrder())
+			r.Get("/audit", s.handleAdminAuditEvents())
+			r.Get("/audit/verify", s.handleAdminVerifyAudit())
+
+			r.Get("/api-keys", s.handleAdminAPIKeys())
+			r.Post("/api-keys", s.handleAdminCreateAPIKey())
+			r.Delete("/api-keys/{id}", s.handleAdminRevokeAPIKey())
+
+			r.Get("/webhooks", s.handleAdminWebhooks())
+			r.Post("/webhooks", s.handleAdminCreateWebhook())
+			r.Delete("/webhooks/{id}", s.handleAdminDisableWebhook())
+			r.Get("/webhooks/{id}/deliveries", s.handleAdminWebhookDeliveries())
+
+			r.Get("/campaigns", s.handleAdminCampaigns())
+			r.Post("/campaigns", s.handleAdminCreateCampaign())
 		})
 	})
 
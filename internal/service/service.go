@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -9,22 +10,40 @@ import (
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 
+	"gophermart/internal/service/accrual"
+	"gophermart/internal/service/events"
+	"gophermart/internal/service/notify"
+	"gophermart/internal/service/oidc"
+	"gophermart/internal/service/publisher"
 	"gophermart/internal/service/storage"
+	"gophermart/internal/service/tier"
 	"gophermart/internal/service/token"
 )
 
 type Service struct {
-	config Config
-	router *chi.Mux
-	db     storage.Storage
-	client *http.Client
-	tm     token.Maker
-	log    *zap.SugaredLogger
-	wg     sync.WaitGroup
+	config    Config
+	router    *chi.Mux
+	db        storage.Storage
+	client    *http.Client
+	accrual   *accrual.Providers
+	tm        token.Maker
+	keys      *token.KeySet
+	keyCipher *token.KeyCipher
+	notify    notify.Notifier
+	oidc      *oidc.Provider
+	tiers     tier.Tiers
+	events    *events.Broker
+	publisher publisher.Publisher
+	log       *zap.SugaredLogger
+	wg        sync.WaitGroup
 }
 
 func New(cfg Config) (*Service, error) {
-	db, err := storage.NewStorage(cfg.DatabaseDriver, cfg.DatabaseURI)
+	if !storage.ClawbackPolicy(cfg.ClawbackPolicy).Valid() {
+		return nil, fmt.Errorf(`clawback policy "%s" is not supported; use "negative/debt"`, cfg.ClawbackPolicy)
+	}
+
+	db, err := storage.NewStorage(cfg.DatabaseDriver, cfg.DatabaseURI, storage.WithPointsLifetime(cfg.PointsLifetime))
 	if err != nil {
 		return nil, err
 	}
@@ -33,17 +52,91 @@ func New(cfg Config) (*Service, error) {
 		Timeout: 5 * time.Second,
 	}
 
-	tokenMaker, err := token.NewTokenMaker(cfg.TokenEngine, cfg.Key)
+	// Without providers configured every order goes to the single accrual system
+	providers := []accrual.Config{{Name: defaultAccrualProvider, Address: cfg.AccrualAddress, CallbackSecret: cfg.AccrualSecret}}
+	if cfg.AccrualProviders != "" {
+		// Every provider signs callbacks with a secret of its own
+		if cfg.AccrualSecret != "" {
+			return nil, fmt.Errorf("ACCRUAL_CALLBACK_SECRET is for the single accrual system; set callback_secret of each provider in ACCRUAL_PROVIDERS")
+		}
+
+		providers, err = accrual.Parse(cfg.AccrualProviders)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	accrualProviders, err := accrual.NewProviders(providers)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := token.NewKeySet(cfg.KeyRefresh)
+
+	tokenMaker, err := token.NewTokenMaker(cfg.TokenEngine, cfg.Key, keys)
 	if err != nil {
 		return nil, err
 	}
 
+	// Asymmetric engines keep private keys in DB, the secret encrypts them
+	var keyCipher *token.KeyCipher
+	if token.UsesKeySet(cfg.TokenEngine) {
+		keyCipher, err = token.NewKeyCipher(cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("SECRET (-k) is mandatory for %s token engine: %w", cfg.TokenEngine, err)
+		}
+	}
+
 	logger, err := initLogger(cfg.LogLevel, cfg.LogFormat)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{cfg, nil, db, client, tokenMaker, logger, sync.WaitGroup{}}, nil
+	// Reset tokens are secrets, there is no default channel to send them over
+	var notifier notify.Notifier
+	if cfg.Notifier != "" {
+		notifier, err = notify.NewNotifier(
+			cfg.Notifier,
+			notify.Config{
+				File:         cfg.NotifyFile,
+				SMTPAddress:  cfg.SMTPAddress,
+				SMTPFrom:     cfg.SMTPFrom,
+				SMTPUsername: cfg.SMTPUsername,
+				SMTPPassword: cfg.SMTPPassword,
+			},
+			logger,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	eventPublisher, err := publisher.NewPublisher(cfg.Publisher, publisher.Config{File: cfg.PublisherFile}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// OIDC login is enabled by configuring an issuer
+	var oidcProvider *oidc.Provider
+	if cfg.OIDCIssuer != "" {
+		oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+		}, client)
+	}
+
+	// Tiers are enabled by configuring them
+	var tiers tier.Tiers
+	if cfg.Tiers != "" {
+		tiers, err = tier.Parse(cfg.Tiers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Service{cfg, nil, db, client, accrualProviders, tokenMaker, keys, keyCipher, notifier, oidcProvider, tiers, events.NewBroker(cfg.EventsHistory), eventPublisher, logger, sync.WaitGroup{}}, nil
 }
 
 func (s *Service) Run(ctx context.Context) {
@@ -54,12 +147,77 @@ func (s *Service) Run(ctx context.Context) {
 		s.log.Fatalf("failed to init DB: %s", err)
 	}
 
+	s.bootstrapAdmins(ctx)
+
+	if token.UsesKeySet(s.config.TokenEngine) {
+		err = s.refreshKeys(ctx)
+		if err != nil {
+			s.log.Fatalf("failed to load signing keys: %s", err)
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.rotateKeys(ctx)
+		}()
+	}
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
 		s.processOrders(ctx)
 	}()
 
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.releaseHolds(ctx)
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.expirePoints(ctx)
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.deliverWebhooks(ctx)
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.relayOutbox(ctx)
+	}()
+
+	if s.tiers != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.recalculateTiers(ctx)
+		}()
+	}
+
+	// gRPC API is served on a separate socket when one is configured
+	if s.config.GRPCAddress != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveGRPC(ctx)
+		}()
+	}
+
+	// Re-verification of processed orders is off unless a window is set
+	if s.config.RecheckWindow > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.recheckOrders(ctx)
+		}()
+	}
+
 	s.log.Infof("gophermart server started at: %s; debug=%v", s.config.RunAddress, s.config.Debug)
 	s.log.Fatalf("server crashed due to: %s", http.ListenAndServe(s.config.RunAddress, s.router))
 }
@@ -71,5 +229,11 @@ func (s *Service) Stop() {
 	s.log.Infof("connection to database closed")
 
 	s.wg.Wait()
+
+	err := s.publisher.Close()
+	if err != nil {
+		s.log.Errorf("failed to close event publisher: %s", err)
+	}
+
 	s.log.Infof("successfully shut down")
 }
@@ -0,0 +1,32 @@
+package signature
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	body := []byte(`{"event": "order.updated"}`)
+
+	header := Sign("secret", at, body)
+	require.Regexp(t, `^t=1700000000,v1=[0-9a-f]{64}$`, header)
+
+	require.NoError(t, Verify("secret", header, body, at.Add(time.Minute), 5*time.Minute))
+	require.ErrorIs(t, Verify("other", header, body, at, 5*time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", header, []byte(`{}`), at, 5*time.Minute), ErrInvalidSignature)
+	require.ErrorIs(t, Verify("secret", header, body, at.Add(10*time.Minute), 5*time.Minute), ErrExpiredSignature)
+	require.ErrorIs(t, Verify("secret", "v1=abc", body, at, 5*time.Minute), ErrInvalidSignature)
+}
+
+func TestVerifyAnyOfSignatures(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	body := []byte(`{}`)
+
+	header := Sign("new", at, body) + ",v1=" + Sign("old", at, body)[len("t=1700000000,v1="):]
+
+	require.NoError(t, Verify("old", header, body, at, time.Minute))
+	require.NoError(t, Verify("new", header, body, at, time.Minute))
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/service/events"
+	"gophermart/internal/service/storage"
+)
+
+const (
+	eventOrder   = "order"
+	eventBalance = "balance"
+
+	// sseHeartbeat keeps idle connections from being cut by proxies
+	sseHeartbeat = 15 * time.Second
+)
+
+// publishOrderUpdate pushes the updated order to the order owner's event
+// streams, followed by the balance when the order credited any points.
+// It is only called for orders that actually changed.
+func (s *Service) publishOrderUpdate(ctx context.Context, order storage.Order) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		s.log.Errorf("failed to marshal order %s event: %s", order.Number, err)
+		return
+	}
+
+	s.events.Publish(order.RegisteredBy, eventOrder, data)
+
+	if order.Accrual == 0 {
+		return
+	}
+
+	balance, err := s.db.GetUserBalance(ctx, order.RegisteredBy)
+	if err != nil {
+		s.log.Errorf("failed to get balance of %s for event: %s", order.RegisteredBy, err)
+		return
+	}
+
+	data, err = json.Marshal(balance)
+	if err != nil {
+		s.log.Errorf("failed to marshal balance event: %s", err)
+		return
+	}
+
+	s.events.Publish(order.RegisteredBy, eventBalance, data)
+}
+
+func writeSSE(w http.ResponseWriter, event events.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+func (s *Service) handleOrderEvents() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "streaming is not supported"}`))
+			return
+		}
+
+		userName := getUserNameFromRequest(r)
+
+		// Browsers resend the last seen ID on reconnect, a bad one replays nothing
+		lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+		replay, updates, cancel := s.events.Subscribe(userName, lastID)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		for _, event := range replay {
+			if writeSSE(w, event) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-updates:
+				if !ok {
+					s.log.Infof("event stream of %s fell behind and is closed", userName)
+					return
+				}
+
+				if writeSSE(w, event) != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+					return
+				}
+			}
+
+			flusher.Flush()
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gophermart/internal/service/storage"
+)
+
+var statementCSVHeader = []string{"at", "type", "reference", "amount", "balance"}
+
+// statementWriter streams entries as they come from DB. Headers are only
+// sent with the first entry so an empty statement can still be a 204.
+type statementWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	started bool
+}
+
+func newStatementWriter(w http.ResponseWriter, r *http.Request) *statementWriter {
+	sw := &statementWriter{w: w}
+	if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		sw.csv = csv.NewWriter(w)
+	}
+
+	return sw
+}
+
+func formatPoints(amount float32) string {
+	return strconv.FormatFloat(float64(amount), 'f', -1, 32)
+}
+
+func (sw *statementWriter) write(entry storage.StatementEntry) error {
+	if sw.csv != nil {
+		if !sw.started {
+			sw.started = true
+			sw.w.Header().Set("Content-Type", "text/csv")
+			sw.w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+			sw.csv.Write(statementCSVHeader)
+		}
+
+		return sw.csv.Write([]string{
+			entry.At.UTC().Format(time.RFC3339),
+			string(entry.Type),
+			entry.Reference,
+			formatPoints(entry.Amount),
+			formatPoints(entry.Balance),
+		})
+	}
+
+	res, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if !sw.started {
+		sw.started = true
+		sw.w.Write([]byte("["))
+	} else {
+		sw.w.Write([]byte(","))
+	}
+
+	_, err = sw.w.Write(res)
+	return err
+}
+
+func (sw *statementWriter) close() error {
+	if sw.csv != nil {
+		sw.csv.Flush()
+		return sw.csv.Error()
+	}
+
+	_, err := sw.w.Write([]byte("]"))
+	return err
+}
+
+func (s *Service) handleStatement() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+		query := r.URL.Query()
+
+		var from, to time.Time
+		for name, value := range map[string]*time.Time{"from": &from, "to": &to} {
+			if query.Get(name) == "" {
+				continue
+			}
+
+			parsed, err := time.Parse(time.RFC3339, query.Get(name))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status": "error", "message": "from/to must be RFC 3339 timestamps"}`))
+				return
+			}
+
+			*value = parsed
+		}
+
+		if to.IsZero() {
+			to = time.Now()
+		}
+
+		sw := newStatementWriter(w, r)
+
+		err := s.db.StreamStatement(r.Context(), userName, from, to, sw.write)
+		if err != nil {
+			s.log.Errorf("failed to get statement of %s due to: %s", userName, err)
+
+			// Once streaming started the status is already sent
+			if sw.started {
+				return
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get statement"}`))
+			return
+		}
+
+		if !sw.started {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		err = sw.close()
+		if err != nil {
+			s.log.Errorf("failed to write statement of %s due to: %s", userName, err)
+		}
+	})
+}
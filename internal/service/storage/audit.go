@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Audit event actions
+const (
+	AuditUserRegistered      = "user.registered"
+	AuditUserPasswordChanged = "user.password_changed"
+	AuditUserPasswordReset   = "user.password_reset"
+	AuditUserRoleChanged     = "user.role_changed"
+	AuditUserBlocked         = "user.blocked"
+	AuditUserUnblocked       = "user.unblocked"
+	AuditUserMFAEnabled      = "user.mfa_enabled"
+	AuditUserMFADisabled     = "user.mfa_disabled"
+	AuditUserTierChanged     = "user.tier_changed"
+	AuditUserIdentityLinked  = "user.identity_linked"
+	AuditOrderUploaded       = "order.uploaded"
+	AuditOrderUpdated        = "order.updated"
+	AuditOrderRequeued       = "order.requeued"
+	AuditOrderRevised        = "order.revised"
+	AuditBalanceAdjusted     = "balance.adjusted"
+	AuditBalanceWithdrawn    = "balance.withdrawn"
+	AuditBalanceHeld         = "balance.held"
+	AuditBalanceHoldReleased = "balance.hold_released"
+	AuditBalanceRefunded     = "balance.refunded"
+	AuditBalanceExpired      = "balance.expired"
+	AuditBalanceTransferOut  = "balance.transferred_out"
+	AuditBalanceTransferIn   = "balance.transferred_in"
+	AuditBalanceBonus        = "balance.bonus"
+	AuditCampaignCreated     = "campaign.created"
+	AuditReferralCreated     = "referral.created"
+	AuditAPIKeyCreated       = "api_key.created"
+	AuditAPIKeyRevoked       = "api_key.revoked"
+	AuditWebhookCreated      = "webhook.created"
+	AuditWebhookDisabled     = "webhook.disabled"
+
+	AuditUserLoggedIn           = "user.logged_in"
+	AuditUserLoginFailed        = "user.login_failed"
+	AuditUserMFAFailed          = "user.mfa_failed"
+	AuditUserUnlocked           = "user.unlocked"
+	AuditAdminSearchedUsers     = "admin.searched_users"
+	AuditAdminViewedUser        = "admin.viewed_user"
+	AuditAdminViewedOrders      = "admin.viewed_orders"
+	AuditAdminViewedWithdrawals = "admin.viewed_withdrawals"
+	AuditAdminBootstrapped      = "admin.bootstrapped"
+
+	auditSystemActor = "system"
+	// Arbitrary constant identifying the advisory lock serializing chain appends
+	auditChainLockID = 0x6175646974
+)
+
+var ErrAuditChainBroken = errors.New(`audit chain is broken`)
+
+// auditAppendOnlyStatements make audit_events reject updates and deletes
+var auditAppendOnlyStatements = []string{
+	`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'audit_events_append_only') THEN
+			CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+		END IF;
+	END
+	$$`,
+}
+
+// AuditInfo describes who is changing state; it travels in request context
+// so drivers can record it in the same transaction as the change
+type AuditInfo struct {
+	Actor     string
+	RequestID string
+	IP        string
+}
+
+type auditCtxKey struct{}
+
+func WithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditCtxKey{}, info)
+}
+
+// WithAuditActor sets actor keeping the rest of audit info
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	info := AuditInfoFromContext(ctx)
+	info.Actor = actor
+
+	return WithAuditInfo(ctx, info)
+}
+
+func AuditInfoFromContext(ctx context.Context) AuditInfo {
+	info, _ := ctx.Value(auditCtxKey{}).(AuditInfo)
+	return info
+}
+
+// NewAuditEvent prefills event with audit info from ctx
+func NewAuditEvent(ctx context.Context, action string, target string) AuditEvent {
+	info := AuditInfoFromContext(ctx)
+
+	actor := info.Actor
+	if actor == "" {
+		actor = auditSystemActor
+	}
+
+	return AuditEvent{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		RequestID: info.RequestID,
+		IP:        info.IP,
+		// DB keeps microseconds only, the hash must survive a round trip
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+}
+
+func (e AuditEvent) withAmounts(before, after float32) AuditEvent {
+	e.AmountBefore = &before
+	e.AmountAfter = &after
+
+	return e
+}
+
+func (e AuditEvent) withDetails(details string) AuditEvent {
+	e.Details = details
+	return e
+}
+
+func formatAmount(amount *float32) string {
+	if amount == nil {
+		return ""
+	}
+
+	return strconv.FormatFloat(float64(*amount), 'f', -1, 32)
+}
+
+// ComputeHash chains event to the previous one
+func (e AuditEvent) ComputeHash() string {
+	h := sha256.New()
+	h.Write([]byte(strings.Join([]string{
+		e.PrevHash,
+		e.Actor,
+		e.Action,
+		e.Target,
+		formatAmount(e.AmountBefore),
+		formatAmount(e.AmountAfter),
+		e.Details,
+		e.RequestID,
+		e.IP,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}, "\x1f")))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditChainVerifier checks events one by one in insertion order
+type AuditChainVerifier struct {
+	prevHash string
+	Checked  int64
+}
+
+func (v *AuditChainVerifier) Next(event AuditEvent) error {
+	if event.PrevHash != v.prevHash || event.ComputeHash() != event.Hash {
+		return fmt.Errorf("%w at event %d", ErrAuditChainBroken, event.ID)
+	}
+
+	v.prevHash = event.Hash
+	v.Checked++
+
+	return nil
+}
+
+// transferAuditEvents records a transfer against both balances it changed
+func transferAuditEvents(ctx context.Context, sender, recipient User, transfer Transfer) []AuditEvent {
+	return []AuditEvent{
+		NewAuditEvent(ctx, AuditBalanceTransferOut, sender.Name).
+			withAmounts(sender.Current, sender.Current-transfer.Sum).
+			withDetails(recipient.Name),
+		NewAuditEvent(ctx, AuditBalanceTransferIn, recipient.Name).
+			withAmounts(recipient.Current, recipient.Current+transfer.Sum).
+			withDetails(sender.Name),
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestChain() []AuditEvent {
+	ctx := WithAuditInfo(context.Background(), AuditInfo{Actor: "admin", RequestID: "req-1", IP: "127.0.0.1"})
+
+	events := []AuditEvent{
+		NewAuditEvent(ctx, AuditUserBlocked, "alice").withDetails("fraud"),
+		NewAuditEvent(ctx, AuditBalanceAdjusted, "bob").withAmounts(100, 50.5),
+		NewAuditEvent(context.Background(), AuditOrderUpdated, "12345678903"),
+	}
+
+	prevHash := ""
+	for i := range events {
+		events[i].ID = int64(i + 1)
+		events[i].PrevHash = prevHash
+		events[i].Hash = events[i].ComputeHash()
+		prevHash = events[i].Hash
+	}
+
+	return events
+}
+
+func verifyChain(events []AuditEvent) (int64, error) {
+	verifier := AuditChainVerifier{}
+
+	for _, event := range events {
+		err := verifier.Next(event)
+		if err != nil {
+			return verifier.Checked, err
+		}
+	}
+
+	return verifier.Checked, nil
+}
+
+func TestNewAuditEvent(t *testing.T) {
+	events := newTestChain()
+
+	require.Equal(t, "admin", events[0].Actor)
+	require.Equal(t, "req-1", events[0].RequestID)
+	require.Equal(t, auditSystemActor, events[2].Actor)
+}
+
+func TestAuditChainVerifier(t *testing.T) {
+	checked, err := verifyChain(newTestChain())
+	require.NoError(t, err)
+	require.Equal(t, int64(3), checked)
+}
+
+func TestAuditChainVerifierDetectsTampering(t *testing.T) {
+	tests := map[string]struct {
+		tamper  func(events []AuditEvent) []AuditEvent
+		checked int64
+	}{
+		"amount changed": {
+			tamper: func(events []AuditEvent) []AuditEvent {
+				after := float32(500)
+				events[1].AmountAfter = &after
+				return events
+			},
+			checked: 1,
+		},
+		"event deleted": {
+			tamper: func(events []AuditEvent) []AuditEvent {
+				return append(events[:1], events[2:]...)
+			},
+			checked: 1,
+		},
+		"event rehashed": {
+			tamper: func(events []AuditEvent) []AuditEvent {
+				events[1].Target = "mallory"
+				events[1].Hash = events[1].ComputeHash()
+				return events
+			},
+			checked: 2,
+		},
+	}
+
+	for name, tt := range tests {
+		checked, err := verifyChain(tt.tamper(newTestChain()))
+		require.True(t, errors.Is(err, ErrAuditChainBroken), name)
+		require.Equal(t, tt.checked, checked, name)
+	}
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type Storage interface {
@@ -13,30 +15,188 @@ type Storage interface {
 	GetUserByCreds(context.Context, User) (User, error)
 	GetUserByName(context.Context, string) (User, error)
 	GetUserBalance(context.Context, string) (Balance, error)
+	UpdatePassword(context.Context, User) error
+	SetUserRole(context.Context, User) error
+	SetUserBlocked(context.Context, User) error
+	SearchUsers(context.Context, string, int, int) ([]User, error)
+	AdjustBalance(context.Context, BalanceAdjustment) error
+
+	GetTierStandings(context.Context, time.Time) ([]TierStanding, error)
+	GetTierStanding(context.Context, string, time.Time) (TierStanding, error)
+	SetUserTier(context.Context, string, string, float32) error
+
+	GetUserByIdentity(context.Context, string, string) (User, error)
+	CreateUserWithIdentity(context.Context, User, UserIdentity) error
+	LinkIdentity(context.Context, UserIdentity) error
+
+	SavePasswordReset(context.Context, PasswordReset) error
+	ResetPassword(context.Context, string, User) (string, error)
+
+	SetTOTPSecret(context.Context, string, string) error
+	EnableTOTP(context.Context, string, int64, []string) error
+	DisableTOTP(context.Context, string) error
+	UseTOTPStep(context.Context, string, int64) error
+	UseRecoveryCode(context.Context, string, string) error
+
+	ReserveLoginAttempt(context.Context, map[string]LoginPolicy, time.Time) ([]LoginAttempt, error)
+	ReleaseLoginAttempt(context.Context, []string) error
+	ResetLoginAttempts(context.Context, []string) error
 
 	SaveOrder(context.Context, Order) error
-	UpdateOrder(context.Context, AccrualOrder) error
+	UpdateOrder(context.Context, AccrualOrder) (Order, error)
 	GetUserOrders(context.Context, string, string) ([]Order, error)
 	GetOrders(context.Context, []Status) ([]Order, error)
+	RequeueOrder(context.Context, string) error
+	GetProcessedOrders(context.Context, time.Time) ([]Order, error)
+	ReviseOrder(context.Context, AccrualOrder, ClawbackPolicy) error
 
 	SaveWithdrawal(context.Context, Withdrawal) error
 	GetWithdrawals(context.Context, string, string) ([]Withdrawal, error)
+	RefundWithdrawal(context.Context, Refund) (Refund, error)
+
+	TransferPoints(context.Context, Transfer, float32) (Transfer, error)
+	GetTransfers(context.Context, string) ([]Transfer, error)
+
+	CreateCampaign(context.Context, Campaign) (Campaign, error)
+	GetCampaigns(context.Context) ([]Campaign, error)
+	RedeemPromo(context.Context, string, string, time.Time) (Bonus, error)
+	GrantWelcomeBonus(context.Context, string, time.Time) (Bonus, error)
+	GetBonuses(context.Context, string) ([]Bonus, error)
+
+	GetReferralCode(context.Context, string, string) (string, error)
+	GetUserByReferralCode(context.Context, string) (User, error)
+	CreateReferral(context.Context, Referral) (Referral, error)
+	GetReferrals(context.Context, string) ([]Referral, error)
+	RewardReferral(context.Context, string, float32, float32, time.Time) error
+
+	CreateHold(context.Context, Hold) (Hold, error)
+	GetHolds(context.Context, string) ([]Hold, error)
+	ConfirmHold(context.Context, string, int, time.Time) error
+	CancelHold(context.Context, string, int, time.Time) error
+	ReleaseExpiredHolds(context.Context, time.Time) (int, error)
+
+	ExpirePoints(context.Context, time.Time) (int, error)
+	StreamStatement(context.Context, string, time.Time, time.Time, func(StatementEntry) error) error
+
+	SaveSigningKey(context.Context, SigningKey) error
+	GetSigningKeys(context.Context) ([]SigningKey, error)
+	DeleteSigningKeys(context.Context, time.Time) error
+
+	SaveAPIKey(context.Context, APIKey) (int, error)
+	GetAPIKeyByPrefix(context.Context, string) (APIKey, error)
+	GetAPIKeys(context.Context) ([]APIKey, error)
+	RevokeAPIKey(context.Context, int) error
+
+	ClaimOutboxMessages(context.Context, time.Time, int, time.Duration) ([]OutboxMessage, error)
+	MarkOutboxPublished(context.Context, int64, time.Time) error
+
+	CreateWebhook(context.Context, Webhook) (Webhook, error)
+	GetWebhooks(context.Context) ([]Webhook, error)
+	DisableWebhook(context.Context, int) error
+	ClaimWebhookDeliveries(context.Context, time.Time, int, time.Duration) ([]WebhookDelivery, error)
+	UpdateWebhookDelivery(context.Context, WebhookDelivery) error
+	GetWebhookDeliveries(context.Context, int, int, int) ([]WebhookDelivery, error)
+
+	SaveAuditEvent(context.Context, AuditEvent) error
+	GetAuditEvents(context.Context, AuditFilter) ([]AuditEvent, error)
+	VerifyAuditLog(context.Context) (int64, error)
 
 	Close()
 }
 
-var storageMap = map[string]func(string) (Storage, error){
+// Options are driver settings beyond the connection URI
+type Options struct {
+	// PointsLifetime is how many months credited points stay spendable;
+	// zero keeps them forever
+	PointsLifetime int
+}
+
+type Option func(*Options)
+
+func WithPointsLifetime(months int) Option {
+	return func(opts *Options) {
+		opts.PointsLifetime = months
+	}
+}
+
+func newOptions(opts []Option) Options {
+	options := Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// newLot makes a lot of credited points expiring at the end of the day
+// PointsLifetime months after it was earned
+func (o Options) newLot(userName, source string, amount float32, at time.Time) PointLot {
+	lot := PointLot{
+		UserName:  userName,
+		Source:    source,
+		Amount:    amount,
+		Remaining: amount,
+		EarnedAt:  at,
+	}
+
+	if o.PointsLifetime > 0 {
+		y, m, d := at.UTC().AddDate(0, o.PointsLifetime, 0).Date()
+		expiresAt := time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		lot.ExpiresAt = &expiresAt
+	}
+
+	return lot
+}
+
+var storageMap = map[string]func(string, ...Option) (Storage, error){
 	"sqlx": NewSQLxDriver,
 	"gorm": NewSQLxDriver,
 }
 
-func NewStorage(name, uri string) (Storage, error) {
+// escapeLike escapes LIKE pattern wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// statementQuery collects every change of a user balance; %[1]s is the
+// placeholder of the user name. Accruals are listed as first credited,
+// later revisions follow as entries of their own. The part of an accrual
+// that repaid debt is listed as a debit next to it. Expirations have
+// no table besides the audit log.
+const statementQuery = `
+	SELECT 'accrual' AS type, o.number AS reference, coalesce((
+			SELECT r.accrual_before FROM order_revisions r WHERE r.orderid = o.number ORDER BY r.id LIMIT 1
+		), o.accrual) AS amount, coalesce(o.processed_at, o.uploaded_at) AS at
+	FROM orders o WHERE o.registered_by = %[1]s
+	UNION ALL
+	SELECT 'debt_repayment', number, -repaid, coalesce(processed_at, uploaded_at)
+	FROM orders WHERE registered_by = %[1]s AND repaid > 0
+	UNION ALL
+	SELECT 'revision', orderid, credited, created_at FROM order_revisions WHERE user_name = %[1]s
+	UNION ALL
+	SELECT 'withdrawal', orderid, -sum, processed_at FROM withdrawals WHERE registered_by = %[1]s
+	UNION ALL
+	SELECT 'refund', orderid, sum, created_at FROM refunds WHERE user_name = %[1]s
+	UNION ALL
+	SELECT 'adjustment', reason, amount, created_at FROM balance_adjustments WHERE user_name = %[1]s
+	UNION ALL
+	SELECT 'transfer_out', to_user, -sum, created_at FROM transfers WHERE from_user = %[1]s
+	UNION ALL
+	SELECT 'transfer_in', from_user, sum, created_at FROM transfers WHERE to_user = %[1]s
+	UNION ALL
+	SELECT kind, campaign, points, created_at FROM bonuses WHERE user_name = %[1]s
+	UNION ALL
+	SELECT 'expiration', '', amount_after - amount_before, created_at FROM audit_events
+	WHERE target = %[1]s AND action = '` + AuditBalanceExpired + `'
+`
+
+func NewStorage(name, uri string, opts ...Option) (Storage, error) {
 	driverCreator, ok := storageMap[name]
 	if !ok {
 		return nil, fmt.Errorf(`DB ORM "%s" is not supported; use "gorm/sqlx"`, name)
 	}
 
-	driver, err := driverCreator(uri)
+	driver, err := driverCreator(uri, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -2,18 +2,24 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
 type GORMDriver struct {
 	conn *gorm.DB
+	opts Options
 }
 
-func NewGORMDriver(uri string) (Storage, error) {
+func NewGORMDriver(uri string, opts ...Option) (Storage, error) {
 	db, err := gorm.Open(postgres.Open(uri), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
@@ -21,11 +27,22 @@ func NewGORMDriver(uri string) (Storage, error) {
 		return nil, fmt.Errorf("failed to open DB connection: %w", err)
 	}
 
-	return &GORMDriver{db}, nil
+	return &GORMDriver{db, newOptions(opts)}, nil
 }
 
 func (g *GORMDriver) Init(ctx context.Context) error {
-	g.conn.AutoMigrate(&User{}, &Order{}, &Withdrawal{})
+	g.conn.AutoMigrate(&User{}, &Order{}, &Withdrawal{}, &BalanceAdjustment{}, &PasswordReset{}, &RecoveryCode{}, &LoginAttempt{}, &SigningKey{}, &AuditEvent{}, &APIKey{}, &UserIdentity{}, &Hold{}, &Refund{}, &OrderRevision{}, &PointLot{}, &Transfer{}, &Campaign{}, &Bonus{}, &Referral{}, &OutboxMessage{}, &Webhook{}, &WebhookDelivery{})
+
+	// Orders credited before multipliers got exactly what accrual system returned
+	g.conn.WithContext(ctx).Exec("UPDATE orders SET base_accrual = accrual WHERE base_accrual = 0 AND accrual <> 0")
+
+	// Referral bonuses belong to no campaign
+	g.conn.WithContext(ctx).Exec("ALTER TABLE bonuses ALTER COLUMN campaign_id DROP NOT NULL")
+
+	for _, statement := range auditAppendOnlyStatements {
+		g.conn.WithContext(ctx).Exec(statement)
+	}
+
 	return nil
 }
 
@@ -42,7 +59,89 @@ func (g *GORMDriver) CreateUser(ctx context.Context, user User) error {
 		return ErrUserExists
 	}
 
-	g.conn.WithContext(ctx).Omit("password").Create(&user)
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit("password").Create(&user).Error
+		if err != nil {
+			return err
+		}
+
+		err = createGORMOutboxMessage(tx, EventPayload{Event: EventUserRegistered, User: user.Name, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditUserRegistered, user.Name)
+		event.Actor = user.Name
+
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) GetUserByIdentity(ctx context.Context, issuer string, subject string) (User, error) {
+	user := User{}
+
+	g.conn.WithContext(ctx).
+		Joins("JOIN user_identities ON user_identities.user_name = users.name").
+		Where("user_identities.issuer = ? AND user_identities.subject = ?", issuer, subject).
+		Take(&user)
+	if user.ID == 0 {
+		return User{}, ErrUserDoesNotExist
+	}
+
+	return user, nil
+}
+
+func (g *GORMDriver) CreateUserWithIdentity(ctx context.Context, user User, identity UserIdentity) error {
+	existingUser := User{}
+
+	g.conn.WithContext(ctx).Where("name = ?", user.Name).Take(&existingUser)
+	if existingUser.ID != 0 {
+		return ErrUserExists
+	}
+
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Omit("password").Create(&user).Error
+		if err != nil {
+			return err
+		}
+
+		err = createGORMOutboxMessage(tx, EventPayload{Event: EventUserRegistered, User: user.Name, CreatedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+
+		err = createGORMIdentity(tx, identity)
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditUserRegistered, user.Name).withDetails(identity.Issuer)
+		event.Actor = user.Name
+
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) LinkIdentity(ctx context.Context, identity UserIdentity) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := createGORMIdentity(tx, identity)
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditUserIdentityLinked, identity.UserName).withDetails(identity.Issuer))
+	})
+}
+
+func createGORMIdentity(tx *gorm.DB, identity UserIdentity) error {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&identity)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrIdentityAlreadyLinked
+	}
 
 	return nil
 }
@@ -74,80 +173,1708 @@ func (g *GORMDriver) GetUserBalance(ctx context.Context, userName string) (Balan
 		return Balance{}, ErrUserDoesNotExist
 	}
 
-	return Balance{
-		Current:   user.Current,
-		Withdrawn: user.Withdrawn,
-	}, nil
+	balance := user.Balance()
+
+	expiry := PointsExpiry{}
+
+	err := g.conn.WithContext(ctx).Model(&PointLot{}).
+		Select("expires_at AS at, sum(remaining) AS amount").
+		Where("user_name = ? AND remaining > 0 AND expires_at IS NOT NULL", userName).
+		Group("expires_at").Order("expires_at").Limit(1).
+		Scan(&expiry).Error
+	if err != nil {
+		return Balance{}, err
+	}
+
+	if !expiry.At.IsZero() {
+		balance.NextExpiry = &expiry
+	}
+
+	return balance, nil
 }
 
-func (g *GORMDriver) SaveOrder(ctx context.Context, order Order) error {
-	existingOrder := Order{}
+// spendGORMLots takes amount from the oldest lots of user locked by the caller
+func spendGORMLots(tx *gorm.DB, userName string, amount float32) error {
+	if amount <= 0 {
+		return nil
+	}
 
-	g.conn.WithContext(ctx).Where("number = ?", order.Number).Take(&existingOrder)
-	if existingOrder.ID != 0 {
-		if existingOrder.RegisteredBy == order.RegisteredBy {
-			return ErrOrderAlreadyRegisteredByUser
+	lots := []PointLot{}
+
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_name = ? AND remaining > 0", userName).
+		Order("earned_at, id").Find(&lots).Error
+	if err != nil {
+		return err
+	}
+
+	return updateGORMLots(tx, takeFromLots(lots, amount))
+}
+
+func updateGORMLots(tx *gorm.DB, lots []PointLot) error {
+	for _, lot := range lots {
+		err := tx.Model(&lot).Update("remaining", lot.Remaining).Error
+		if err != nil {
+			return err
 		}
+	}
 
-		if existingOrder.RegisteredBy != order.RegisteredBy {
-			return ErrOrderAlreadyRegisteredBySomeoneElse
+	return nil
+}
+
+func (g *GORMDriver) ExpirePoints(ctx context.Context, at time.Time) (int, error) {
+	userNames := []string{}
+	g.conn.WithContext(ctx).Model(&PointLot{}).Distinct("user_name").Where("remaining > 0 AND expires_at <= ?", at).Pluck("user_name", &userNames)
+
+	expired := 0
+
+	for _, userName := range userNames {
+		ok := false
+
+		err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			user := User{}
+
+			tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", userName).Take(&user)
+			if user.ID == 0 {
+				return ErrUserDoesNotExist
+			}
+
+			lots := []PointLot{}
+
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("user_name = ? AND remaining > 0 AND expires_at <= ?", userName, at).
+				Order("earned_at, id").Find(&lots).Error
+			if err != nil {
+				return err
+			}
+
+			amount := expirable(user, lots)
+			if amount <= 0 {
+				return nil
+			}
+
+			err = updateGORMLots(tx, takeFromLots(lots, amount))
+			if err != nil {
+				return err
+			}
+
+			tx.Model(&user).Update("current", gorm.Expr("current - ?", amount))
+
+			ok = true
+
+			err = enqueueGORMWebhooks(tx, newBalancePayload(WebhookBalanceExpired, user, -amount, at))
+			if err != nil {
+				return err
+			}
+
+			event := NewAuditEvent(ctx, AuditBalanceExpired, userName).
+				withAmounts(user.Current, user.Current-amount)
+
+			return appendGORMAuditEvent(tx, event)
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		if ok {
+			expired++
 		}
 	}
 
-	g.conn.WithContext(ctx).Create(&order)
+	return expired, nil
+}
 
-	return nil
+func (g *GORMDriver) UpdatePassword(ctx context.Context, user User) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("name = ?", user.Name).Updates(map[string]interface{}{"passhash": user.Passhash, "sessions_valid_after": user.SessionsValidAfter})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditUserPasswordChanged, user.Name))
+	})
 }
 
-func (g *GORMDriver) UpdateOrder(ctx context.Context, order AccrualOrder) error {
-	g.conn.WithContext(ctx).Model(&Order{}).Where("number = ?", order.Order).Updates(map[string]interface{}{"status": order.Status, "accrual": order.Accrual})
+func (g *GORMDriver) SetUserRole(ctx context.Context, user User) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Admins demoting each other at once must not both succeed
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", roleChangeLockID).Error
+		if err != nil {
+			return err
+		}
+
+		existingUser := User{}
 
-	updatedOrder := Order{}
-	g.conn.WithContext(ctx).Where("number = ?", order.Order).Take(&updatedOrder)
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", user.Name).Take(&existingUser)
+		if existingUser.ID == 0 {
+			return ErrUserDoesNotExist
+		}
 
-	g.conn.WithContext(ctx).Model(&User{}).Where("name = ?", updatedOrder.RegisteredBy).Update("current", gorm.Expr("current + ?", updatedOrder.Accrual))
+		if existingUser.Role == user.Role {
+			return nil
+		}
 
-	return nil
+		if existingUser.Role == RoleAdmin {
+			var admins int64
+
+			err = tx.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error
+			if err != nil {
+				return err
+			}
+
+			if admins <= 1 {
+				return ErrLastAdmin
+			}
+		}
+
+		err = tx.Model(&existingUser).Updates(map[string]interface{}{"role": user.Role, "sessions_valid_after": user.SessionsValidAfter}).Error
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditUserRoleChanged, user.Name).withDetails(fmt.Sprintf("%s -> %s", existingUser.Role, user.Role))
+
+		return appendGORMAuditEvent(tx, event)
+	})
 }
 
-func (g *GORMDriver) GetUserOrders(ctx context.Context, userName string, orderField string) ([]Order, error) {
-	orders := []Order{}
-	g.conn.WithContext(ctx).Order(orderField).Where("registered_by=?", userName).Find(&orders)
+func (g *GORMDriver) SetUserBlocked(ctx context.Context, user User) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("name = ?", user.Name).Updates(map[string]interface{}{"blocked": user.Blocked, "block_reason": user.BlockReason, "sessions_valid_after": user.SessionsValidAfter})
+		if result.Error != nil {
+			return result.Error
+		}
 
-	return orders, nil
+		if result.RowsAffected == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		action := AuditUserUnblocked
+		if user.Blocked {
+			action = AuditUserBlocked
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, action, user.Name).withDetails(user.BlockReason))
+	})
 }
 
-func (g *GORMDriver) GetOrders(ctx context.Context, statuses []Status) ([]Order, error) {
-	orders := []Order{}
-	g.conn.WithContext(ctx).Where("status IN ?", statuses).Find(&orders)
+func (g *GORMDriver) SearchUsers(ctx context.Context, query string, limit int, offset int) ([]User, error) {
+	pattern := "%" + escapeLike(query) + "%"
 
-	return orders, nil
+	users := []User{}
+	g.conn.WithContext(ctx).Where("name ILIKE ? OR email ILIKE ?", pattern, pattern).Order("name").Limit(limit).Offset(offset).Find(&users)
+
+	return users, nil
 }
 
-func (g *GORMDriver) SaveWithdrawal(ctx context.Context, withdrawal Withdrawal) error {
-	user := User{}
+func (g *GORMDriver) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
 
-	g.conn.WithContext(ctx).Where("name = ?", withdrawal.RegisteredBy).Take(&user)
-	if user.ID == 0 {
-		return ErrUserDoesNotExist
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", adjustment.UserName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		if adjustment.Amount < 0 && user.Current+adjustment.Amount < user.Held {
+			return ErrNotEnoughPoints
+		}
+
+		tx.Model(&user).Update("current", gorm.Expr("current + ?", adjustment.Amount))
+
+		err := tx.Create(&adjustment).Error
+		if err != nil {
+			return err
+		}
+
+		if adjustment.Amount > 0 {
+			lot := g.opts.newLot(adjustment.UserName, "adjustment", adjustment.Amount, adjustment.CreatedAt)
+			err = tx.Create(&lot).Error
+		} else {
+			err = spendGORMLots(tx, adjustment.UserName, -adjustment.Amount)
+		}
+		if err != nil {
+			return err
+		}
+
+		payload := newBalancePayload(WebhookBalanceAdjusted, user, adjustment.Amount, adjustment.CreatedAt)
+		payload.Adjustment = &adjustment
+
+		err = enqueueGORMWebhooks(tx, payload)
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditBalanceAdjusted, adjustment.UserName).
+			withAmounts(user.Current, user.Current+adjustment.Amount).
+			withDetails(adjustment.Reason)
+
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) tierStandings(ctx context.Context, since time.Time) *gorm.DB {
+	return g.conn.WithContext(ctx).Model(&User{}).
+		Select("users.name AS user_name, users.tier, coalesce(sum(orders.base_accrual), 0) AS accrued").
+		Joins("LEFT JOIN orders ON orders.registered_by = users.name AND orders.status = ? AND orders.processed_at >= ?", StatusProcessed, since).
+		Group("users.name, users.tier")
+}
+
+func (g *GORMDriver) GetTierStandings(ctx context.Context, since time.Time) ([]TierStanding, error) {
+	standings := []TierStanding{}
+
+	err := g.tierStandings(ctx, since).Scan(&standings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return standings, nil
+}
+
+func (g *GORMDriver) GetTierStanding(ctx context.Context, userName string, since time.Time) (TierStanding, error) {
+	standing := TierStanding{}
+
+	g.tierStandings(ctx, since).Where("users.name = ?", userName).Scan(&standing)
+	if standing.UserName == "" {
+		return TierStanding{}, ErrUserDoesNotExist
 	}
 
-	if user.Current < withdrawal.Sum {
-		return ErrNotEnoughPoints
+	return standing, nil
+}
+
+func (g *GORMDriver) SetUserTier(ctx context.Context, userName string, tier string, multiplier float32) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", userName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		if user.Tier == tier && user.Multiplier == multiplier {
+			return nil
+		}
+
+		err := tx.Model(&user).Updates(map[string]interface{}{"tier": tier, "multiplier": multiplier}).Error
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditUserTierChanged, userName).
+			withDetails(fmt.Sprintf("%s -> %s x%v", user.Tier, tier, multiplier))
+
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) SavePasswordReset(ctx context.Context, reset PasswordReset) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tx.Model(&PasswordReset{}).Where("user_name = ? AND used_at IS NULL", reset.UserName).Update("used_at", gorm.Expr("now()"))
+
+		return tx.Create(&reset).Error
+	})
+}
+
+func (g *GORMDriver) ResetPassword(ctx context.Context, tokenHash string, user User) (string, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		reset := PasswordReset{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, user.SessionsValidAfter).Take(&reset)
+		if reset.ID == 0 {
+			return ErrInvalidResetToken
+		}
+
+		tx.Model(&reset).Update("used_at", user.SessionsValidAfter)
+
+		user.Name = reset.UserName
+
+		err := tx.Model(&User{}).Where("name = ?", user.Name).Updates(map[string]interface{}{"passhash": user.Passhash, "sessions_valid_after": user.SessionsValidAfter}).Error
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditUserPasswordReset, user.Name)
+		event.Actor = user.Name
+
+		return appendGORMAuditEvent(tx, event)
+	})
+	if err != nil {
+		return "", err
 	}
 
-	g.conn.WithContext(ctx).Model(&user).Updates(map[string]interface{}{"current": gorm.Expr("current - ?", withdrawal.Sum), "withdrawn": gorm.Expr("withdrawn + ?", withdrawal.Sum)})
+	return user.Name, nil
+}
+
+func (g *GORMDriver) SetTOTPSecret(ctx context.Context, userName string, secret string) error {
+	result := g.conn.WithContext(ctx).Model(&User{}).Where("name = ? AND NOT totp_enabled", userName).Update("totp_secret", secret)
+	if result.Error != nil {
+		return result.Error
+	}
 
-	g.conn.WithContext(ctx).Create(&withdrawal)
+	if result.RowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
 
 	return nil
 }
 
-func (g *GORMDriver) GetWithdrawals(ctx context.Context, userName string, orderField string) ([]Withdrawal, error) {
-	withdrawals := []Withdrawal{}
-	g.conn.WithContext(ctx).Order(orderField).Where("registered_by=?", userName).Find(&withdrawals)
+func (g *GORMDriver) EnableTOTP(ctx context.Context, userName string, step int64, recoveryCodeHashes []string) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&User{}).Where("name = ? AND NOT totp_enabled AND totp_secret != ''", userName).Updates(map[string]interface{}{"totp_enabled": true, "totp_last_step": step})
+		if result.Error != nil {
+			return result.Error
+		}
 
-	return withdrawals, nil
+		if result.RowsAffected == 0 {
+			return ErrTOTPAlreadyEnabled
+		}
+
+		tx.Where("user_name = ?", userName).Delete(&RecoveryCode{})
+
+		for _, codeHash := range recoveryCodeHashes {
+			err := tx.Create(&RecoveryCode{UserName: userName, CodeHash: codeHash}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditUserMFAEnabled, userName))
+	})
+}
+
+func (g *GORMDriver) DisableTOTP(ctx context.Context, userName string) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tx.Model(&User{}).Where("name = ?", userName).Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0})
+
+		err := tx.Where("user_name = ?", userName).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditUserMFADisabled, userName))
+	})
+}
+
+func (g *GORMDriver) UseTOTPStep(ctx context.Context, userName string, step int64) error {
+	result := g.conn.WithContext(ctx).Model(&User{}).Where("name = ? AND totp_last_step < ?", userName, step).Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+func (g *GORMDriver) UseRecoveryCode(ctx context.Context, userName string, codeHash string) error {
+	result := g.conn.WithContext(ctx).Model(&RecoveryCode{}).Where("user_name = ? AND code_hash = ? AND used_at IS NULL", userName, codeHash).Update("used_at", gorm.Expr("now()"))
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	return nil
+}
+
+func (g *GORMDriver) ReserveLoginAttempt(ctx context.Context, policies map[string]LoginPolicy, at time.Time) ([]LoginAttempt, error) {
+	keys := make([]string, 0, len(policies))
+	for key := range policies {
+		keys = append(keys, key)
+	}
+
+	// Locks are always taken in the same order not to deadlock
+	sort.Strings(keys)
+
+	throttled := []LoginAttempt{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, key := range keys {
+			err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", loginAttemptLockID, key).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		attempts := []LoginAttempt{}
+
+		err := tx.Where("key IN ?", keys).Find(&attempts).Error
+		if err != nil {
+			return err
+		}
+
+		for _, attempt := range attempts {
+			if wait, _ := attempt.RetryAfter(policies[attempt.Key], at); wait > 0 {
+				throttled = append(throttled, attempt)
+			}
+		}
+
+		if len(throttled) > 0 {
+			return nil
+		}
+
+		for _, key := range keys {
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "key"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"failures":     gorm.Expr("CASE WHEN login_attempts.last_failure < ? THEN 1 ELSE login_attempts.failures + 1 END", at.Add(-policies[key].Lockout)),
+					"last_failure": at,
+				}),
+			}).Create(&LoginAttempt{Key: key, Failures: 1, LastFailure: at}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return throttled, nil
+}
+
+func (g *GORMDriver) ReleaseLoginAttempt(ctx context.Context, keys []string) error {
+	return g.conn.WithContext(ctx).Model(&LoginAttempt{}).Where("key IN ?", keys).Update("failures", gorm.Expr("greatest(failures - 1, 0)")).Error
+}
+
+func (g *GORMDriver) ResetLoginAttempts(ctx context.Context, keys []string) error {
+	return g.conn.WithContext(ctx).Where("key IN ?", keys).Delete(&LoginAttempt{}).Error
+}
+
+func (g *GORMDriver) SaveOrder(ctx context.Context, order Order) error {
+	existingOrder := Order{}
+
+	g.conn.WithContext(ctx).Where("number = ?", order.Number).Take(&existingOrder)
+	if existingOrder.ID != 0 {
+		if existingOrder.RegisteredBy == order.RegisteredBy {
+			return ErrOrderAlreadyRegisteredByUser
+		}
+
+		if existingOrder.RegisteredBy != order.RegisteredBy {
+			return ErrOrderAlreadyRegisteredBySomeoneElse
+		}
+	}
+
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&order).Error
+		if err != nil {
+			return err
+		}
+
+		err = createGORMOutboxMessage(tx, EventPayload{Event: EventOrderUploaded, User: order.RegisteredBy, Order: &order, CreatedAt: order.UploadedAt})
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditOrderUploaded, order.Number).withDetails(order.RegisteredBy))
+	})
+}
+
+func (g *GORMDriver) UpdateOrder(ctx context.Context, processed AccrualOrder) (Order, error) {
+	order := Order{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", processed.Order).Take(&order)
+		if order.ID == 0 {
+			return ErrOrderDoesNotExist
+		}
+
+		// Pushed results are trusted from the provider the order is routed to only,
+		// orders uploaded before providers were recorded are left to polling
+		if processed.Provider != "" && processed.Provider != order.Provider {
+			return ErrOrderOtherProvider
+		}
+
+		// Results may come from both polling and callbacks, only the first counts
+		if order.Status.Final() {
+			return ErrOrderAlreadyProcessed
+		}
+
+		// Pending orders are polled over and over, repeats change nothing
+		if !order.changedBy(processed) {
+			return ErrOrderNotChanged
+		}
+
+		user := User{}
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", order.RegisteredBy).Take(&user)
+
+		// Tier multiplier of the moment is kept with the order
+		base := processed.credited()
+		accrual := base * user.Multiplier
+
+		credited, repaid := user.repayDebt(accrual)
+
+		updates := map[string]interface{}{
+			"status":       processed.Status,
+			"accrual":      accrual,
+			"base_accrual": base,
+			"multiplier":   user.Multiplier,
+			"repaid":       repaid,
+		}
+		if processed.Status == StatusProcessed {
+			updates["processed_at"] = gorm.Expr("now()")
+		}
+
+		tx.Model(&order).Updates(updates)
+		order.Status, order.Accrual, order.BaseAccrual, order.Multiplier, order.Repaid = processed.Status, accrual, base, user.Multiplier, repaid
+
+		tx.Model(&user).Updates(map[string]interface{}{"current": gorm.Expr("current + ?", credited), "debt": gorm.Expr("debt - ?", repaid)})
+
+		if credited > 0 {
+			lot := g.opts.newLot(user.Name, order.Number, credited, time.Now())
+
+			err := tx.Create(&lot).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		updated := user
+		updated.Current, updated.Debt = user.Current+credited, user.Debt-repaid
+
+		payload := EventPayload{
+			Event:     WebhookOrderUpdated,
+			User:      user.Name,
+			Order:     &order,
+			Balance:   updated.Balance(),
+			CreatedAt: time.Now(),
+		}
+
+		err := enqueueGORMWebhooks(tx, payload)
+		if err != nil {
+			return err
+		}
+
+		if processed.Status == StatusProcessed {
+			payload.Event = EventOrderProcessed
+
+			err = createGORMOutboxMessage(tx, payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		event := NewAuditEvent(ctx, AuditOrderUpdated, order.Number).
+			withAmounts(user.Current, user.Current+credited).
+			withDetails(processed.Status.String())
+
+		return appendGORMAuditEvent(tx, event)
+	})
+	if err != nil {
+		return Order{}, err
+	}
+
+	return order, nil
+}
+
+func (g *GORMDriver) GetUserOrders(ctx context.Context, userName string, orderField string) ([]Order, error) {
+	orders := []Order{}
+	g.conn.WithContext(ctx).Order(orderField).Where("registered_by=?", userName).Find(&orders)
+
+	return orders, nil
+}
+
+func (g *GORMDriver) GetOrders(ctx context.Context, statuses []Status) ([]Order, error) {
+	orders := []Order{}
+	g.conn.WithContext(ctx).Where("status IN ?", statuses).Find(&orders)
+
+	return orders, nil
+}
+
+func (g *GORMDriver) GetProcessedOrders(ctx context.Context, since time.Time) ([]Order, error) {
+	orders := []Order{}
+
+	err := g.conn.WithContext(ctx).Where("status = ? AND processed_at >= ?", StatusProcessed, since).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (g *GORMDriver) ReviseOrder(ctx context.Context, revised AccrualOrder, policy ClawbackPolicy) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order := Order{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", revised.Order).Take(&order)
+		if order.ID == 0 {
+			return ErrOrderDoesNotExist
+		}
+
+		if order.Status != StatusProcessed {
+			return ErrOrderNotProcessed
+		}
+
+		if revised.points() == order.BaseAccrual && revised.Status == order.Status {
+			return nil
+		}
+
+		revision := newOrderRevision(order, revised)
+
+		user := User{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", order.RegisteredBy).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		revision.Credited, revision.Debt = user.accrualChange(revision.AccrualAfter-revision.AccrualBefore, policy)
+
+		err := tx.Model(&order).Updates(map[string]interface{}{"status": revision.StatusAfter, "accrual": revision.AccrualAfter, "base_accrual": revised.points()}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&user).Updates(map[string]interface{}{"current": gorm.Expr("current + ?", revision.Credited), "debt": gorm.Expr("debt + ?", revision.Debt)}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(&revision).Error
+		if err != nil {
+			return err
+		}
+
+		if revision.Credited > 0 {
+			lot := g.opts.newLot(user.Name, order.Number, revision.Credited, revision.CreatedAt)
+			err = tx.Create(&lot).Error
+		} else {
+			err = spendGORMLots(tx, user.Name, -revision.Credited)
+		}
+		if err != nil {
+			return err
+		}
+
+		payload := newBalancePayload(WebhookOrderRevised, user, revision.Credited, revision.CreatedAt)
+		payload.Balance.Debt += revision.Debt
+		payload.Revision = &revision
+
+		err = enqueueGORMWebhooks(tx, payload)
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditOrderRevised, order.Number).
+			withAmounts(user.Current, user.Current+revision.Credited).
+			withDetails(revision.String())
+
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) RequeueOrder(ctx context.Context, number string) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order := Order{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", number).Take(&order)
+		if order.ID == 0 {
+			return ErrOrderDoesNotExist
+		}
+
+		if order.Status == StatusProcessed {
+			return ErrOrderAlreadyProcessed
+		}
+
+		err := tx.Model(&order).Updates(map[string]interface{}{"status": StatusNew, "accrual": 0}).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditOrderRequeued, number).withDetails(order.Status.String()))
+	})
+}
+
+func (g *GORMDriver) SaveWithdrawal(ctx context.Context, withdrawal Withdrawal) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", withdrawal.RegisteredBy).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		if user.Balance().Available < withdrawal.Sum {
+			return ErrNotEnoughPoints
+		}
+
+		return createGORMWithdrawal(ctx, tx, user, withdrawal)
+	})
+}
+
+func createGORMWithdrawal(ctx context.Context, tx *gorm.DB, user User, withdrawal Withdrawal) error {
+	tx.Model(&user).Updates(map[string]interface{}{"current": gorm.Expr("current - ?", withdrawal.Sum), "withdrawn": gorm.Expr("withdrawn + ?", withdrawal.Sum)})
+
+	err := tx.Create(&withdrawal).Error
+	if err != nil {
+		return err
+	}
+
+	err = spendGORMLots(tx, withdrawal.RegisteredBy, withdrawal.Sum)
+	if err != nil {
+		return err
+	}
+
+	updated := user
+	updated.Current, updated.Withdrawn = user.Current-withdrawal.Sum, user.Withdrawn+withdrawal.Sum
+
+	payload := EventPayload{
+		Event:      WebhookBalanceWithdrawn,
+		User:       user.Name,
+		Withdrawal: &withdrawal,
+		Balance:    updated.Balance(),
+		CreatedAt:  time.Now(),
+	}
+
+	err = enqueueGORMWebhooks(tx, payload)
+	if err != nil {
+		return err
+	}
+
+	payload.Event = EventPointsWithdrawn
+
+	err = createGORMOutboxMessage(tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceWithdrawn, withdrawal.RegisteredBy).
+		withAmounts(user.Current, user.Current-withdrawal.Sum).
+		withDetails(withdrawal.Order)
+
+	return appendGORMAuditEvent(tx, event)
+}
+
+func (g *GORMDriver) CreateHold(ctx context.Context, hold Hold) (Hold, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", hold.UserName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		available := user.Balance().Available
+		if available < hold.Sum {
+			return ErrNotEnoughPoints
+		}
+
+		hold.Status = HoldActive
+
+		err := tx.Create(&hold).Error
+		if err != nil {
+			return err
+		}
+
+		tx.Model(&user).Update("held", gorm.Expr("held + ?", hold.Sum))
+
+		event := NewAuditEvent(ctx, AuditBalanceHeld, hold.UserName).
+			withAmounts(available, available-hold.Sum).
+			withDetails(hold.Order)
+
+		return appendGORMAuditEvent(tx, event)
+	})
+	if err != nil {
+		return Hold{}, err
+	}
+
+	return hold, nil
+}
+
+func (g *GORMDriver) GetHolds(ctx context.Context, userName string) ([]Hold, error) {
+	holds := []Hold{}
+	g.conn.WithContext(ctx).Order("created_at DESC").Where("user_name = ?", userName).Find(&holds)
+
+	return holds, nil
+}
+
+func lockGORMActiveHold(tx *gorm.DB, userName string, id int) (User, Hold, error) {
+	user := User{}
+
+	tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", userName).Take(&user)
+	if user.ID == 0 {
+		return User{}, Hold{}, ErrHoldDoesNotExist
+	}
+
+	hold := Hold{}
+
+	tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND user_name = ? AND status = ?", id, userName, HoldActive).Take(&hold)
+	if hold.ID == 0 {
+		return User{}, Hold{}, ErrHoldDoesNotExist
+	}
+
+	return user, hold, nil
+}
+
+func releaseGORMHold(ctx context.Context, tx *gorm.DB, user User, hold Hold, status HoldStatus, at time.Time) error {
+	tx.Model(&hold).Updates(map[string]interface{}{"status": status, "resolved_at": at})
+	tx.Model(&user).Update("held", gorm.Expr("held - ?", hold.Sum))
+
+	available := user.Balance().Available
+
+	event := NewAuditEvent(ctx, AuditBalanceHoldReleased, hold.UserName).
+		withAmounts(available, available+hold.Sum).
+		withDetails(string(status))
+
+	return appendGORMAuditEvent(tx, event)
+}
+
+func (g *GORMDriver) ConfirmHold(ctx context.Context, userName string, id int, at time.Time) error {
+	expired := false
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, hold, err := lockGORMActiveHold(tx, userName, id)
+		if err != nil {
+			return err
+		}
+
+		if !at.Before(hold.ExpiresAt) {
+			expired = true
+			return releaseGORMHold(ctx, tx, user, hold, HoldExpired, at)
+		}
+
+		tx.Model(&hold).Updates(map[string]interface{}{"status": HoldConfirmed, "resolved_at": at})
+		tx.Model(&user).Update("held", gorm.Expr("held - ?", hold.Sum))
+
+		return createGORMWithdrawal(ctx, tx, user, Withdrawal{
+			RegisteredBy: userName,
+			Order:        hold.Order,
+			Sum:          hold.Sum,
+			ProcessedAt:  at,
+		})
+	})
+	if err == nil && expired {
+		return ErrHoldExpired
+	}
+
+	return err
+}
+
+func (g *GORMDriver) CancelHold(ctx context.Context, userName string, id int, at time.Time) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user, hold, err := lockGORMActiveHold(tx, userName, id)
+		if err != nil {
+			return err
+		}
+
+		return releaseGORMHold(ctx, tx, user, hold, HoldCancelled, at)
+	})
+}
+
+func (g *GORMDriver) ReleaseExpiredHolds(ctx context.Context, at time.Time) (int, error) {
+	expired := []Hold{}
+	g.conn.WithContext(ctx).Where("status = ? AND expires_at <= ?", HoldActive, at).Find(&expired)
+
+	released := 0
+
+	for _, candidate := range expired {
+		err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			user, hold, err := lockGORMActiveHold(tx, candidate.UserName, candidate.ID)
+			if err != nil {
+				return err
+			}
+
+			return releaseGORMHold(ctx, tx, user, hold, HoldExpired, at)
+		})
+		if errors.Is(err, ErrHoldDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+
+		released++
+	}
+
+	return released, nil
+}
+
+func (g *GORMDriver) GetWithdrawals(ctx context.Context, userName string, orderField string) ([]Withdrawal, error) {
+	withdrawals := []Withdrawal{}
+	g.conn.WithContext(ctx).Order(orderField).Where("registered_by=?", userName).Find(&withdrawals)
+
+	for i := range withdrawals {
+		withdrawals[i].setRefundStatus()
+	}
+
+	return withdrawals, nil
+}
+
+func (g *GORMDriver) RefundWithdrawal(ctx context.Context, refund Refund) (Refund, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", refund.UserName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		withdrawal := Withdrawal{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("registered_by = ? AND orderid = ?", refund.UserName, refund.Order).
+			Order("processed_at DESC").Take(&withdrawal)
+		if withdrawal.ID == 0 {
+			return ErrWithdrawalDoesNotExist
+		}
+
+		if refund.Sum == 0 {
+			refund.Sum = withdrawal.Refundable()
+		}
+
+		if refund.Sum <= 0 || refund.Sum > withdrawal.Refundable() {
+			return ErrRefundExceedsWithdrawal
+		}
+
+		refund.WithdrawalID = withdrawal.ID
+
+		tx.Model(&withdrawal).Update("refunded", gorm.Expr("refunded + ?", refund.Sum))
+		tx.Model(&user).Updates(map[string]interface{}{"current": gorm.Expr("current + ?", refund.Sum), "withdrawn": gorm.Expr("withdrawn - ?", refund.Sum)})
+
+		err := tx.Create(&refund).Error
+		if err != nil {
+			return err
+		}
+
+		// Refunded points start a new lot rather than reviving spent ones
+		lot := g.opts.newLot(refund.UserName, "refund:"+refund.Order, refund.Sum, refund.CreatedAt)
+
+		err = tx.Create(&lot).Error
+		if err != nil {
+			return err
+		}
+
+		payload := newBalancePayload(WebhookBalanceRefunded, user, refund.Sum, refund.CreatedAt)
+		payload.Balance.Withdrawn -= refund.Sum
+		payload.Refund = &refund
+
+		err = enqueueGORMWebhooks(tx, payload)
+		if err != nil {
+			return err
+		}
+
+		event := NewAuditEvent(ctx, AuditBalanceRefunded, refund.UserName).
+			withAmounts(user.Current, user.Current+refund.Sum).
+			withDetails(refund.Order + ": " + refund.Reason)
+
+		return appendGORMAuditEvent(tx, event)
+	})
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return refund, nil
+}
+
+func (g *GORMDriver) TransferPoints(ctx context.Context, transfer Transfer, dailyLimit float32) (Transfer, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Rows are locked in name order so opposite transfers can not deadlock
+		users := []User{}
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name IN ?", []string{transfer.From, transfer.To}).
+			Order("name").Find(&users).Error
+		if err != nil {
+			return err
+		}
+
+		sender, recipient, err := transferParties(users, transfer)
+		if err != nil {
+			return err
+		}
+
+		if dailyLimit > 0 {
+			var sent float32
+
+			tx.Model(&Transfer{}).
+				Where("from_user = ? AND created_at > ?", transfer.From, transfer.CreatedAt.Add(-24*time.Hour)).
+				Select("coalesce(sum(sum), 0)").Scan(&sent)
+
+			if sent+transfer.Sum > dailyLimit {
+				return ErrTransferLimitExceeded
+			}
+		}
+
+		if sender.Balance().Available < transfer.Sum {
+			return ErrNotEnoughPoints
+		}
+
+		tx.Model(&sender).Update("current", gorm.Expr("current - ?", transfer.Sum))
+		tx.Model(&recipient).Update("current", gorm.Expr("current + ?", transfer.Sum))
+
+		lots := []PointLot{}
+
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_name = ? AND remaining > 0", sender.Name).
+			Order("earned_at, id").Find(&lots).Error
+		if err != nil {
+			return err
+		}
+
+		changed, moved := moveLots(lots, transfer.Sum, recipient.Name, "transfer:"+sender.Name)
+
+		err = updateGORMLots(tx, changed)
+		if err != nil {
+			return err
+		}
+
+		if len(moved) > 0 {
+			err = tx.Create(&moved).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Create(&transfer).Error
+		if err != nil {
+			return err
+		}
+
+		for _, payload := range transferPayloads(sender, recipient, transfer) {
+			err = enqueueGORMWebhooks(tx, payload)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, event := range transferAuditEvents(ctx, sender, recipient, transfer) {
+			err = appendGORMAuditEvent(tx, event)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	return transfer, nil
+}
+
+func (g *GORMDriver) GetTransfers(ctx context.Context, userName string) ([]Transfer, error) {
+	transfers := []Transfer{}
+	g.conn.WithContext(ctx).Where("from_user = ? OR to_user = ?", userName, userName).Order("created_at DESC").Find(&transfers)
+
+	return transfers, nil
+}
+
+func (g *GORMDriver) CreateCampaign(ctx context.Context, campaign Campaign) (Campaign, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&campaign)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrCampaignExists
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditCampaignCreated, campaign.Name).withDetails(string(campaign.Kind)))
+	})
+	if err != nil {
+		return Campaign{}, err
+	}
+
+	return campaign, nil
+}
+
+func (g *GORMDriver) GetCampaigns(ctx context.Context) ([]Campaign, error) {
+	campaigns := []Campaign{}
+	g.conn.WithContext(ctx).Order("id DESC").Find(&campaigns)
+
+	return campaigns, nil
+}
+
+func (g *GORMDriver) RedeemPromo(ctx context.Context, code string, userName string, at time.Time) (Bonus, error) {
+	bonus := Bonus{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		campaign := Campaign{}
+
+		// Campaign row is locked first so budget is spent one redemption at a time
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ? AND kind = ?", code, CampaignPromo).Take(&campaign)
+		if campaign.ID == 0 {
+			return ErrCampaignDoesNotExist
+		}
+
+		var err error
+		bonus, err = g.grantBonus(ctx, tx, campaign, userName, at)
+
+		return err
+	})
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	return bonus, nil
+}
+
+func (g *GORMDriver) GrantWelcomeBonus(ctx context.Context, userName string, at time.Time) (Bonus, error) {
+	campaignIDs := []int{}
+	g.conn.WithContext(ctx).Model(&Campaign{}).
+		Where("kind = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", CampaignWelcome, at, at).
+		Order("id").Pluck("id", &campaignIDs)
+
+	// The first campaign with budget left wins
+	err := ErrCampaignDoesNotExist
+	for _, id := range campaignIDs {
+		bonus := Bonus{}
+
+		err = g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			campaign := Campaign{}
+
+			tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).Take(&campaign)
+			if campaign.ID == 0 {
+				return ErrCampaignDoesNotExist
+			}
+
+			var err error
+			bonus, err = g.grantBonus(ctx, tx, campaign, userName, at)
+
+			return err
+		})
+		if err == nil {
+			return bonus, nil
+		}
+	}
+
+	return Bonus{}, err
+}
+
+// grantBonus credits campaign points to user if the campaign allows;
+// the campaign is locked by the caller
+func (g *GORMDriver) grantBonus(ctx context.Context, tx *gorm.DB, campaign Campaign, userName string, at time.Time) (Bonus, error) {
+	user := User{}
+
+	tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", userName).Take(&user)
+	if user.ID == 0 {
+		return Bonus{}, ErrUserDoesNotExist
+	}
+
+	var redeemed int64
+	tx.Model(&Bonus{}).Where("campaign_id = ? AND user_name = ?", campaign.ID, userName).Count(&redeemed)
+
+	err := campaign.check(at, int(redeemed))
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	bonus := campaign.bonus(userName, at)
+
+	tx.Model(&campaign).Update("spent", gorm.Expr("spent + ?", bonus.Points))
+
+	return bonus, g.creditBonus(ctx, tx, user, bonus)
+}
+
+// creditBonus adds bonus points to user locked by the caller
+func (g *GORMDriver) creditBonus(ctx context.Context, tx *gorm.DB, user User, bonus Bonus) error {
+	tx.Model(&user).Update("current", gorm.Expr("current + ?", bonus.Points))
+
+	err := tx.Create(&bonus).Error
+	if err != nil {
+		return err
+	}
+
+	lot := g.opts.newLot(user.Name, string(bonus.Kind)+":"+bonus.Campaign, bonus.Points, bonus.CreatedAt)
+
+	err = tx.Create(&lot).Error
+	if err != nil {
+		return err
+	}
+
+	payload := newBalancePayload(WebhookBalanceBonus, user, bonus.Points, bonus.CreatedAt)
+	payload.Bonus = &bonus
+
+	err = enqueueGORMWebhooks(tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceBonus, user.Name).
+		withAmounts(user.Current, user.Current+bonus.Points).
+		withDetails(string(bonus.Kind) + ": " + bonus.Campaign)
+
+	return appendGORMAuditEvent(tx, event)
+}
+
+func (g *GORMDriver) GetBonuses(ctx context.Context, userName string) ([]Bonus, error) {
+	bonuses := []Bonus{}
+	g.conn.WithContext(ctx).Where("user_name = ?", userName).Order("created_at DESC").Find(&bonuses)
+
+	return bonuses, nil
+}
+
+func (g *GORMDriver) GetReferralCode(ctx context.Context, userName string, candidate string) (string, error) {
+	user := User{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", userName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		// The candidate is only taken if user has no code yet
+		if user.ReferralCode != nil {
+			return nil
+		}
+
+		user.ReferralCode = &candidate
+
+		return tx.Model(&user).Update("referral_code", candidate).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return *user.ReferralCode, nil
+}
+
+func (g *GORMDriver) GetUserByReferralCode(ctx context.Context, code string) (User, error) {
+	user := User{}
+
+	g.conn.WithContext(ctx).Where("referral_code = ?", code).Take(&user)
+	if user.ID == 0 {
+		return User{}, ErrReferralCodeInvalid
+	}
+
+	return user, nil
+}
+
+func (g *GORMDriver) CreateReferral(ctx context.Context, referral Referral) (Referral, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		referrerIPs := []string{}
+		tx.Model(&AuditEvent{}).Distinct("ip").Where("actor = ? AND ip <> ''", referral.Referrer).Pluck("ip", &referrerIPs)
+
+		earlier := []Referral{}
+		tx.Where("referrer = ?", referral.Referrer).Find(&earlier)
+
+		referral = referral.screen(referrerIPs, earlier)
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&referral)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrUserExists
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditReferralCreated, referral.Referee).withDetails(referral.String()))
+	})
+	if err != nil {
+		return Referral{}, err
+	}
+
+	return referral, nil
+}
+
+func (g *GORMDriver) GetReferrals(ctx context.Context, referrer string) ([]Referral, error) {
+	referrals := []Referral{}
+	g.conn.WithContext(ctx).Where("referrer = ?", referrer).Order("created_at DESC").Find(&referrals)
+
+	return referrals, nil
+}
+
+func (g *GORMDriver) RewardReferral(ctx context.Context, referee string, referrerPoints float32, refereePoints float32, at time.Time) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		referral := Referral{}
+
+		// Referral row is locked first so concurrent orders reward once
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("referee = ? AND status = ?", referee, ReferralPending).Take(&referral)
+		if referral.ID == 0 {
+			return ErrReferralDoesNotExist
+		}
+
+		users := []User{}
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name IN ?", []string{referral.Referrer, referral.Referee}).
+			Order("name").Find(&users).Error
+		if err != nil {
+			return err
+		}
+
+		referrer, refereeUser, reason := referralParties(users, referral)
+		if reason != "" {
+			return tx.Model(&referral).Updates(map[string]interface{}{"status": ReferralRejected, "reason": reason}).Error
+		}
+
+		if referrerPoints > 0 {
+			err = g.creditBonus(ctx, tx, referrer, referralBonus(referrer.Name, referee, referrerPoints, at))
+			if err != nil {
+				return err
+			}
+		}
+
+		if refereePoints > 0 {
+			err = g.creditBonus(ctx, tx, refereeUser, referralBonus(referee, referral.Referrer, refereePoints, at))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&referral).Updates(map[string]interface{}{"status": ReferralRewarded, "rewarded_at": at}).Error
+	})
+}
+
+func (g *GORMDriver) SaveSigningKey(ctx context.Context, key SigningKey) error {
+	return g.conn.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&key).Error
+}
+
+func (g *GORMDriver) GetSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	keys := []SigningKey{}
+	g.conn.WithContext(ctx).Order("created_at DESC").Find(&keys)
+
+	return keys, nil
+}
+
+func (g *GORMDriver) DeleteSigningKeys(ctx context.Context, createdBefore time.Time) error {
+	return g.conn.WithContext(ctx).Where("created_at < ?", createdBefore).Delete(&SigningKey{}).Error
+}
+
+func (g *GORMDriver) SaveAPIKey(ctx context.Context, key APIKey) (int, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&key).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditAPIKeyCreated, key.Prefix).withDetails(key.Scopes))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return key.ID, nil
+}
+
+func (g *GORMDriver) GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	key := APIKey{}
+
+	g.conn.WithContext(ctx).Where("prefix = ? AND revoked_at IS NULL", prefix).Take(&key)
+	if key.ID == 0 {
+		return APIKey{}, ErrAPIKeyDoesNotExist
+	}
+
+	return key, nil
+}
+
+func (g *GORMDriver) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+	g.conn.WithContext(ctx).Order("created_at DESC").Find(&keys)
+
+	return keys, nil
+}
+
+func (g *GORMDriver) RevokeAPIKey(ctx context.Context, id int) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		key := APIKey{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND revoked_at IS NULL", id).Take(&key)
+		if key.ID == 0 {
+			return ErrAPIKeyDoesNotExist
+		}
+
+		err := tx.Model(&key).Update("revoked_at", gorm.Expr("now()")).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditAPIKeyRevoked, key.Prefix))
+	})
+}
+
+// createGORMOutboxMessage records a domain event in the same tx as the change
+func createGORMOutboxMessage(tx *gorm.DB, payload EventPayload) error {
+	msg, err := newOutboxMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&msg).Error
+}
+
+// ClaimOutboxMessages takes the oldest unpublished messages for lease,
+// see the sqlx driver for why only one relay holds a claim at a time
+func (g *GORMDriver) ClaimOutboxMessages(ctx context.Context, at time.Time, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	messages := []OutboxMessage{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", outboxClaimLockID).Error
+		if err != nil {
+			return err
+		}
+
+		var claimed int64
+
+		err = tx.Model(&OutboxMessage{}).Where("published_at IS NULL AND claimed_until > ?", at).Count(&claimed).Error
+		if err != nil || claimed > 0 {
+			return err
+		}
+
+		err = tx.Where("published_at IS NULL").Order("id").Limit(limit).Find(&messages).Error
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+
+		claimedUntil := at.Add(lease)
+
+		ids := make([]int64, 0, len(messages))
+		for i := range messages {
+			messages[i].ClaimedUntil = &claimedUntil
+			ids = append(ids, messages[i].ID)
+		}
+
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).Update("claimed_until", claimedUntil).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (g *GORMDriver) MarkOutboxPublished(ctx context.Context, id int64, at time.Time) error {
+	return g.conn.WithContext(ctx).Model(&OutboxMessage{}).Where("id = ?", id).Update("published_at", at).Error
+}
+
+func (g *GORMDriver) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&webhook).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditWebhookCreated, webhook.URL).withDetails(webhook.Events))
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, nil
+}
+
+func (g *GORMDriver) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	g.conn.WithContext(ctx).Order("id").Find(&webhooks)
+
+	return webhooks, nil
+}
+
+func (g *GORMDriver) DisableWebhook(ctx context.Context, id int) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		webhook := Webhook{}
+
+		tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND disabled_at IS NULL", id).Take(&webhook)
+		if webhook.ID == 0 {
+			return ErrWebhookDoesNotExist
+		}
+
+		err := tx.Model(&webhook).Update("disabled_at", gorm.Expr("now()")).Error
+		if err != nil {
+			return err
+		}
+
+		return appendGORMAuditEvent(tx, NewAuditEvent(ctx, AuditWebhookDisabled, webhook.URL))
+	})
+}
+
+// enqueueGORMWebhooks writes payload to the outbox of every subscribed webhook
+// in the same tx as the change it reports
+func enqueueGORMWebhooks(tx *gorm.DB, payload EventPayload) error {
+	webhooks := []Webhook{}
+	tx.Where("disabled_at IS NULL").Find(&webhooks)
+
+	deliveries, err := newDeliveries(webhooks, payload)
+	if err != nil || len(deliveries) == 0 {
+		return err
+	}
+
+	return tx.Create(&deliveries).Error
+}
+
+// ClaimWebhookDeliveries takes due deliveries of active webhooks and puts
+// them off for lease so other workers skip them while they are being sent
+func (g *GORMDriver) ClaimWebhookDeliveries(ctx context.Context, at time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	err := g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "webhook_deliveries"}, Options: "SKIP LOCKED"}).
+			Joins("JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id").
+			Where("webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ? AND webhooks.disabled_at IS NULL", WebhookPending, at).
+			Order("webhook_deliveries.next_attempt_at").Limit(limit).Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]int, 0, len(deliveries))
+		for i := range deliveries {
+			deliveries[i].NextAttemptAt = at.Add(lease)
+			ids = append(ids, deliveries[i].ID)
+		}
+
+		return tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).Update("next_attempt_at", at.Add(lease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (g *GORMDriver) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	return g.conn.WithContext(ctx).Model(&delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"response_code":   delivery.ResponseCode,
+		"last_error":      delivery.LastError,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"delivered_at":    delivery.DeliveredAt,
+	}).Error
+}
+
+func (g *GORMDriver) GetWebhookDeliveries(ctx context.Context, webhookID int, limit int, offset int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	err := g.conn.WithContext(ctx).Where("webhook_id = ?", webhookID).Order("id DESC").Limit(limit).Offset(offset).Find(&deliveries).Error
+
+	return deliveries, err
+}
+
+// appendGORMAuditEvent links event to the chain tail within tx,
+// see appendAuditEvent for the locking rationale
+func appendGORMAuditEvent(tx *gorm.DB, event AuditEvent) error {
+	err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLockID).Error
+	if err != nil {
+		return err
+	}
+
+	tail := AuditEvent{}
+	tx.Order("id DESC").Limit(1).Find(&tail)
+
+	event.PrevHash = tail.Hash
+	event.Hash = event.ComputeHash()
+
+	return tx.Create(&event).Error
+}
+
+func (g *GORMDriver) SaveAuditEvent(ctx context.Context, event AuditEvent) error {
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return appendGORMAuditEvent(tx, event)
+	})
+}
+
+func (g *GORMDriver) GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	query := g.conn.WithContext(ctx).Model(&AuditEvent{})
+
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("created_at < ?", filter.To)
+	}
+
+	events := []AuditEvent{}
+	err := query.Order("id DESC").Limit(filter.Limit).Offset(filter.Offset).Find(&events).Error
+
+	return events, err
+}
+
+func (g *GORMDriver) StreamStatement(ctx context.Context, userName string, from time.Time, to time.Time, fn func(StatementEntry) error) error {
+	entries := fmt.Sprintf(statementQuery, "@user")
+	args := map[string]interface{}{"user": userName, "from": from, "to": to}
+
+	// A snapshot keeps the opening balance consistent with the entries
+	return g.conn.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+
+		tx.Where("name = ?", userName).Take(&user)
+		if user.ID == 0 {
+			return ErrUserDoesNotExist
+		}
+
+		// Opening balance is counted back from the current one so points
+		// credited before entries were recorded still add up
+		var since float32
+
+		err := tx.Raw(`SELECT coalesce(sum(amount), 0) FROM (`+entries+`) entries WHERE at >= @from`, args).Scan(&since).Error
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Raw(`SELECT * FROM (`+entries+`) entries WHERE amount <> 0 AND at >= @from AND at < @to ORDER BY at`, args).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		balance := user.Current - since
+
+		for rows.Next() {
+			entry := StatementEntry{}
+
+			err = tx.ScanRows(rows, &entry)
+			if err != nil {
+				return err
+			}
+
+			balance += entry.Amount
+			entry.Balance = balance
+
+			err = fn(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+}
+
+func (g *GORMDriver) VerifyAuditLog(ctx context.Context) (int64, error) {
+	rows, err := g.conn.WithContext(ctx).Model(&AuditEvent{}).Order("id").Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	verifier := AuditChainVerifier{}
+
+	for rows.Next() {
+		event := AuditEvent{}
+
+		err = g.conn.ScanRows(rows, &event)
+		if err != nil {
+			return verifier.Checked, err
+		}
+
+		err = verifier.Next(event)
+		if err != nil {
+			return verifier.Checked, err
+		}
+	}
+
+	return verifier.Checked, rows.Err()
 }
 
 func (g *GORMDriver) Close() {
@@ -5,17 +5,56 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 )
 
 var (
 	ErrUserExists       = errors.New(`user exists`)
 	ErrUserDoesNotExist = errors.New(`user does not exist`)
+	ErrLastAdmin        = errors.New(`last admin can not be demoted`)
 
 	ErrOrderAlreadyRegisteredByUser        = errors.New(`order already registered by user`)
 	ErrOrderAlreadyRegisteredBySomeoneElse = errors.New(`order already registered by other user`)
 
+	ErrOrderDoesNotExist     = errors.New(`order does not exist`)
+	ErrOrderAlreadyProcessed = errors.New(`order already processed`)
+	ErrOrderNotProcessed     = errors.New(`order is not processed yet`)
+	ErrOrderNotChanged       = errors.New(`order is not changed`)
+	ErrOrderOtherProvider    = errors.New(`order is routed to other accrual provider`)
+
 	ErrNotEnoughPoints = errors.New(`user balance is too low`)
+
+	ErrHoldDoesNotExist = errors.New(`hold does not exist or is already resolved`)
+	ErrHoldExpired      = errors.New(`hold expired`)
+
+	ErrTransferLimitExceeded = errors.New(`daily transfer limit exceeded`)
+
+	ErrCampaignExists         = errors.New(`campaign code exists`)
+	ErrCampaignDoesNotExist   = errors.New(`campaign does not exist`)
+	ErrCampaignInactive       = errors.New(`campaign is not active`)
+	ErrCampaignBudgetExceeded = errors.New(`campaign budget exhausted`)
+	ErrCampaignLimitReached   = errors.New(`campaign already redeemed`)
+
+	ErrReferralCodeInvalid  = errors.New(`referral code is invalid`)
+	ErrReferralDoesNotExist = errors.New(`referral does not exist or is resolved`)
+
+	ErrWithdrawalDoesNotExist  = errors.New(`withdrawal does not exist`)
+	ErrRefundExceedsWithdrawal = errors.New(`refund exceeds what is left of withdrawal`)
+
+	ErrInvalidResetToken = errors.New(`password reset token is invalid or expired`)
+
+	ErrTOTPCodeReused      = errors.New(`totp code already used`)
+	ErrInvalidRecoveryCode = errors.New(`recovery code is invalid or used`)
+	ErrTOTPAlreadyEnabled  = errors.New(`totp already enabled`)
+
+	ErrAPIKeyDoesNotExist = errors.New(`api key does not exist`)
+
+	ErrWebhookDoesNotExist = errors.New(`webhook does not exist`)
+
+	ErrIdentityAlreadyLinked = errors.New(`identity already linked`)
 )
 
 type Status int
@@ -48,6 +87,11 @@ func (s Status) String() string {
 	return toString[s]
 }
 
+// Final statuses are not changed by the accrual system anymore
+func (s Status) Final() bool {
+	return s == StatusProcessed || s == StatusInvalid
+}
+
 func (s Status) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.String())
 }
@@ -69,13 +113,203 @@ func (s *Status) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type Role string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleSupport, RoleAdmin:
+		return true
+	}
+
+	return false
+}
+
+type HoldStatus string
+
+const (
+	HoldActive    HoldStatus = "held"
+	HoldConfirmed HoldStatus = "confirmed"
+	HoldCancelled HoldStatus = "cancelled"
+	HoldExpired   HoldStatus = "expired"
+)
+
+// Domain events relayed to other services through the outbox
+const (
+	EventUserRegistered  = "UserRegistered"
+	EventOrderUploaded   = "OrderUploaded"
+	EventOrderProcessed  = "OrderProcessed"
+	EventPointsWithdrawn = "PointsWithdrawn"
+)
+
+// Events partners can subscribe webhooks to
+const (
+	WebhookOrderUpdated       = AuditOrderUpdated
+	WebhookOrderRevised       = AuditOrderRevised
+	WebhookBalanceWithdrawn   = AuditBalanceWithdrawn
+	WebhookBalanceAdjusted    = AuditBalanceAdjusted
+	WebhookBalanceRefunded    = AuditBalanceRefunded
+	WebhookBalanceExpired     = AuditBalanceExpired
+	WebhookBalanceTransferOut = AuditBalanceTransferOut
+	WebhookBalanceTransferIn  = AuditBalanceTransferIn
+	WebhookBalanceBonus       = AuditBalanceBonus
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookPending   WebhookDeliveryStatus = "pending"
+	WebhookDelivered WebhookDeliveryStatus = "delivered"
+	WebhookFailed    WebhookDeliveryStatus = "failed"
+
+	// maxWebhookBackoff caps the exponential delay between attempts
+	maxWebhookBackoff = 6 * time.Hour
+)
+
+type RefundStatus string
+
+const (
+	RefundPartial RefundStatus = "partially_refunded"
+	RefundFull    RefundStatus = "refunded"
+)
+
+// ClawbackPolicy decides what happens when a revised accrual takes back
+// more points than the user has available
+type ClawbackPolicy string
+
+const (
+	// ClawbackNegative lets the balance go below zero
+	ClawbackNegative ClawbackPolicy = "negative"
+	// ClawbackDebt takes what is available and records the rest as debt
+	// repaid from future accruals
+	ClawbackDebt ClawbackPolicy = "debt"
+)
+
+func (p ClawbackPolicy) Valid() bool {
+	switch p {
+	case ClawbackNegative, ClawbackDebt:
+		return true
+	}
+
+	return false
+}
+
+type CampaignKind string
+
+const (
+	// CampaignPromo is redeemed by code
+	CampaignPromo CampaignKind = "promo"
+	// CampaignWelcome is granted on registration
+	CampaignWelcome CampaignKind = "welcome"
+	// CampaignReferral marks bonuses of the referral program,
+	// there are no campaigns of this kind
+	CampaignReferral CampaignKind = "referral"
+)
+
+func (k CampaignKind) Valid() bool {
+	switch k {
+	case CampaignPromo, CampaignWelcome:
+		return true
+	}
+
+	return false
+}
+
+// StatementEntryType tells what changed the balance; bonuses carry
+// the kind of their campaign
+type StatementEntryType string
+
+const (
+	StatementAccrual     StatementEntryType = "accrual"
+	StatementRevision    StatementEntryType = "revision"
+	StatementWithdrawal  StatementEntryType = "withdrawal"
+	StatementRefund      StatementEntryType = "refund"
+	StatementAdjustment  StatementEntryType = "adjustment"
+	StatementTransferOut StatementEntryType = "transfer_out"
+	StatementTransferIn  StatementEntryType = "transfer_in"
+	StatementExpiration  StatementEntryType = "expiration"
+	// StatementDebtRepayment is the part of an accrual that repaid debt
+	StatementDebtRepayment StatementEntryType = "debt_repayment"
+)
+
+type ReferralStatus string
+
+const (
+	ReferralPending  ReferralStatus = "pending"
+	ReferralRewarded ReferralStatus = "rewarded"
+	ReferralRejected ReferralStatus = "rejected"
+)
+
 type User struct {
-	ID        int
-	Name      string  `json:"login" gorm:"not null;unique"`
-	Password  string  `gorm:"-"`
-	Passhash  string  `gorm:"not null"`
-	Current   float32 `gorm:"type:float8;default:0"`
-	Withdrawn float32 `gorm:"type:float8;default:0"`
+	ID                 int
+	Name               string    `json:"login" gorm:"not null;unique"`
+	Email              string    `json:"email,omitempty" gorm:"not null;default:''"`
+	Password           string    `gorm:"-"`
+	Passhash           string    `gorm:"not null"`
+	Current            float32   `gorm:"type:float8;default:0"`
+	Withdrawn          float32   `gorm:"type:float8;default:0"`
+	Held               float32   `gorm:"type:float8;not null;default:0"`
+	Debt               float32   `gorm:"type:float8;not null;default:0"`
+	Tier               string    `json:"-" gorm:"not null;default:''"`
+	Multiplier         float32   `json:"-" gorm:"type:float8;not null;default:1"`
+	ReferralCode       *string   `json:"-" db:"referral_code" gorm:"unique"`
+	Role               Role      `json:"-" gorm:"not null;default:'user'"`
+	Blocked            bool      `json:"-" gorm:"not null;default:false"`
+	BlockReason        string    `json:"-" db:"block_reason" gorm:"not null;default:''"`
+	SessionsValidAfter time.Time `json:"-" db:"sessions_valid_after" gorm:"not null;default:'epoch'"`
+	TOTPSecret         string    `json:"-" db:"totp_secret" gorm:"column:totp_secret;not null;default:''"`
+	TOTPEnabled        bool      `json:"-" db:"totp_enabled" gorm:"column:totp_enabled;not null;default:false"`
+	TOTPLastStep       int64     `json:"-" db:"totp_last_step" gorm:"column:totp_last_step;not null;default:0"`
+}
+
+func (u User) Balance() Balance {
+	return Balance{
+		Current:   u.Current,
+		Withdrawn: u.Withdrawn,
+		Held:      u.Held,
+		Available: u.Current - u.Held,
+		Debt:      u.Debt,
+	}
+}
+
+// repayDebt splits credited points into what goes to current balance and
+// what repays debt
+func (u User) repayDebt(amount float32) (float32, float32) {
+	repaid := amount
+	if u.Debt < repaid {
+		repaid = u.Debt
+	}
+
+	return amount - repaid, repaid
+}
+
+// accrualChange splits a change of accrued points into changes of current
+// balance and debt. Credits repay debt first; debits beyond what is
+// available become debt under ClawbackDebt.
+func (u User) accrualChange(amount float32, policy ClawbackPolicy) (float32, float32) {
+	if amount >= 0 {
+		credited, repaid := u.repayDebt(amount)
+		return credited, -repaid
+	}
+
+	if policy != ClawbackDebt {
+		return amount, 0
+	}
+
+	taken := -amount
+	if available := u.Balance().Available; available < taken {
+		taken = available
+	}
+	if taken < 0 {
+		taken = 0
+	}
+
+	return -taken, -amount - taken
 }
 
 func (u *User) HashPassword() {
@@ -85,31 +319,749 @@ func (u *User) HashPassword() {
 }
 
 type (
+	// Balance.Current includes points reserved by holds, Available excludes them
 	Balance struct {
-		Current   float32
-		Withdrawn float32
+		Current   float32 `json:"current"`
+		Withdrawn float32 `json:"withdrawn"`
+		Held      float32 `json:"held"`
+		Available float32 `json:"available"`
+		Debt      float32 `json:"debt,omitempty"`
+		// NextExpiry is filled in by GetUserBalance
+		NextExpiry *PointsExpiry `json:"next_expiry,omitempty"`
+	}
+
+	PointsExpiry struct {
+		Amount float32   `json:"amount"`
+		At     time.Time `json:"at" db:"expires_at"`
+	}
+
+	// PointLot is a portion of credited points spent and expired oldest first.
+	// Lots without expiry date never expire.
+	PointLot struct {
+		ID        int
+		UserName  string     `db:"user_name" gorm:"not null;index"`
+		Source    string     `gorm:"not null"`
+		Amount    float32    `gorm:"type:float8;not null"`
+		Remaining float32    `gorm:"type:float8;not null"`
+		EarnedAt  time.Time  `db:"earned_at" gorm:"not null"`
+		ExpiresAt *time.Time `db:"expires_at" gorm:"index"`
 	}
 
 	Order struct {
-		ID           int       `json:"-"`
-		RegisteredBy string    `json:"-" db:"registered_by" gorm:"not null;unique"`
-		Number       string    `json:"number" gorm:"not null"`
-		Status       Status    `json:"status" gorm:"not null"`
-		Accrual      float32   `json:"accrual,omitempty" gorm:"type:float8;default:0"`
-		UploadedAt   time.Time `json:"uploaded_at" db:"uploaded_at"`
+		ID           int        `json:"-"`
+		RegisteredBy string     `json:"-" db:"registered_by" gorm:"not null;unique"`
+		Number       string     `json:"number" gorm:"not null"`
+		Status       Status     `json:"status" gorm:"not null"`
+		Accrual      float32    `json:"accrual,omitempty" gorm:"type:float8;default:0"`
+		UploadedAt   time.Time  `json:"uploaded_at" db:"uploaded_at"`
+		ProcessedAt  *time.Time `json:"-" db:"processed_at"`
+		// BaseAccrual is what the accrual system returned before Multiplier
+		BaseAccrual float32 `json:"-" db:"base_accrual" gorm:"type:float8;not null;default:0"`
+		Multiplier  float32 `json:"-" gorm:"type:float8;not null;default:1"`
+		// Provider is the accrual system the order was routed to
+		Provider string `json:"-" gorm:"not null;default:''"`
+		// Repaid is the part of Accrual that went to debt instead of balance
+		Repaid float32 `json:"-" gorm:"type:float8;not null;default:0"`
+	}
+
+	// OrderRevision records a compensating change after the accrual system
+	// revised an already processed order
+	OrderRevision struct {
+		ID            int       `json:"-"`
+		Order         string    `json:"order" db:"orderid" gorm:"column:orderid;not null;index"`
+		UserName      string    `json:"-" db:"user_name" gorm:"not null"`
+		StatusBefore  Status    `json:"status_before" db:"status_before" gorm:"not null"`
+		StatusAfter   Status    `json:"status_after" db:"status_after" gorm:"not null"`
+		AccrualBefore float32   `json:"accrual_before" db:"accrual_before" gorm:"type:float8;not null"`
+		AccrualAfter  float32   `json:"accrual_after" db:"accrual_after" gorm:"type:float8;not null"`
+		Credited      float32   `json:"credited" gorm:"type:float8;not null"`
+		Debt          float32   `json:"debt" gorm:"type:float8;not null"`
+		CreatedAt     time.Time `json:"created_at" db:"created_at" gorm:"not null"`
 	}
 
 	AccrualOrder struct {
 		Order   string  `json:"order"`
 		Status  Status  `json:"status"`
 		Accrual float32 `json:"accrual,omitempty"`
+		// Provider is set for pushed results, which are only accepted
+		// for orders routed to the provider that pushed them
+		Provider string `json:"-"`
+	}
+
+	// TierStanding is what user accrued within the tier window
+	TierStanding struct {
+		UserName string  `db:"user_name"`
+		Tier     string  `db:"tier"`
+		Accrued  float32 `db:"accrued"`
 	}
 
 	Withdrawal struct {
+		ID           int          `json:"-"`
+		RegisteredBy string       `json:"-" db:"registered_by" gorm:"not null;unique"`
+		Order        string       `json:"order" db:"orderid" gorm:"column:orderid;not null"`
+		Sum          float32      `json:"sum" gorm:"type:float8;default:0"`
+		Refunded     float32      `json:"refunded,omitempty" gorm:"type:float8;not null;default:0"`
+		RefundStatus RefundStatus `json:"refund_status,omitempty" db:"-" gorm:"-"`
+		ProcessedAt  time.Time    `json:"processed_at" db:"processed_at"`
+	}
+
+	Refund struct {
 		ID           int       `json:"-"`
-		RegisteredBy string    `json:"-" db:"registered_by" gorm:"not null;unique"`
+		WithdrawalID int       `json:"-" db:"withdrawal_id" gorm:"not null;index"`
+		UserName     string    `json:"-" db:"user_name" gorm:"not null"`
 		Order        string    `json:"order" db:"orderid" gorm:"column:orderid;not null"`
-		Sum          float32   `json:"sum" gorm:"type:float8;default:0"`
-		ProcessedAt  time.Time `json:"processed_at" db:"processed_at"`
+		Sum          float32   `json:"sum" gorm:"type:float8;not null"`
+		Reason       string    `json:"reason" gorm:"not null"`
+		Actor        string    `json:"actor" gorm:"not null"`
+		CreatedAt    time.Time `json:"created_at" db:"created_at" gorm:"not null"`
+	}
+
+	Hold struct {
+		ID         int        `json:"id"`
+		UserName   string     `json:"-" db:"user_name" gorm:"not null;index"`
+		Order      string     `json:"order" db:"orderid" gorm:"column:orderid;not null"`
+		Sum        float32    `json:"sum" gorm:"type:float8;not null"`
+		Status     HoldStatus `json:"status" gorm:"not null"`
+		CreatedAt  time.Time  `json:"created_at" db:"created_at" gorm:"not null"`
+		ExpiresAt  time.Time  `json:"expires_at" db:"expires_at" gorm:"not null;index"`
+		ResolvedAt *time.Time `json:"resolved_at,omitempty" db:"resolved_at"`
+	}
+
+	Transfer struct {
+		ID        int       `json:"id"`
+		From      string    `json:"from" db:"from_user" gorm:"column:from_user;not null;index"`
+		To        string    `json:"to" db:"to_user" gorm:"column:to_user;not null;index"`
+		Sum       float32   `json:"sum" gorm:"type:float8;not null"`
+		CreatedAt time.Time `json:"created_at" db:"created_at" gorm:"not null"`
+	}
+
+	// Campaign grants points outside of the accrual system.
+	// Zero Budget is unlimited.
+	Campaign struct {
+		ID           int          `json:"id"`
+		Kind         CampaignKind `json:"kind" gorm:"not null"`
+		Code         *string      `json:"code,omitempty" gorm:"unique"`
+		Name         string       `json:"name" gorm:"not null"`
+		Points       float32      `json:"points" gorm:"type:float8;not null"`
+		Budget       float32      `json:"budget" gorm:"type:float8;not null;default:0"`
+		Spent        float32      `json:"spent" gorm:"type:float8;not null;default:0"`
+		PerUserLimit int          `json:"per_user_limit" db:"per_user_limit" gorm:"not null;default:1"`
+		StartsAt     time.Time    `json:"starts_at" db:"starts_at" gorm:"not null"`
+		EndsAt       *time.Time   `json:"ends_at,omitempty" db:"ends_at"`
+		CreatedBy    string       `json:"created_by" db:"created_by" gorm:"not null"`
+		CreatedAt    time.Time    `json:"created_at" db:"created_at" gorm:"not null"`
+	}
+
+	// Bonus is points credited by a campaign or the referral program
+	Bonus struct {
+		ID         int          `json:"-"`
+		CampaignID *int         `json:"-" db:"campaign_id" gorm:"index"`
+		UserName   string       `json:"-" db:"user_name" gorm:"not null;index"`
+		Kind       CampaignKind `json:"kind" gorm:"not null"`
+		Campaign   string       `json:"campaign" gorm:"not null"`
+		Points     float32      `json:"points" gorm:"type:float8;not null"`
+		CreatedAt  time.Time    `json:"created_at" db:"created_at" gorm:"not null"`
+	}
+
+	// Referral links a new user to whoever invited them. Both get
+	// a bonus once the referee has an order processed.
+	Referral struct {
+		ID         int            `json:"-"`
+		Referrer   string         `json:"-" gorm:"not null;index"`
+		Referee    string         `json:"referee" gorm:"not null;unique"`
+		Status     ReferralStatus `json:"status" gorm:"not null"`
+		Reason     string         `json:"reason,omitempty" gorm:"not null;default:''"`
+		IP         string         `json:"-" gorm:"not null;default:''"`
+		Device     string         `json:"-" gorm:"not null;default:''"`
+		CreatedAt  time.Time      `json:"created_at" db:"created_at" gorm:"not null"`
+		RewardedAt *time.Time     `json:"rewarded_at,omitempty" db:"rewarded_at"`
+	}
+
+	// StatementEntry is a single credit or debit of the balance
+	StatementEntry struct {
+		Type      StatementEntryType `json:"type"`
+		Reference string             `json:"reference,omitempty"`
+		Amount    float32            `json:"amount"`
+		Balance   float32            `json:"balance" db:"-" gorm:"-"`
+		At        time.Time          `json:"at"`
+	}
+
+	BalanceAdjustment struct {
+		ID        int       `json:"-"`
+		UserName  string    `json:"-" db:"user_name" gorm:"not null"`
+		Amount    float32   `json:"amount" gorm:"type:float8;not null"`
+		Reason    string    `json:"reason" gorm:"not null"`
+		Actor     string    `json:"actor" gorm:"not null"`
+		CreatedAt time.Time `json:"created_at" db:"created_at" gorm:"not null"`
+	}
+
+	PasswordReset struct {
+		ID        int
+		UserName  string     `db:"user_name" gorm:"not null"`
+		TokenHash string     `db:"token_hash" gorm:"not null;unique"`
+		ExpiresAt time.Time  `db:"expires_at" gorm:"not null"`
+		UsedAt    *time.Time `db:"used_at"`
+	}
+
+	RecoveryCode struct {
+		ID       int
+		UserName string     `db:"user_name" gorm:"not null"`
+		CodeHash string     `db:"code_hash" gorm:"not null"`
+		UsedAt   *time.Time `db:"used_at"`
+	}
+
+	LoginAttempt struct {
+		Key         string    `gorm:"primaryKey"`
+		Failures    int       `gorm:"not null;default:0"`
+		LastFailure time.Time `db:"last_failure" gorm:"not null"`
+	}
+
+	// LoginPolicy defines how failed attempts of a key slow down further ones.
+	// After FreeAttempts failures every next attempt waits twice as long
+	// starting from BaseDelay; after MaxAttempts the key is locked for Lockout.
+	LoginPolicy struct {
+		FreeAttempts int
+		MaxAttempts  int
+		BaseDelay    time.Duration
+		Lockout      time.Duration
+	}
+
+	AuditEvent struct {
+		ID           int64     `json:"id"`
+		Actor        string    `json:"actor" gorm:"not null"`
+		Action       string    `json:"action" gorm:"not null;index"`
+		Target       string    `json:"target" gorm:"not null;index"`
+		AmountBefore *float32  `json:"amount_before,omitempty" db:"amount_before" gorm:"type:float8"`
+		AmountAfter  *float32  `json:"amount_after,omitempty" db:"amount_after" gorm:"type:float8"`
+		Details      string    `json:"details,omitempty" gorm:"not null;default:''"`
+		RequestID    string    `json:"request_id,omitempty" db:"request_id" gorm:"not null;default:''"`
+		IP           string    `json:"ip,omitempty" gorm:"not null;default:''"`
+		CreatedAt    time.Time `json:"created_at" db:"created_at" gorm:"not null"`
+		PrevHash     string    `json:"prev_hash" db:"prev_hash" gorm:"not null"`
+		Hash         string    `json:"hash" gorm:"not null;unique"`
+	}
+
+	AuditFilter struct {
+		Actor  string
+		Action string
+		Target string
+		From   time.Time
+		To     time.Time
+		Limit  int
+		Offset int
+	}
+
+	UserIdentity struct {
+		ID        int
+		UserName  string    `db:"user_name" gorm:"not null"`
+		Issuer    string    `gorm:"not null;uniqueIndex:idx_identity"`
+		Subject   string    `gorm:"not null;uniqueIndex:idx_identity"`
+		CreatedAt time.Time `db:"created_at" gorm:"not null"`
+	}
+
+	APIKey struct {
+		ID        int        `json:"id"`
+		Prefix    string     `json:"prefix" gorm:"not null;unique"`
+		Hash      string     `json:"-" gorm:"not null"`
+		Name      string     `json:"name" gorm:"not null"`
+		Scopes    string     `json:"scopes" gorm:"not null"`
+		CreatedBy string     `json:"created_by" db:"created_by" gorm:"not null"`
+		CreatedAt time.Time  `json:"created_at" db:"created_at" gorm:"not null"`
+		RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+	}
+
+	// Webhook is a partner endpoint subscribed to some events;
+	// Events is a comma separated list
+	Webhook struct {
+		ID         int        `json:"id"`
+		URL        string     `json:"url" gorm:"not null"`
+		Secret     string     `json:"-" gorm:"not null"`
+		Events     string     `json:"events" gorm:"not null"`
+		CreatedBy  string     `json:"created_by" db:"created_by" gorm:"not null"`
+		CreatedAt  time.Time  `json:"created_at" db:"created_at" gorm:"not null"`
+		DisabledAt *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	}
+
+	// WebhookDelivery is an outbox entry written along with the change
+	// it reports and later sent by the delivery worker
+	WebhookDelivery struct {
+		ID            int                   `json:"id"`
+		WebhookID     int                   `json:"webhook_id" db:"webhook_id" gorm:"not null;index"`
+		Event         string                `json:"event" gorm:"not null"`
+		Payload       string                `json:"payload" gorm:"not null"`
+		Status        WebhookDeliveryStatus `json:"status" gorm:"not null"`
+		Attempts      int                   `json:"attempts" gorm:"not null;default:0"`
+		ResponseCode  int                   `json:"response_code,omitempty" db:"response_code" gorm:"not null;default:0"`
+		LastError     string                `json:"last_error,omitempty" db:"last_error" gorm:"not null;default:''"`
+		NextAttemptAt time.Time             `json:"next_attempt_at" db:"next_attempt_at" gorm:"not null;index"`
+		CreatedAt     time.Time             `json:"created_at" db:"created_at" gorm:"not null"`
+		DeliveredAt   *time.Time            `json:"delivered_at,omitempty" db:"delivered_at"`
+	}
+
+	// OutboxMessage is a domain event written along with the change
+	// it reports and later relayed to a publisher
+	OutboxMessage struct {
+		ID          int64      `json:"id"`
+		Type        string     `json:"type" gorm:"not null"`
+		Key         string     `json:"key" gorm:"not null"`
+		Payload     string     `json:"payload" gorm:"not null"`
+		CreatedAt   time.Time  `json:"created_at" db:"created_at" gorm:"not null"`
+		PublishedAt *time.Time `json:"published_at,omitempty" db:"published_at" gorm:"index"`
+		// ClaimedUntil keeps other relays off while the message is published
+		ClaimedUntil *time.Time `json:"-" db:"claimed_until"`
+	}
+
+	// EventPayload is the body of webhooks and outbox messages
+	EventPayload struct {
+		Event      string             `json:"event"`
+		User       string             `json:"user"`
+		Order      *Order             `json:"order,omitempty"`
+		Withdrawal *Withdrawal        `json:"withdrawal,omitempty"`
+		Refund     *Refund            `json:"refund,omitempty"`
+		Transfer   *Transfer          `json:"transfer,omitempty"`
+		Bonus      *Bonus             `json:"bonus,omitempty"`
+		Revision   *OrderRevision     `json:"revision,omitempty"`
+		Adjustment *BalanceAdjustment `json:"adjustment,omitempty"`
+		// Amount is how much current balance changed by, for balance events
+		Amount    float32   `json:"amount,omitempty"`
+		Balance   Balance   `json:"balance"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	SigningKey struct {
+		ID string `gorm:"primaryKey"`
+		// Seed is encrypted, storage never sees the private key
+		Seed      []byte    `gorm:"not null"`
+		CreatedAt time.Time `db:"created_at" gorm:"not null"`
 	}
 )
+
+// HasScope reports whether key grants scope; scopes are stored comma-separated
+func (k APIKey) HasScope(scope string) bool {
+	for _, granted := range strings.Split(k.Scopes, ",") {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// takeFromLots spends amount from lots ordered oldest first and returns
+// the lots it changed. Whatever the lots do not cover comes from points
+// credited before lots were tracked.
+func takeFromLots(lots []PointLot, amount float32) []PointLot {
+	changed := []PointLot{}
+
+	for _, lot := range lots {
+		if amount <= 0 {
+			break
+		}
+
+		taken := lot.Remaining
+		if amount < taken {
+			taken = amount
+		}
+
+		lot.Remaining -= taken
+		amount -= taken
+
+		changed = append(changed, lot)
+	}
+
+	return changed
+}
+
+// moveLots spends amount from lots ordered oldest first like takeFromLots and
+// also returns lots for the recipient carrying over earning and expiry dates,
+// so passing points around does not extend their life
+func moveLots(lots []PointLot, amount float32, to string, source string) ([]PointLot, []PointLot) {
+	changed := takeFromLots(lots, amount)
+	moved := make([]PointLot, 0, len(changed)+1)
+
+	for i, lot := range changed {
+		taken := lots[i].Remaining - lot.Remaining
+		if taken <= 0 {
+			continue
+		}
+
+		amount -= taken
+
+		moved = append(moved, PointLot{
+			UserName:  to,
+			Source:    source,
+			Amount:    taken,
+			Remaining: taken,
+			EarnedAt:  lot.EarnedAt,
+			ExpiresAt: lot.ExpiresAt,
+		})
+	}
+
+	// Points credited before lots were tracked never expire
+	if amount > 0 {
+		moved = append(moved, PointLot{
+			UserName:  to,
+			Source:    source,
+			Amount:    amount,
+			Remaining: amount,
+			EarnedAt:  time.Now(),
+		})
+	}
+
+	return changed, moved
+}
+
+// check tells whether user who redeemed the campaign redeemed times
+// can get its points at the moment
+func (c Campaign) check(at time.Time, redeemed int) error {
+	if at.Before(c.StartsAt) || (c.EndsAt != nil && !at.Before(*c.EndsAt)) {
+		return ErrCampaignInactive
+	}
+
+	if c.Budget > 0 && c.Spent+c.Points > c.Budget {
+		return ErrCampaignBudgetExceeded
+	}
+
+	if redeemed >= c.PerUserLimit {
+		return ErrCampaignLimitReached
+	}
+
+	return nil
+}
+
+func (c Campaign) bonus(userName string, at time.Time) Bonus {
+	bonus := Bonus{
+		CampaignID: &c.ID,
+		UserName:   userName,
+		Kind:       c.Kind,
+		Campaign:   c.Name,
+		Points:     c.Points,
+		CreatedAt:  at,
+	}
+
+	if c.Code != nil {
+		bonus.Campaign = *c.Code
+	}
+
+	return bonus
+}
+
+// screen rejects referrals which look like the referrer signing up
+// themselves: from an address the referrer used, or from the address or
+// device of an earlier referee of theirs
+func (r Referral) screen(referrerIPs []string, earlier []Referral) Referral {
+	r.Status = ReferralPending
+
+	for _, ip := range referrerIPs {
+		if r.IP != "" && r.IP == ip {
+			r.Status, r.Reason = ReferralRejected, "same ip as referrer"
+			return r
+		}
+	}
+
+	for _, other := range earlier {
+		if r.IP != "" && r.IP == other.IP {
+			r.Status, r.Reason = ReferralRejected, "same ip as another referee"
+			return r
+		}
+
+		if r.Device != "" && r.Device == other.Device {
+			r.Status, r.Reason = ReferralRejected, "same device as another referee"
+			return r
+		}
+	}
+
+	return r
+}
+
+// referralBonus is a bonus of the referral program
+func referralBonus(userName string, referee string, points float32, at time.Time) Bonus {
+	return Bonus{
+		UserName:  userName,
+		Kind:      CampaignReferral,
+		Campaign:  referee,
+		Points:    points,
+		CreatedAt: at,
+	}
+}
+
+// transferParties picks sender and recipient out of locked users;
+// blocked users can not receive points
+func transferParties(users []User, transfer Transfer) (User, User, error) {
+	var sender, recipient User
+
+	for _, user := range users {
+		switch user.Name {
+		case transfer.From:
+			sender = user
+		case transfer.To:
+			recipient = user
+		}
+	}
+
+	if sender.Name == "" || recipient.Name == "" || recipient.Blocked {
+		return User{}, User{}, ErrUserDoesNotExist
+	}
+
+	return sender, recipient, nil
+}
+
+// referralParties picks referrer and referee of referral out of locked
+// users; a blocked party voids the referral with the returned reason
+func referralParties(users []User, referral Referral) (User, User, string) {
+	var referrer, referee User
+
+	for _, user := range users {
+		switch user.Name {
+		case referral.Referrer:
+			referrer = user
+		case referral.Referee:
+			referee = user
+		}
+	}
+
+	if referrer.Name == "" || referrer.Blocked {
+		return User{}, User{}, "referrer is blocked"
+	}
+
+	if referee.Name == "" || referee.Blocked {
+		return User{}, User{}, "referee is blocked"
+	}
+
+	return referrer, referee, ""
+}
+
+func (r Referral) String() string {
+	if r.Reason == "" {
+		return fmt.Sprintf("%s by %s", r.Status, r.Referrer)
+	}
+
+	return fmt.Sprintf("%s by %s: %s", r.Status, r.Referrer, r.Reason)
+}
+
+func (w Webhook) Subscribed(event string) bool {
+	for _, subscribed := range strings.Split(w.Events, ",") {
+		if subscribed == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newBalancePayload describes a change of current balance by amount; user
+// holds the balance before the change
+func newBalancePayload(event string, user User, amount float32, at time.Time) EventPayload {
+	updated := user
+	updated.Current += amount
+
+	return EventPayload{Event: event, User: user.Name, Amount: amount, Balance: updated.Balance(), CreatedAt: at}
+}
+
+// transferPayloads reports a transfer to both parties
+func transferPayloads(sender, recipient User, transfer Transfer) []EventPayload {
+	out := newBalancePayload(WebhookBalanceTransferOut, sender, -transfer.Sum, transfer.CreatedAt)
+	out.Transfer = &transfer
+
+	in := newBalancePayload(WebhookBalanceTransferIn, recipient, transfer.Sum, transfer.CreatedAt)
+	in.Transfer = &transfer
+
+	return []EventPayload{out, in}
+}
+
+// newDeliveries makes an outbox entry of payload for every webhook subscribed to it
+func newDeliveries(webhooks []Webhook, payload EventPayload) ([]WebhookDelivery, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+
+	deliveries := []WebhookDelivery{}
+	for _, webhook := range webhooks {
+		if webhook.DisabledAt != nil || !webhook.Subscribed(payload.Event) {
+			continue
+		}
+
+		deliveries = append(deliveries, WebhookDelivery{
+			WebhookID:     webhook.ID,
+			Event:         payload.Event,
+			Payload:       string(body),
+			Status:        WebhookPending,
+			NextAttemptAt: payload.CreatedAt,
+			CreatedAt:     payload.CreatedAt,
+		})
+	}
+
+	return deliveries, nil
+}
+
+// Arbitrary constant identifying the advisory lock serializing role changes
+const roleChangeLockID = 0x726f6c65
+
+// Arbitrary constant identifying advisory locks serializing attempts of a login key
+const loginAttemptLockID = 0x6c6f67
+
+// RetryAfter calculates how long to wait before the next attempt and
+// whether the key is locked out
+func (a LoginAttempt) RetryAfter(policy LoginPolicy, now time.Time) (time.Duration, bool) {
+	if now.Sub(a.LastFailure) >= policy.Lockout {
+		return 0, false
+	}
+
+	if a.Failures >= policy.MaxAttempts {
+		return a.LastFailure.Add(policy.Lockout).Sub(now), true
+	}
+
+	if a.Failures < policy.FreeAttempts {
+		return 0, false
+	}
+
+	delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, float64(a.Failures-policy.FreeAttempts)))
+	if delay > policy.Lockout {
+		delay = policy.Lockout
+	}
+
+	retryAfter := a.LastFailure.Add(delay).Sub(now)
+	if retryAfter < 0 {
+		return 0, false
+	}
+
+	return retryAfter, false
+}
+
+// Arbitrary constant identifying the advisory lock serializing outbox claims
+const outboxClaimLockID = 0x6f7574626f78
+
+// newOutboxMessage keys the message by user so events of a user stay in order
+func newOutboxMessage(payload EventPayload) (OutboxMessage, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxMessage{}, fmt.Errorf("failed to marshal outbox payload: %w", err)
+	}
+
+	return OutboxMessage{
+		Type:      payload.Event,
+		Key:       payload.User,
+		Payload:   string(body),
+		CreatedAt: payload.CreatedAt,
+	}, nil
+}
+
+func (d WebhookDelivery) Delivered(at time.Time, code int) WebhookDelivery {
+	d.Attempts++
+	d.Status = WebhookDelivered
+	d.ResponseCode = code
+	d.LastError = ""
+	d.DeliveredAt = &at
+
+	return d
+}
+
+// Failed schedules the next attempt doubling backoff each time
+// or gives up after maxAttempts
+func (d WebhookDelivery) Failed(at time.Time, code int, reason string, maxAttempts int, backoff time.Duration) WebhookDelivery {
+	d.Attempts++
+	d.ResponseCode = code
+	d.LastError = reason
+
+	if d.Attempts >= maxAttempts {
+		d.Status = WebhookFailed
+		return d
+	}
+
+	delay := backoff
+	for i := 1; i < d.Attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+
+	d.NextAttemptAt = at.Add(delay)
+
+	return d
+}
+
+// expirable is how much of expired lots can be taken from user;
+// points reserved by holds are spared until the hold is resolved
+func expirable(user User, lots []PointLot) float32 {
+	var amount float32
+	for _, lot := range lots {
+		amount += lot.Remaining
+	}
+
+	if available := user.Balance().Available; available < amount {
+		amount = available
+	}
+
+	if amount < 0 {
+		return 0
+	}
+
+	return amount
+}
+
+// changedBy tells whether an accrual result differs from what the order has
+func (o Order) changedBy(processed AccrualOrder) bool {
+	return o.Status != processed.Status || o.BaseAccrual != processed.credited()
+}
+
+// credited is the base accrual the result credits; only PROCESSED results
+// credit, an accrual announced earlier may still change and would be
+// credited twice
+func (o AccrualOrder) credited() float32 {
+	if o.Status != StatusProcessed {
+		return 0
+	}
+
+	return o.Accrual
+}
+
+// points is the base accrual of the order; INVALID orders accrue nothing
+func (o AccrualOrder) points() float32 {
+	if o.Status == StatusInvalid {
+		return 0
+	}
+
+	return o.Accrual
+}
+
+// newOrderRevision compares a processed order with what the accrual system
+// reports now. The multiplier the order was credited with is kept.
+func newOrderRevision(order Order, revised AccrualOrder) OrderRevision {
+	return OrderRevision{
+		Order:         order.Number,
+		UserName:      order.RegisteredBy,
+		StatusBefore:  order.Status,
+		StatusAfter:   revised.Status,
+		AccrualBefore: order.Accrual,
+		AccrualAfter:  revised.points() * order.Multiplier,
+		CreatedAt:     time.Now(),
+	}
+}
+
+func (r OrderRevision) String() string {
+	s := fmt.Sprintf("%s %v -> %s %v", r.StatusBefore, r.AccrualBefore, r.StatusAfter, r.AccrualAfter)
+	if r.Debt != 0 {
+		s += fmt.Sprintf("; debt %+v", r.Debt)
+	}
+
+	return s
+}
+
+// Refundable is what is left of withdrawal to refund
+func (w Withdrawal) Refundable() float32 {
+	return w.Sum - w.Refunded
+}
+
+func (w *Withdrawal) setRefundStatus() {
+	switch {
+	case w.Refunded <= 0:
+		w.RefundStatus = ""
+	case w.Refundable() <= 0:
+		w.RefundStatus = RefundFull
+	default:
+		w.RefundStatus = RefundPartial
+	}
+}
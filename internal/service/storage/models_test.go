@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserBalance(t *testing.T) {
+	user := User{Current: 500, Withdrawn: 100, Held: 120.5}
+
+	require.Equal(t, Balance{Current: 500, Withdrawn: 100, Held: 120.5, Available: 379.5}, user.Balance())
+}
+
+func TestWithdrawalRefundStatus(t *testing.T) {
+	tests := map[float32]RefundStatus{
+		0:   "",
+		40:  RefundPartial,
+		100: RefundFull,
+	}
+
+	for refunded, expected := range tests {
+		withdrawal := Withdrawal{Sum: 100, Refunded: refunded}
+		withdrawal.setRefundStatus()
+
+		require.Equal(t, expected, withdrawal.RefundStatus, "refunded %v", refunded)
+		require.Equal(t, 100-refunded, withdrawal.Refundable())
+	}
+}
+
+func TestAccrualChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     User
+		amount   float32
+		policy   ClawbackPolicy
+		credited float32
+		debt     float32
+	}{
+		{"credit", User{Current: 100}, 50, ClawbackDebt, 50, 0},
+		{"credit repays debt", User{Current: 0, Debt: 30}, 50, ClawbackDebt, 20, -30},
+		{"credit below debt", User{Current: 0, Debt: 80}, 50, ClawbackNegative, 0, -50},
+		{"debit goes negative", User{Current: 20}, -50, ClawbackNegative, -50, 0},
+		{"debit within available", User{Current: 100}, -50, ClawbackDebt, -50, 0},
+		{"debit beyond available", User{Current: 100, Held: 70}, -50, ClawbackDebt, -30, 20},
+		{"debit of negative balance", User{Current: -10}, -50, ClawbackDebt, 0, 50},
+	}
+
+	for _, tt := range tests {
+		credited, debt := tt.user.accrualChange(tt.amount, tt.policy)
+
+		require.Equal(t, tt.credited, credited, tt.name)
+		require.Equal(t, tt.debt, debt, tt.name)
+	}
+}
+
+func TestNewOrderRevision(t *testing.T) {
+	order := Order{Number: "12345678903", RegisteredBy: "alice", Status: StatusProcessed, Accrual: 500, BaseAccrual: 500, Multiplier: 1}
+
+	revision := newOrderRevision(order, AccrualOrder{Order: order.Number, Status: StatusProcessed, Accrual: 300})
+	require.Equal(t, float32(300), revision.AccrualAfter)
+	require.Equal(t, "PROCESSED 500 -> PROCESSED 300", revision.String())
+
+	revision = newOrderRevision(order, AccrualOrder{Order: order.Number, Status: StatusInvalid, Accrual: 500})
+	require.Equal(t, float32(0), revision.AccrualAfter)
+	require.Equal(t, StatusInvalid, revision.StatusAfter)
+
+	order = Order{Number: "12345678903", RegisteredBy: "alice", Status: StatusProcessed, Accrual: 625, BaseAccrual: 500, Multiplier: 1.25}
+
+	revision = newOrderRevision(order, AccrualOrder{Order: order.Number, Status: StatusProcessed, Accrual: 400})
+	require.Equal(t, float32(500), revision.AccrualAfter)
+}
+
+func TestTakeFromLots(t *testing.T) {
+	lots := []PointLot{{ID: 1, Remaining: 30}, {ID: 2, Remaining: 50}, {ID: 3, Remaining: 20}}
+
+	require.Equal(t, []PointLot{{ID: 1, Remaining: 0}, {ID: 2, Remaining: 40}}, takeFromLots(lots, 40))
+	require.Equal(t, []PointLot{{ID: 1, Remaining: 0}, {ID: 2, Remaining: 0}, {ID: 3, Remaining: 0}}, takeFromLots(lots, 150))
+	require.Empty(t, takeFromLots(lots, 0))
+}
+
+func TestExpirable(t *testing.T) {
+	lots := []PointLot{{Remaining: 30}, {Remaining: 50}}
+
+	require.Equal(t, float32(80), expirable(User{Current: 200}, lots))
+	require.Equal(t, float32(60), expirable(User{Current: 100, Held: 40}, lots))
+	require.Equal(t, float32(0), expirable(User{Current: -10}, lots))
+}
+
+func TestNewLot(t *testing.T) {
+	earnedAt := time.Date(2023, time.January, 31, 15, 4, 5, 0, time.UTC)
+
+	lot := Options{}.newLot("alice", "12345678903", 100, earnedAt)
+	require.Nil(t, lot.ExpiresAt)
+	require.Equal(t, float32(100), lot.Remaining)
+
+	lot = Options{PointsLifetime: 6}.newLot("alice", "12345678903", 100, earnedAt)
+	require.Equal(t, time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC), *lot.ExpiresAt)
+}
+
+func TestMoveLots(t *testing.T) {
+	expiresAt := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	earnedAt := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	lots := []PointLot{{ID: 1, Remaining: 30, EarnedAt: earnedAt, ExpiresAt: &expiresAt}}
+
+	changed, moved := moveLots(lots, 20, "bob", "transfer:alice")
+	require.Equal(t, []PointLot{{ID: 1, Remaining: 10, EarnedAt: earnedAt, ExpiresAt: &expiresAt}}, changed)
+	require.Equal(t, []PointLot{{UserName: "bob", Source: "transfer:alice", Amount: 20, Remaining: 20, EarnedAt: earnedAt, ExpiresAt: &expiresAt}}, moved)
+
+	changed, moved = moveLots(lots, 50, "bob", "transfer:alice")
+	require.Len(t, changed, 1)
+	require.Len(t, moved, 2)
+	require.Equal(t, float32(30), moved[0].Amount)
+	require.Equal(t, float32(20), moved[1].Amount)
+	require.Nil(t, moved[1].ExpiresAt)
+}
+
+func TestTransferParties(t *testing.T) {
+	transfer := Transfer{From: "alice", To: "bob", Sum: 10}
+
+	sender, recipient, err := transferParties([]User{{Name: "alice"}, {Name: "bob"}}, transfer)
+	require.NoError(t, err)
+	require.Equal(t, "alice", sender.Name)
+	require.Equal(t, "bob", recipient.Name)
+
+	_, _, err = transferParties([]User{{Name: "alice"}}, transfer)
+	require.ErrorIs(t, err, ErrUserDoesNotExist)
+
+	_, _, err = transferParties([]User{{Name: "alice"}, {Name: "bob", Blocked: true}}, transfer)
+	require.ErrorIs(t, err, ErrUserDoesNotExist)
+}
+
+func TestCampaignCheck(t *testing.T) {
+	startsAt := time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC)
+	endsAt := startsAt.AddDate(0, 1, 0)
+	campaign := Campaign{Points: 100, Budget: 1000, Spent: 800, PerUserLimit: 1, StartsAt: startsAt, EndsAt: &endsAt}
+
+	require.NoError(t, campaign.check(startsAt, 0))
+	require.ErrorIs(t, campaign.check(startsAt.Add(-time.Second), 0), ErrCampaignInactive)
+	require.ErrorIs(t, campaign.check(endsAt, 0), ErrCampaignInactive)
+	require.ErrorIs(t, campaign.check(startsAt, 1), ErrCampaignLimitReached)
+
+	campaign.Spent = 950
+	require.ErrorIs(t, campaign.check(startsAt, 0), ErrCampaignBudgetExceeded)
+
+	campaign.Budget = 0
+	require.NoError(t, campaign.check(startsAt, 0))
+}
+
+func TestReferralScreen(t *testing.T) {
+	referral := Referral{Referrer: "alice", Referee: "bob", IP: "10.0.0.2", Device: "phone"}
+
+	require.Equal(t, ReferralPending, referral.screen([]string{"10.0.0.1"}, nil).Status)
+
+	screened := referral.screen([]string{"10.0.0.1", "10.0.0.2"}, nil)
+	require.Equal(t, ReferralRejected, screened.Status)
+	require.Equal(t, "same ip as referrer", screened.Reason)
+
+	screened = referral.screen(nil, []Referral{{Referee: "carol", IP: "10.0.0.3", Device: "phone"}})
+	require.Equal(t, ReferralRejected, screened.Status)
+	require.Equal(t, "same device as another referee", screened.Reason)
+
+	// Unknown address or device matches nothing
+	referral.IP, referral.Device = "", ""
+	require.Equal(t, ReferralPending, referral.screen([]string{""}, []Referral{{Referee: "carol"}}).Status)
+}
+
+func TestReferralParties(t *testing.T) {
+	referral := Referral{Referrer: "alice", Referee: "bob"}
+
+	referrer, referee, reason := referralParties([]User{{Name: "alice"}, {Name: "bob"}}, referral)
+	require.Empty(t, reason)
+	require.Equal(t, "alice", referrer.Name)
+	require.Equal(t, "bob", referee.Name)
+
+	_, _, reason = referralParties([]User{{Name: "alice", Blocked: true}, {Name: "bob"}}, referral)
+	require.Equal(t, "referrer is blocked", reason)
+
+	_, _, reason = referralParties([]User{{Name: "alice"}}, referral)
+	require.Equal(t, "referee is blocked", reason)
+}
+
+func TestNewDeliveries(t *testing.T) {
+	disabledAt := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	webhooks := []Webhook{
+		{ID: 1, Events: WebhookOrderUpdated + "," + WebhookBalanceWithdrawn},
+		{ID: 2, Events: WebhookBalanceWithdrawn},
+		{ID: 3, Events: WebhookOrderUpdated, DisabledAt: &disabledAt},
+	}
+	payload := EventPayload{Event: WebhookOrderUpdated, User: "alice", CreatedAt: disabledAt}
+
+	deliveries, err := newDeliveries(webhooks, payload)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, 1, deliveries[0].WebhookID)
+	require.Equal(t, WebhookPending, deliveries[0].Status)
+	require.Equal(t, disabledAt, deliveries[0].NextAttemptAt)
+	require.JSONEq(t, `{"event": "order.updated", "user": "alice", "balance": {"current": 0, "withdrawn": 0, "held": 0, "available": 0}, "created_at": "2024-01-01T00:00:00Z"}`, deliveries[0].Payload)
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	delivery := WebhookDelivery{Status: WebhookPending}
+
+	delivery = delivery.Failed(at, 500, "status 500", 4, time.Minute)
+	require.Equal(t, WebhookPending, delivery.Status)
+	require.Equal(t, at.Add(time.Minute), delivery.NextAttemptAt)
+
+	delivery = delivery.Failed(at, 0, "timeout", 4, time.Minute)
+	require.Equal(t, at.Add(2*time.Minute), delivery.NextAttemptAt)
+	require.Equal(t, "timeout", delivery.LastError)
+
+	delivered := delivery.Delivered(at, 200)
+	require.Equal(t, WebhookDelivered, delivered.Status)
+	require.Equal(t, 3, delivered.Attempts)
+	require.Empty(t, delivered.LastError)
+
+	delivery = delivery.Failed(at, 500, "status 500", 4, time.Minute)
+	delivery = delivery.Failed(at, 500, "status 500", 4, time.Minute)
+	require.Equal(t, WebhookFailed, delivery.Status)
+
+	delivery = WebhookDelivery{Attempts: 20}.Failed(at, 500, "status 500", 100, time.Minute)
+	require.Equal(t, at.Add(maxWebhookBackoff), delivery.NextAttemptAt)
+}
+
+func TestNewBalancePayload(t *testing.T) {
+	at := time.Now()
+	user := User{Name: "alice", Current: 500, Withdrawn: 100, Held: 50}
+
+	payload := newBalancePayload(WebhookBalanceExpired, user, -120, at)
+	require.Equal(t, WebhookBalanceExpired, payload.Event)
+	require.Equal(t, "alice", payload.User)
+	require.Equal(t, float32(-120), payload.Amount)
+	require.Equal(t, Balance{Current: 380, Withdrawn: 100, Held: 50, Available: 330}, payload.Balance)
+	require.Equal(t, at, payload.CreatedAt)
+}
+
+func TestNewOutboxMessage(t *testing.T) {
+	at := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	msg, err := newOutboxMessage(EventPayload{Event: EventUserRegistered, User: "alice", CreatedAt: at})
+	require.NoError(t, err)
+	require.Equal(t, EventUserRegistered, msg.Type)
+	require.Equal(t, "alice", msg.Key)
+	require.Equal(t, at, msg.CreatedAt)
+	require.Contains(t, msg.Payload, `"event":"UserRegistered"`)
+}
+
+func TestOrderChangedBy(t *testing.T) {
+	order := Order{Number: "12345678903", Status: StatusProcessing, Accrual: 0}
+
+	require.False(t, order.changedBy(AccrualOrder{Order: order.Number, Status: StatusProcessing}))
+	require.True(t, order.changedBy(AccrualOrder{Order: order.Number, Status: StatusProcessed, Accrual: 100}))
+	require.True(t, order.changedBy(AccrualOrder{Order: order.Number, Status: StatusRegistered, Accrual: 10}))
+
+	// Accruals of results that are not PROCESSED are not credited
+	require.False(t, order.changedBy(AccrualOrder{Order: order.Number, Status: StatusProcessing, Accrual: 10}))
+	require.Zero(t, AccrualOrder{Status: StatusProcessing, Accrual: 10}.credited())
+	require.Equal(t, float32(10), AccrualOrder{Status: StatusProcessed, Accrual: 10}.credited())
+}
+
+func TestStatusFinal(t *testing.T) {
+	require.False(t, StatusNew.Final())
+	require.False(t, StatusProcessing.Final())
+	require.True(t, StatusInvalid.Final())
+	require.True(t, StatusProcessed.Final())
+}
+
+func TestLoginAttemptRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	policy := LoginPolicy{FreeAttempts: 3, MaxAttempts: 10, BaseDelay: time.Second, Lockout: 15 * time.Minute}
+
+	tests := []struct {
+		name       string
+		attempt    LoginAttempt
+		retryAfter time.Duration
+		locked     bool
+	}{
+		{"no failures", LoginAttempt{}, 0, false},
+		{"free attempts", LoginAttempt{Failures: 2, LastFailure: now}, 0, false},
+		{"first delay", LoginAttempt{Failures: 3, LastFailure: now}, time.Second, false},
+		{"doubled delay", LoginAttempt{Failures: 5, LastFailure: now}, 4 * time.Second, false},
+		{"delay passed", LoginAttempt{Failures: 5, LastFailure: now.Add(-5 * time.Second)}, 0, false},
+		{"delay partly passed", LoginAttempt{Failures: 5, LastFailure: now.Add(-time.Second)}, 3 * time.Second, false},
+		{"locked out", LoginAttempt{Failures: 10, LastFailure: now.Add(-5 * time.Minute)}, 10 * time.Minute, true},
+		{"lockout passed", LoginAttempt{Failures: 10, LastFailure: now.Add(-15 * time.Minute)}, 0, false},
+		{"locked right after failure", LoginAttempt{Failures: 30, LastFailure: now}, 15 * time.Minute, true},
+	}
+
+	for _, tt := range tests {
+		retryAfter, locked := tt.attempt.RetryAfter(policy, now)
+
+		require.Equal(t, tt.retryAfter, retryAfter, tt.name)
+		require.Equal(t, tt.locked, locked, tt.name)
+	}
+
+	// Delays are capped by lockout even before the key gets locked
+	retryAfter, locked := LoginAttempt{Failures: 20, LastFailure: now}.RetryAfter(LoginPolicy{FreeAttempts: 3, MaxAttempts: 50, BaseDelay: time.Second, Lockout: time.Minute}, now)
+	require.Equal(t, time.Minute, retryAfter)
+	require.False(t, locked)
+}
+
+func TestAPIKeyHasScope(t *testing.T) {
+	key := APIKey{Scopes: "orders:read,orders:write"}
+
+	require.True(t, key.HasScope("orders:write"))
+	require.True(t, key.HasScope("orders:read"))
+	require.False(t, key.HasScope("orders"))
+	require.False(t, key.HasScope("balance:write"))
+	require.False(t, key.HasScope(""))
+	require.False(t, APIKey{}.HasScope("orders:write"))
+}
@@ -2,7 +2,12 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -10,15 +15,16 @@ import (
 
 type SQLxDriver struct {
 	conn *sqlx.DB
+	opts Options
 }
 
-func NewSQLxDriver(uri string) (Storage, error) {
+func NewSQLxDriver(uri string, opts ...Option) (Storage, error) {
 	conn, err := sqlx.Open("postgres", uri)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open DB connection: %w", err)
 	}
 
-	return &SQLxDriver{conn}, nil
+	return &SQLxDriver{conn, newOptions(opts)}, nil
 }
 
 func (d *SQLxDriver) Init(ctx context.Context) error {
@@ -53,6 +59,284 @@ func (d *SQLxDriver) Init(ctx context.Context) error {
 		)
 	`
 
+	balanceAdjustmentsTable := `
+		CREATE TABLE IF NOT EXISTS balance_adjustments (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			amount double precision NOT NULL,
+			reason text NOT NULL,
+			actor text NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	passwordResetsTable := `
+		CREATE TABLE IF NOT EXISTS password_resets (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			token_hash text NOT NULL UNIQUE,
+			expires_at timestamptz NOT NULL,
+			used_at timestamptz
+		)
+	`
+
+	recoveryCodesTable := `
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			code_hash text NOT NULL,
+			used_at timestamptz
+		)
+	`
+
+	loginAttemptsTable := `
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			key text PRIMARY KEY,
+			failures int NOT NULL DEFAULT 0,
+			last_failure timestamptz NOT NULL
+		)
+	`
+
+	auditEventsTable := `
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id bigserial PRIMARY KEY,
+			actor text NOT NULL,
+			action text NOT NULL,
+			target text NOT NULL,
+			amount_before double precision,
+			amount_after double precision,
+			details text NOT NULL DEFAULT '',
+			request_id text NOT NULL DEFAULT '',
+			ip text NOT NULL DEFAULT '',
+			created_at timestamptz NOT NULL,
+			prev_hash text NOT NULL,
+			hash text NOT NULL UNIQUE
+		)
+	`
+
+	refundsTable := `
+		CREATE TABLE IF NOT EXISTS refunds (
+			id serial PRIMARY KEY,
+			withdrawal_id integer NOT NULL REFERENCES withdrawals (id) ON DELETE CASCADE,
+			user_name text NOT NULL,
+			orderid text NOT NULL,
+			sum double precision NOT NULL,
+			reason text NOT NULL,
+			actor text NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	orderRevisionsTable := `
+		CREATE TABLE IF NOT EXISTS order_revisions (
+			id serial PRIMARY KEY,
+			orderid text NOT NULL REFERENCES orders (number) ON DELETE CASCADE,
+			user_name text NOT NULL,
+			status_before int NOT NULL,
+			status_after int NOT NULL,
+			accrual_before double precision NOT NULL,
+			accrual_after double precision NOT NULL,
+			credited double precision NOT NULL,
+			debt double precision NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	pointLotsTable := `
+		CREATE TABLE IF NOT EXISTS point_lots (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			source text NOT NULL,
+			amount double precision NOT NULL,
+			remaining double precision NOT NULL,
+			earned_at timestamptz NOT NULL,
+			expires_at timestamptz
+		)
+	`
+
+	transfersTable := `
+		CREATE TABLE IF NOT EXISTS transfers (
+			id serial PRIMARY KEY,
+			from_user text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			to_user text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			sum double precision NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	campaignsTable := `
+		CREATE TABLE IF NOT EXISTS campaigns (
+			id serial PRIMARY KEY,
+			kind text NOT NULL,
+			code text UNIQUE,
+			name text NOT NULL,
+			points double precision NOT NULL,
+			budget double precision NOT NULL DEFAULT 0,
+			spent double precision NOT NULL DEFAULT 0,
+			per_user_limit int NOT NULL DEFAULT 1,
+			starts_at timestamptz NOT NULL,
+			ends_at timestamptz,
+			created_by text NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	bonusesTable := `
+		CREATE TABLE IF NOT EXISTS bonuses (
+			id serial PRIMARY KEY,
+			campaign_id integer NOT NULL REFERENCES campaigns (id) ON DELETE CASCADE,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			kind text NOT NULL,
+			campaign text NOT NULL,
+			points double precision NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	referralsTable := `
+		CREATE TABLE IF NOT EXISTS referrals (
+			id serial PRIMARY KEY,
+			referrer text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			referee text NOT NULL UNIQUE REFERENCES users (name) ON DELETE CASCADE,
+			status text NOT NULL,
+			reason text NOT NULL DEFAULT '',
+			ip text NOT NULL DEFAULT '',
+			device text NOT NULL DEFAULT '',
+			created_at timestamptz NOT NULL,
+			rewarded_at timestamptz
+		)
+	`
+
+	holdsTable := `
+		CREATE TABLE IF NOT EXISTS holds (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			orderid text NOT NULL,
+			sum double precision NOT NULL,
+			status text NOT NULL,
+			created_at timestamptz NOT NULL,
+			expires_at timestamptz NOT NULL,
+			resolved_at timestamptz
+		)
+	`
+
+	userIdentitiesTable := `
+		CREATE TABLE IF NOT EXISTS user_identities (
+			id serial PRIMARY KEY,
+			user_name text NOT NULL REFERENCES users (name) ON DELETE CASCADE,
+			issuer text NOT NULL,
+			subject text NOT NULL,
+			created_at timestamptz NOT NULL,
+			UNIQUE (issuer, subject)
+		)
+	`
+
+	apiKeysTable := `
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id serial PRIMARY KEY,
+			prefix text NOT NULL UNIQUE,
+			hash text NOT NULL,
+			name text NOT NULL,
+			scopes text NOT NULL,
+			created_by text NOT NULL,
+			created_at timestamptz NOT NULL,
+			revoked_at timestamptz
+		)
+	`
+
+	outboxMessagesTable := `
+		CREATE TABLE IF NOT EXISTS outbox_messages (
+			id bigserial PRIMARY KEY,
+			type text NOT NULL,
+			key text NOT NULL,
+			payload text NOT NULL,
+			created_at timestamptz NOT NULL,
+			published_at timestamptz,
+			claimed_until timestamptz
+		)
+	`
+
+	webhooksTable := `
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id serial PRIMARY KEY,
+			url text NOT NULL,
+			secret text NOT NULL,
+			events text NOT NULL,
+			created_by text NOT NULL,
+			created_at timestamptz NOT NULL,
+			disabled_at timestamptz
+		)
+	`
+
+	webhookDeliveriesTable := `
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id bigserial PRIMARY KEY,
+			webhook_id integer NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+			event text NOT NULL,
+			payload text NOT NULL,
+			status text NOT NULL,
+			attempts int NOT NULL DEFAULT 0,
+			response_code int NOT NULL DEFAULT 0,
+			last_error text NOT NULL DEFAULT '',
+			next_attempt_at timestamptz NOT NULL,
+			created_at timestamptz NOT NULL,
+			delivered_at timestamptz
+		)
+	`
+
+	signingKeysTable := `
+		CREATE TABLE IF NOT EXISTS signing_keys (
+			id text PRIMARY KEY,
+			seed bytea NOT NULL,
+			created_at timestamptz NOT NULL
+		)
+	`
+
+	// Columns added after the initial schema
+	migrations := []string{
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email text NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS sessions_valid_after timestamptz NOT NULL DEFAULT 'epoch'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'user'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS block_reason text NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS held double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS refunded double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS debt double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS processed_at timestamptz`,
+		`CREATE INDEX IF NOT EXISTS orders_processed_at_idx ON orders (processed_at)`,
+		`CREATE INDEX IF NOT EXISTS order_revisions_orderid_idx ON order_revisions (orderid)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS tier text NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS multiplier double precision NOT NULL DEFAULT 1`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS multiplier double precision NOT NULL DEFAULT 1`,
+		// Orders credited before multipliers got exactly what accrual system returned
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS base_accrual double precision`,
+		`UPDATE orders SET base_accrual = accrual WHERE base_accrual IS NULL`,
+		`ALTER TABLE orders ALTER COLUMN base_accrual SET DEFAULT 0`,
+		`ALTER TABLE orders ALTER COLUMN base_accrual SET NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS transfers_from_user_idx ON transfers (from_user, created_at)`,
+		`CREATE INDEX IF NOT EXISTS transfers_to_user_idx ON transfers (to_user, created_at)`,
+		`CREATE INDEX IF NOT EXISTS bonuses_user_name_idx ON bonuses (user_name, campaign_id)`,
+		// Referral bonuses belong to no campaign
+		`ALTER TABLE bonuses ALTER COLUMN campaign_id DROP NOT NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS referral_code text UNIQUE`,
+		`CREATE INDEX IF NOT EXISTS referrals_referrer_idx ON referrals (referrer)`,
+		`CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor)`,
+		`CREATE INDEX IF NOT EXISTS outbox_messages_unpublished_idx ON outbox_messages (id) WHERE published_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id)`,
+		`CREATE INDEX IF NOT EXISTS point_lots_user_name_idx ON point_lots (user_name, earned_at) WHERE remaining > 0`,
+		`CREATE INDEX IF NOT EXISTS point_lots_expires_at_idx ON point_lots (expires_at) WHERE remaining > 0`,
+		`CREATE INDEX IF NOT EXISTS holds_expires_at_idx ON holds (expires_at) WHERE status = 'held'`,
+		`CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target)`,
+		// Orders uploaded before providers were configurable are routed anew
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS provider text NOT NULL DEFAULT ''`,
+		`ALTER TABLE outbox_messages ADD COLUMN IF NOT EXISTS claimed_until timestamptz`,
+		`ALTER TABLE orders ADD COLUMN IF NOT EXISTS repaid double precision NOT NULL DEFAULT 0`,
+	}
+
 	tx, err := d.conn.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to create transaction: %w", err)
@@ -62,6 +346,33 @@ func (d *SQLxDriver) Init(ctx context.Context) error {
 	tx.ExecContext(ctx, usersTable)
 	tx.ExecContext(ctx, ordersTable)
 	tx.ExecContext(ctx, withdrawalsTable)
+	tx.ExecContext(ctx, balanceAdjustmentsTable)
+	tx.ExecContext(ctx, passwordResetsTable)
+	tx.ExecContext(ctx, recoveryCodesTable)
+	tx.ExecContext(ctx, loginAttemptsTable)
+	tx.ExecContext(ctx, auditEventsTable)
+	tx.ExecContext(ctx, refundsTable)
+	tx.ExecContext(ctx, orderRevisionsTable)
+	tx.ExecContext(ctx, pointLotsTable)
+	tx.ExecContext(ctx, transfersTable)
+	tx.ExecContext(ctx, campaignsTable)
+	tx.ExecContext(ctx, bonusesTable)
+	tx.ExecContext(ctx, referralsTable)
+	tx.ExecContext(ctx, holdsTable)
+	tx.ExecContext(ctx, userIdentitiesTable)
+	tx.ExecContext(ctx, apiKeysTable)
+	tx.ExecContext(ctx, outboxMessagesTable)
+	tx.ExecContext(ctx, webhooksTable)
+	tx.ExecContext(ctx, webhookDeliveriesTable)
+	tx.ExecContext(ctx, signingKeysTable)
+
+	for _, migration := range migrations {
+		tx.ExecContext(ctx, migration)
+	}
+
+	for _, statement := range auditAppendOnlyStatements {
+		tx.ExecContext(ctx, statement)
+	}
 
 	return tx.Commit()
 }
@@ -81,18 +392,114 @@ func (d *SQLxDriver) CreateUser(ctx context.Context, user User) error {
 	}
 	defer tx.Rollback()
 
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditUserRegistered, user.Name)
+	event.Actor = user.Name
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertUser(ctx context.Context, tx *sqlx.Tx, user User) error {
 	existingUser := User{}
 
-	err = tx.GetContext(ctx, &existingUser, `SELECT * FROM users WHERE name=$1`, user.Name)
+	err := tx.GetContext(ctx, &existingUser, `SELECT * FROM users WHERE name=$1`, user.Name)
 	if err == nil {
 		return ErrUserExists
 	}
 
-	_, err = tx.NamedExecContext(ctx, `INSERT INTO users (name, passhash) VALUES (:name, :passhash)`, user)
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO users (name, email, passhash) VALUES (:name, :email, :passhash)`, user)
 	if err != nil {
 		return fmt.Errorf("failed to insert new user: %w", err)
 	}
 
+	return insertOutboxMessage(ctx, tx, EventPayload{Event: EventUserRegistered, User: user.Name, CreatedAt: time.Now()})
+}
+
+func insertIdentity(ctx context.Context, tx *sqlx.Tx, identity UserIdentity) error {
+	result, err := tx.NamedExecContext(ctx, `
+		INSERT INTO user_identities (user_name, issuer, subject, created_at)
+		VALUES (:user_name, :issuer, :subject, :created_at)
+		ON CONFLICT (issuer, subject) DO NOTHING
+	`, identity)
+	if err != nil {
+		return fmt.Errorf("failed to insert user identity: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrIdentityAlreadyLinked
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) GetUserByIdentity(ctx context.Context, issuer string, subject string) (User, error) {
+	user := User{}
+
+	err := d.conn.GetContext(ctx, &user, `
+		SELECT users.* FROM users JOIN user_identities ON user_identities.user_name = users.name
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2
+	`, issuer, subject)
+	if err != nil {
+		return User{}, ErrUserDoesNotExist
+	}
+
+	return user, nil
+}
+
+func (d *SQLxDriver) CreateUserWithIdentity(ctx context.Context, user User, identity UserIdentity) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	err = insertIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditUserRegistered, user.Name).withDetails(identity.Issuer)
+	event.Actor = user.Name
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) LinkIdentity(ctx context.Context, identity UserIdentity) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = insertIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditUserIdentityLinked, identity.UserName).withDetails(identity.Issuer))
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
@@ -118,106 +525,130 @@ func (d *SQLxDriver) GetUserByName(ctx context.Context, userName string) (User,
 	return user, nil
 }
 
-func (d *SQLxDriver) SaveOrder(ctx context.Context, order Order) error {
+func (d *SQLxDriver) UpdatePassword(ctx context.Context, user User) error {
 	tx, err := d.conn.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to create transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	existingOrder := Order{}
-
-	err = tx.GetContext(ctx, &existingOrder, `SELECT * FROM orders WHERE number=$1`, order.Number)
-	if err == nil {
-		if existingOrder.RegisteredBy == order.RegisteredBy {
-			return ErrOrderAlreadyRegisteredByUser
-		}
+	result, err := tx.NamedExecContext(ctx, `UPDATE users SET passhash = :passhash, sessions_valid_after = :sessions_valid_after WHERE name = :name`, user)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
 
-		if existingOrder.RegisteredBy != order.RegisteredBy {
-			return ErrOrderAlreadyRegisteredBySomeoneElse
-		}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserDoesNotExist
 	}
 
-	_, err = tx.NamedExecContext(ctx, `INSERT INTO orders (registered_by, number, status, uploaded_at) VALUES (:registered_by, :number, :status, :uploaded_at)`, order)
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditUserPasswordChanged, user.Name))
 	if err != nil {
-		return fmt.Errorf("failed to insert new order: %w", err)
+		return err
 	}
 
 	return tx.Commit()
 }
 
-func (d *SQLxDriver) UpdateOrder(ctx context.Context, order AccrualOrder) error {
+func (d *SQLxDriver) SetUserRole(ctx context.Context, user User) error {
 	tx, err := d.conn.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to create transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	_, err = tx.NamedExecContext(ctx, `UPDATE orders SET status = :status, accrual = :accrual WHERE number=:order`, order)
+	// Admins demoting each other at once must not both succeed
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, roleChangeLockID)
 	if err != nil {
-		return fmt.Errorf("failed to update order: %w", err)
+		return fmt.Errorf("failed to lock roles: %w", err)
 	}
 
-	updatedOrder := Order{}
-	err = tx.GetContext(ctx, &updatedOrder, `SELECT * FROM orders WHERE number=$1`, order.Order)
+	existingUser := User{}
+
+	err = tx.GetContext(ctx, &existingUser, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, user.Name)
 	if err != nil {
-		return fmt.Errorf("failed to get updated order: %w", err)
+		return ErrUserDoesNotExist
 	}
 
-	_, err = tx.NamedExecContext(ctx, `UPDATE users SET current = users.current + :accrual WHERE name=:registered_by`, updatedOrder)
-	if err != nil {
-		return fmt.Errorf("failed to update order: %w", err)
+	if existingUser.Role == user.Role {
+		return nil
 	}
 
-	return tx.Commit()
-}
+	if existingUser.Role == RoleAdmin {
+		var admins int
 
-func (d *SQLxDriver) GetUserOrders(ctx context.Context, userName string, orderField string) ([]Order, error) {
-	query := fmt.Sprintf(`SELECT * FROM orders WHERE registered_by=$1 ORDER BY %s`, orderField)
+		err = tx.GetContext(ctx, &admins, `SELECT count(*) FROM users WHERE role = $1`, RoleAdmin)
+		if err != nil {
+			return fmt.Errorf("failed to count admins: %w", err)
+		}
 
-	orders := []Order{}
+		if admins <= 1 {
+			return ErrLastAdmin
+		}
+	}
 
-	err := d.conn.SelectContext(ctx, &orders, query, userName)
+	_, err = tx.NamedExecContext(ctx, `UPDATE users SET role = :role, sessions_valid_after = :sessions_valid_after WHERE name = :name`, user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get orders")
+		return fmt.Errorf("failed to update user role: %w", err)
 	}
 
-	return orders, nil
+	event := NewAuditEvent(ctx, AuditUserRoleChanged, user.Name).withDetails(fmt.Sprintf("%s -> %s", existingUser.Role, user.Role))
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (d *SQLxDriver) GetOrders(ctx context.Context, statuses []Status) ([]Order, error) {
-	query, args, err := sqlx.In(`SELECT * FROM orders WHERE status IN (?)`, statuses)
+func (d *SQLxDriver) SetUserBlocked(ctx context.Context, user User) error {
+	tx, err := d.conn.Beginx()
 	if err != nil {
-		return nil, fmt.Errorf("failed to prepare IN query: %w", err)
+		return fmt.Errorf("failed to create transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	query = d.conn.Rebind(query)
+	result, err := tx.NamedExecContext(ctx, `UPDATE users SET blocked = :blocked, block_reason = :block_reason, sessions_valid_after = :sessions_valid_after WHERE name = :name`, user)
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
 
-	orders := []Order{}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrUserDoesNotExist
+	}
 
-	err = d.conn.SelectContext(ctx, &orders, query, args...)
+	action := AuditUserUnblocked
+	if user.Blocked {
+		action = AuditUserBlocked
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, action, user.Name).withDetails(user.BlockReason))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get orders: %w", err)
+		return err
 	}
 
-	return orders, nil
+	return tx.Commit()
 }
 
-func (d *SQLxDriver) GetUserBalance(ctx context.Context, userName string) (Balance, error) {
-	user := User{}
+func (d *SQLxDriver) SearchUsers(ctx context.Context, query string, limit int, offset int) ([]User, error) {
+	users := []User{}
 
-	err := d.conn.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1`, userName)
+	err := d.conn.SelectContext(
+		ctx,
+		&users,
+		`SELECT * FROM users WHERE name ILIKE $1 OR email ILIKE $1 ORDER BY name LIMIT $2 OFFSET $3`,
+		"%"+escapeLike(query)+"%",
+		limit,
+		offset,
+	)
 	if err != nil {
-		return Balance{}, fmt.Errorf("failed to get user balance")
+		return nil, fmt.Errorf("failed to search users: %w", err)
 	}
 
-	return Balance{
-		Current:   user.Current,
-		Withdrawn: user.Withdrawn,
-	}, nil
+	return users, nil
 }
 
-func (d *SQLxDriver) SaveWithdrawal(ctx context.Context, withdrawal Withdrawal) error {
+func (d *SQLxDriver) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) error {
 	tx, err := d.conn.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to create transaction: %w", err)
@@ -226,37 +657,2099 @@ func (d *SQLxDriver) SaveWithdrawal(ctx context.Context, withdrawal Withdrawal)
 
 	user := User{}
 
-	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1`, withdrawal.RegisteredBy)
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, adjustment.UserName)
 	if err != nil {
 		return ErrUserDoesNotExist
 	}
 
-	if user.Current < withdrawal.Sum {
+	// Points reserved by holds can not be taken away; credits are always
+	// accepted as the balance may be negative after a clawback
+	if adjustment.Amount < 0 && user.Current+adjustment.Amount < user.Held {
 		return ErrNotEnoughPoints
 	}
 
-	_, err = tx.NamedExecContext(ctx, `UPDATE users SET current = users.current - :sum, withdrawn = users.withdrawn + :sum WHERE name = :registered_by`, withdrawal)
+	_, err = tx.NamedExecContext(ctx, `UPDATE users SET current = users.current + :amount WHERE name = :user_name`, adjustment)
 	if err != nil {
 		return fmt.Errorf("failed to update user balance: %w", err)
 	}
 
-	_, err = tx.NamedExecContext(ctx, `INSERT INTO withdrawals (registered_by, orderid, sum, processed_at) VALUES (:registered_by, :orderid, :sum, :processed_at)`, withdrawal)
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO balance_adjustments (user_name, amount, reason, actor, created_at) VALUES (:user_name, :amount, :reason, :actor, :created_at)`, adjustment)
 	if err != nil {
-		return fmt.Errorf("failed to insert new withdraw: %w", err)
+		return fmt.Errorf("failed to insert balance adjustment: %w", err)
+	}
+
+	if adjustment.Amount > 0 {
+		err = insertLot(ctx, tx, d.opts.newLot(adjustment.UserName, "adjustment", adjustment.Amount, adjustment.CreatedAt))
+	} else {
+		err = spendLots(ctx, tx, adjustment.UserName, -adjustment.Amount)
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := newBalancePayload(WebhookBalanceAdjusted, user, adjustment.Amount, adjustment.CreatedAt)
+	payload.Adjustment = &adjustment
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceAdjusted, adjustment.UserName).
+		withAmounts(user.Current, user.Current+adjustment.Amount).
+		withDetails(adjustment.Reason)
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
 	}
 
 	return tx.Commit()
 }
 
-func (d *SQLxDriver) GetWithdrawals(ctx context.Context, userName string, orderField string) ([]Withdrawal, error) {
-	query := fmt.Sprintf(`SELECT * FROM withdrawals WHERE registered_by=$1 ORDER BY %s`, orderField)
+// tierStandingsQuery sums base accruals of orders processed since $1
+// so that multipliers do not feed back into tiers
+const tierStandingsQuery = `
+	SELECT users.name AS user_name, users.tier, coalesce(sum(orders.base_accrual), 0) AS accrued
+	FROM users LEFT JOIN orders
+		ON orders.registered_by = users.name AND orders.status = $1 AND orders.processed_at >= $2
+`
 
-	withdrawals := []Withdrawal{}
+func (d *SQLxDriver) GetTierStandings(ctx context.Context, since time.Time) ([]TierStanding, error) {
+	standings := []TierStanding{}
 
-	err := d.conn.SelectContext(ctx, &withdrawals, query, userName)
+	err := d.conn.SelectContext(ctx, &standings, tierStandingsQuery+` GROUP BY users.name, users.tier`, StatusProcessed, since)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get withdrawals")
+		return nil, fmt.Errorf("failed to get tier standings: %w", err)
 	}
 
-	return withdrawals, nil
+	return standings, nil
+}
+
+func (d *SQLxDriver) GetTierStanding(ctx context.Context, userName string, since time.Time) (TierStanding, error) {
+	standing := TierStanding{}
+
+	err := d.conn.GetContext(ctx, &standing, tierStandingsQuery+` WHERE users.name = $3 GROUP BY users.name, users.tier`, StatusProcessed, since, userName)
+	if err != nil {
+		return TierStanding{}, ErrUserDoesNotExist
+	}
+
+	return standing, nil
+}
+
+func (d *SQLxDriver) SetUserTier(ctx context.Context, userName string, tier string, multiplier float32) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, userName)
+	if err != nil {
+		return ErrUserDoesNotExist
+	}
+
+	if user.Tier == tier && user.Multiplier == multiplier {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET tier = $2, multiplier = $3 WHERE name = $1`, userName, tier, multiplier)
+	if err != nil {
+		return fmt.Errorf("failed to update user tier: %w", err)
+	}
+
+	event := NewAuditEvent(ctx, AuditUserTierChanged, userName).
+		withDetails(fmt.Sprintf("%s -> %s x%v", user.Tier, tier, multiplier))
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) SavePasswordReset(ctx context.Context, reset PasswordReset) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only the latest reset token of a user stays usable
+	_, err = tx.ExecContext(ctx, `UPDATE password_resets SET used_at = now() WHERE user_name = $1 AND used_at IS NULL`, reset.UserName)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate previous password resets: %w", err)
+	}
+
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO password_resets (user_name, token_hash, expires_at) VALUES (:user_name, :token_hash, :expires_at)`, reset)
+	if err != nil {
+		return fmt.Errorf("failed to insert new password reset: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) ResetPassword(ctx context.Context, tokenHash string, user User) (string, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userName string
+
+	err = tx.GetContext(
+		ctx,
+		&userName,
+		`UPDATE password_resets SET used_at = $2 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 RETURNING user_name`,
+		tokenHash,
+		user.SessionsValidAfter,
+	)
+	if err != nil {
+		return "", ErrInvalidResetToken
+	}
+
+	user.Name = userName
+
+	_, err = tx.NamedExecContext(ctx, `UPDATE users SET passhash = :passhash, sessions_valid_after = :sessions_valid_after WHERE name = :name`, user)
+	if err != nil {
+		return "", fmt.Errorf("failed to update password: %w", err)
+	}
+
+	event := NewAuditEvent(ctx, AuditUserPasswordReset, userName)
+	event.Actor = userName
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return "", err
+	}
+
+	return userName, tx.Commit()
+}
+
+func (d *SQLxDriver) SetTOTPSecret(ctx context.Context, userName string, secret string) error {
+	result, err := d.conn.ExecContext(ctx, `UPDATE users SET totp_secret = $2 WHERE name = $1 AND NOT totp_enabled`, userName, secret)
+	if err != nil {
+		return fmt.Errorf("failed to set totp secret: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) EnableTOTP(ctx context.Context, userName string, step int64, recoveryCodeHashes []string) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET totp_enabled = true, totp_last_step = $2 WHERE name = $1 AND NOT totp_enabled AND totp_secret != ''`, userName, step)
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_name = $1`, userName)
+	if err != nil {
+		return fmt.Errorf("failed to delete old recovery codes: %w", err)
+	}
+
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_name, code_hash) VALUES ($1, $2)`, userName, codeHash)
+		if err != nil {
+			return fmt.Errorf("failed to insert recovery code: %w", err)
+		}
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditUserMFAEnabled, userName))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) DisableTOTP(ctx context.Context, userName string) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET totp_enabled = false, totp_secret = '', totp_last_step = 0 WHERE name = $1`, userName)
+	if err != nil {
+		return fmt.Errorf("failed to disable totp: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_name = $1`, userName)
+	if err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditUserMFADisabled, userName))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) UseTOTPStep(ctx context.Context, userName string, step int64) error {
+	result, err := d.conn.ExecContext(ctx, `UPDATE users SET totp_last_step = $2 WHERE name = $1 AND totp_last_step < $2`, userName, step)
+	if err != nil {
+		return fmt.Errorf("failed to save totp step: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) UseRecoveryCode(ctx context.Context, userName string, codeHash string) error {
+	result, err := d.conn.ExecContext(ctx, `UPDATE recovery_codes SET used_at = now() WHERE user_name = $1 AND code_hash = $2 AND used_at IS NULL`, userName, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	return nil
+}
+
+// ReserveLoginAttempt counts the attempt as failed upfront unless one of the
+// keys is throttled, then throttled attempts are returned and nothing is
+// counted. Concurrent attempts of a key are serialized so each of them sees
+// the ones before.
+func (d *SQLxDriver) ReserveLoginAttempt(ctx context.Context, policies map[string]LoginPolicy, at time.Time) ([]LoginAttempt, error) {
+	keys := make([]string, 0, len(policies))
+	for key := range policies {
+		keys = append(keys, key)
+	}
+
+	// Locks are always taken in the same order not to deadlock
+	sort.Strings(keys)
+
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range keys {
+		_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, loginAttemptLockID, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock login attempts: %w", err)
+		}
+	}
+
+	query, args, err := sqlx.In(`SELECT * FROM login_attempts WHERE key IN (?)`, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare IN query: %w", err)
+	}
+
+	attempts := []LoginAttempt{}
+
+	err = tx.SelectContext(ctx, &attempts, tx.Rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get login attempts: %w", err)
+	}
+
+	throttled := []LoginAttempt{}
+	for _, attempt := range attempts {
+		if wait, _ := attempt.RetryAfter(policies[attempt.Key], at); wait > 0 {
+			throttled = append(throttled, attempt)
+		}
+	}
+
+	if len(throttled) > 0 {
+		return throttled, nil
+	}
+
+	// Failures older than lockout do not count anymore
+	upsert := `
+		INSERT INTO login_attempts (key, failures, last_failure) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+	`
+
+	for _, key := range keys {
+		_, err = tx.ExecContext(ctx, upsert, key, at, at.Add(-policies[key].Lockout))
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve login attempt: %w", err)
+		}
+	}
+
+	return nil, tx.Commit()
+}
+
+// ReleaseLoginAttempt takes back a reserved attempt that did not fail
+func (d *SQLxDriver) ReleaseLoginAttempt(ctx context.Context, keys []string) error {
+	query, args, err := sqlx.In(`UPDATE login_attempts SET failures = greatest(failures - 1, 0) WHERE key IN (?)`, keys)
+	if err != nil {
+		return fmt.Errorf("failed to prepare IN query: %w", err)
+	}
+
+	_, err = d.conn.ExecContext(ctx, d.conn.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to release login attempt: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) ResetLoginAttempts(ctx context.Context, keys []string) error {
+	query, args, err := sqlx.In(`DELETE FROM login_attempts WHERE key IN (?)`, keys)
+	if err != nil {
+		return fmt.Errorf("failed to prepare IN query: %w", err)
+	}
+
+	_, err = d.conn.ExecContext(ctx, d.conn.Rebind(query), args...)
+	if err != nil {
+		return fmt.Errorf("failed to reset login attempts: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) SaveOrder(ctx context.Context, order Order) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	existingOrder := Order{}
+
+	err = tx.GetContext(ctx, &existingOrder, `SELECT * FROM orders WHERE number=$1`, order.Number)
+	if err == nil {
+		if existingOrder.RegisteredBy == order.RegisteredBy {
+			return ErrOrderAlreadyRegisteredByUser
+		}
+
+		if existingOrder.RegisteredBy != order.RegisteredBy {
+			return ErrOrderAlreadyRegisteredBySomeoneElse
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO orders (registered_by, number, status, uploaded_at, provider) VALUES (:registered_by, :number, :status, :uploaded_at, :provider)`, order)
+	if err != nil {
+		return fmt.Errorf("failed to insert new order: %w", err)
+	}
+
+	err = insertOutboxMessage(ctx, tx, EventPayload{Event: EventOrderUploaded, User: order.RegisteredBy, Order: &order, CreatedAt: order.UploadedAt})
+	if err != nil {
+		return err
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditOrderUploaded, order.Number).withDetails(order.RegisteredBy))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) UpdateOrder(ctx context.Context, processed AccrualOrder) (Order, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	order := Order{}
+	err = tx.GetContext(ctx, &order, `SELECT * FROM orders WHERE number=$1 FOR UPDATE`, processed.Order)
+	if err != nil {
+		return Order{}, ErrOrderDoesNotExist
+	}
+
+	// Pushed results are trusted from the provider the order is routed to only,
+	// orders uploaded before providers were recorded are left to polling
+	if processed.Provider != "" && processed.Provider != order.Provider {
+		return Order{}, ErrOrderOtherProvider
+	}
+
+	// Results may come from both polling and callbacks, only the first counts
+	if order.Status.Final() {
+		return Order{}, ErrOrderAlreadyProcessed
+	}
+
+	// Pending orders are polled over and over, repeats change nothing
+	if !order.changedBy(processed) {
+		return Order{}, ErrOrderNotChanged
+	}
+
+	user := User{}
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, order.RegisteredBy)
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to get order owner: %w", err)
+	}
+
+	// Tier multiplier of the moment is kept with the order
+	base := processed.credited()
+	accrual := base * user.Multiplier
+
+	credited, repaid := user.repayDebt(accrual)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET status = $2, accrual = $3, base_accrual = $4, multiplier = $5, repaid = $6 WHERE number = $1
+	`, order.Number, processed.Status, accrual, base, user.Multiplier, repaid)
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to update order: %w", err)
+	}
+
+	// Processing time bounds which orders are re-verified later
+	if processed.Status == StatusProcessed {
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET processed_at = now() WHERE number = $1`, order.Number)
+		if err != nil {
+			return Order{}, fmt.Errorf("failed to update order: %w", err)
+		}
+	}
+
+	order.Status, order.Accrual, order.BaseAccrual, order.Multiplier, order.Repaid = processed.Status, accrual, base, user.Multiplier, repaid
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = current + $2, debt = debt - $3 WHERE name = $1`, user.Name, credited, repaid)
+	if err != nil {
+		return Order{}, fmt.Errorf("failed to update order: %w", err)
+	}
+
+	if credited > 0 {
+		err = insertLot(ctx, tx, d.opts.newLot(user.Name, order.Number, credited, time.Now()))
+		if err != nil {
+			return Order{}, err
+		}
+	}
+
+	updated := user
+	updated.Current, updated.Debt = user.Current+credited, user.Debt-repaid
+
+	payload := EventPayload{
+		Event:     WebhookOrderUpdated,
+		User:      user.Name,
+		Order:     &order,
+		Balance:   updated.Balance(),
+		CreatedAt: time.Now(),
+	}
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if processed.Status == StatusProcessed {
+		payload.Event = EventOrderProcessed
+
+		err = insertOutboxMessage(ctx, tx, payload)
+		if err != nil {
+			return Order{}, err
+		}
+	}
+
+	event := NewAuditEvent(ctx, AuditOrderUpdated, order.Number).
+		withAmounts(user.Current, user.Current+credited).
+		withDetails(processed.Status.String())
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return Order{}, err
+	}
+
+	return order, tx.Commit()
+}
+
+func (d *SQLxDriver) GetUserOrders(ctx context.Context, userName string, orderField string) ([]Order, error) {
+	query := fmt.Sprintf(`SELECT * FROM orders WHERE registered_by=$1 ORDER BY %s`, orderField)
+
+	orders := []Order{}
+
+	err := d.conn.SelectContext(ctx, &orders, query, userName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orders")
+	}
+
+	return orders, nil
+}
+
+func (d *SQLxDriver) GetOrders(ctx context.Context, statuses []Status) ([]Order, error) {
+	query, args, err := sqlx.In(`SELECT * FROM orders WHERE status IN (?)`, statuses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare IN query: %w", err)
+	}
+
+	query = d.conn.Rebind(query)
+
+	orders := []Order{}
+
+	err = d.conn.SelectContext(ctx, &orders, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get orders: %w", err)
+	}
+
+	return orders, nil
+}
+
+func (d *SQLxDriver) GetProcessedOrders(ctx context.Context, since time.Time) ([]Order, error) {
+	orders := []Order{}
+
+	err := d.conn.SelectContext(ctx, &orders, `SELECT * FROM orders WHERE status = $1 AND processed_at >= $2`, StatusProcessed, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processed orders: %w", err)
+	}
+
+	return orders, nil
+}
+
+func (d *SQLxDriver) ReviseOrder(ctx context.Context, revised AccrualOrder, policy ClawbackPolicy) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	order := Order{}
+
+	err = tx.GetContext(ctx, &order, `SELECT * FROM orders WHERE number=$1 FOR UPDATE`, revised.Order)
+	if err != nil {
+		return ErrOrderDoesNotExist
+	}
+
+	if order.Status != StatusProcessed {
+		return ErrOrderNotProcessed
+	}
+
+	if revised.points() == order.BaseAccrual && revised.Status == order.Status {
+		return nil
+	}
+
+	revision := newOrderRevision(order, revised)
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, order.RegisteredBy)
+	if err != nil {
+		return fmt.Errorf("failed to get order owner: %w", err)
+	}
+
+	revision.Credited, revision.Debt = user.accrualChange(revision.AccrualAfter-revision.AccrualBefore, policy)
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE orders SET status = $2, accrual = $3, base_accrual = $4 WHERE number = $1
+	`, order.Number, revision.StatusAfter, revision.AccrualAfter, revised.points())
+	if err != nil {
+		return fmt.Errorf("failed to update order: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = current + $2, debt = debt + $3 WHERE name = $1`, user.Name, revision.Credited, revision.Debt)
+	if err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	if revision.Credited > 0 {
+		err = insertLot(ctx, tx, d.opts.newLot(user.Name, order.Number, revision.Credited, revision.CreatedAt))
+	} else {
+		err = spendLots(ctx, tx, user.Name, -revision.Credited)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO order_revisions (orderid, user_name, status_before, status_after, accrual_before, accrual_after, credited, debt, created_at)
+		VALUES (:orderid, :user_name, :status_before, :status_after, :accrual_before, :accrual_after, :credited, :debt, :created_at)
+	`, revision)
+	if err != nil {
+		return fmt.Errorf("failed to insert order revision: %w", err)
+	}
+
+	payload := newBalancePayload(WebhookOrderRevised, user, revision.Credited, revision.CreatedAt)
+	payload.Balance.Debt += revision.Debt
+	payload.Revision = &revision
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditOrderRevised, order.Number).
+		withAmounts(user.Current, user.Current+revision.Credited).
+		withDetails(revision.String())
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) RequeueOrder(ctx context.Context, number string) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	order := Order{}
+
+	err = tx.GetContext(ctx, &order, `SELECT * FROM orders WHERE number=$1 FOR UPDATE`, number)
+	if err != nil {
+		return ErrOrderDoesNotExist
+	}
+
+	// Processed orders are already credited, re-processing would pay twice
+	if order.Status == StatusProcessed {
+		return ErrOrderAlreadyProcessed
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $2, accrual = 0 WHERE number = $1`, number, StatusNew)
+	if err != nil {
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditOrderRequeued, number).withDetails(order.Status.String()))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) GetUserBalance(ctx context.Context, userName string) (Balance, error) {
+	user := User{}
+
+	err := d.conn.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1`, userName)
+	if err != nil {
+		return Balance{}, fmt.Errorf("failed to get user balance")
+	}
+
+	balance := user.Balance()
+
+	expiry := PointsExpiry{}
+
+	err = d.conn.GetContext(ctx, &expiry, `
+		SELECT expires_at, sum(remaining) AS amount FROM point_lots
+		WHERE user_name=$1 AND remaining > 0 AND expires_at IS NOT NULL
+		GROUP BY expires_at ORDER BY expires_at LIMIT 1
+	`, userName)
+	if err == nil {
+		balance.NextExpiry = &expiry
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Balance{}, fmt.Errorf("failed to get next points expiry: %w", err)
+	}
+
+	return balance, nil
+}
+
+func (d *SQLxDriver) StreamStatement(ctx context.Context, userName string, from time.Time, to time.Time, fn func(StatementEntry) error) error {
+	// A snapshot keeps the opening balance consistent with the entries
+	tx, err := d.conn.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1`, userName)
+	if err != nil {
+		return ErrUserDoesNotExist
+	}
+
+	entries := fmt.Sprintf(statementQuery, "$1")
+
+	// Opening balance is counted back from the current one so points
+	// credited before entries were recorded still add up
+	var since float32
+
+	err = tx.GetContext(ctx, &since, `SELECT coalesce(sum(amount), 0) FROM (`+entries+`) entries WHERE at >= $2`, userName, from)
+	if err != nil {
+		return fmt.Errorf("failed to sum statement entries: %w", err)
+	}
+
+	rows, err := tx.QueryxContext(ctx, `
+		SELECT * FROM (`+entries+`) entries WHERE amount <> 0 AND at >= $2 AND at < $3 ORDER BY at
+	`, userName, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to get statement entries: %w", err)
+	}
+	defer rows.Close()
+
+	balance := user.Current - since
+
+	for rows.Next() {
+		entry := StatementEntry{}
+
+		err = rows.StructScan(&entry)
+		if err != nil {
+			return fmt.Errorf("failed to scan statement entry: %w", err)
+		}
+
+		balance += entry.Amount
+		entry.Balance = balance
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func insertLot(ctx context.Context, tx *sqlx.Tx, lot PointLot) error {
+	_, err := tx.NamedExecContext(ctx, `
+		INSERT INTO point_lots (user_name, source, amount, remaining, earned_at, expires_at)
+		VALUES (:user_name, :source, :amount, :remaining, :earned_at, :expires_at)
+	`, lot)
+	if err != nil {
+		return fmt.Errorf("failed to insert point lot: %w", err)
+	}
+
+	return nil
+}
+
+// spendLots takes amount from the oldest lots of user locked by the caller
+func spendLots(ctx context.Context, tx *sqlx.Tx, userName string, amount float32) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	lots := []PointLot{}
+
+	err := tx.SelectContext(ctx, &lots, `SELECT * FROM point_lots WHERE user_name=$1 AND remaining > 0 ORDER BY earned_at, id FOR UPDATE`, userName)
+	if err != nil {
+		return fmt.Errorf("failed to get point lots: %w", err)
+	}
+
+	return updateLots(ctx, tx, takeFromLots(lots, amount))
+}
+
+func updateLots(ctx context.Context, tx *sqlx.Tx, lots []PointLot) error {
+	for _, lot := range lots {
+		_, err := tx.ExecContext(ctx, `UPDATE point_lots SET remaining = $2 WHERE id = $1`, lot.ID, lot.Remaining)
+		if err != nil {
+			return fmt.Errorf("failed to update point lot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) ExpirePoints(ctx context.Context, at time.Time) (int, error) {
+	userNames := []string{}
+
+	err := d.conn.SelectContext(ctx, &userNames, `SELECT DISTINCT user_name FROM point_lots WHERE remaining > 0 AND expires_at <= $1`, at)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired point lots: %w", err)
+	}
+
+	expired := 0
+
+	// One transaction per user keeps user rows locked only briefly
+	for _, userName := range userNames {
+		ok, err := d.expireUserPoints(ctx, userName, at)
+		if err != nil {
+			return expired, err
+		}
+
+		if ok {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (d *SQLxDriver) expireUserPoints(ctx context.Context, userName string, at time.Time) (bool, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, userName)
+	if err != nil {
+		return false, ErrUserDoesNotExist
+	}
+
+	lots := []PointLot{}
+
+	err = tx.SelectContext(ctx, &lots, `
+		SELECT * FROM point_lots WHERE user_name=$1 AND remaining > 0 AND expires_at <= $2
+		ORDER BY earned_at, id FOR UPDATE
+	`, userName, at)
+	if err != nil {
+		return false, fmt.Errorf("failed to get expired point lots: %w", err)
+	}
+
+	amount := expirable(user, lots)
+	if amount <= 0 {
+		return false, nil
+	}
+
+	err = updateLots(ctx, tx, takeFromLots(lots, amount))
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = current - $2 WHERE name = $1`, userName, amount)
+	if err != nil {
+		return false, fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	err = enqueueWebhooks(ctx, tx, newBalancePayload(WebhookBalanceExpired, user, -amount, at))
+	if err != nil {
+		return false, err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceExpired, userName).
+		withAmounts(user.Current, user.Current-amount)
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (d *SQLxDriver) SaveWithdrawal(ctx context.Context, withdrawal Withdrawal) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, withdrawal.RegisteredBy)
+	if err != nil {
+		return ErrUserDoesNotExist
+	}
+
+	if user.Balance().Available < withdrawal.Sum {
+		return ErrNotEnoughPoints
+	}
+
+	err = insertWithdrawal(ctx, tx, user, withdrawal)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertWithdrawal debits user locked by the caller
+func insertWithdrawal(ctx context.Context, tx *sqlx.Tx, user User, withdrawal Withdrawal) error {
+	_, err := tx.NamedExecContext(ctx, `UPDATE users SET current = users.current - :sum, withdrawn = users.withdrawn + :sum WHERE name = :registered_by`, withdrawal)
+	if err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO withdrawals (registered_by, orderid, sum, processed_at) VALUES (:registered_by, :orderid, :sum, :processed_at)`, withdrawal)
+	if err != nil {
+		return fmt.Errorf("failed to insert new withdraw: %w", err)
+	}
+
+	err = spendLots(ctx, tx, withdrawal.RegisteredBy, withdrawal.Sum)
+	if err != nil {
+		return err
+	}
+
+	updated := user
+	updated.Current, updated.Withdrawn = user.Current-withdrawal.Sum, user.Withdrawn+withdrawal.Sum
+
+	payload := EventPayload{
+		Event:      WebhookBalanceWithdrawn,
+		User:       user.Name,
+		Withdrawal: &withdrawal,
+		Balance:    updated.Balance(),
+		CreatedAt:  time.Now(),
+	}
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+
+	payload.Event = EventPointsWithdrawn
+
+	err = insertOutboxMessage(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceWithdrawn, withdrawal.RegisteredBy).
+		withAmounts(user.Current, user.Current-withdrawal.Sum).
+		withDetails(withdrawal.Order)
+
+	return appendAuditEvent(ctx, tx, event)
+}
+
+func (d *SQLxDriver) CreateHold(ctx context.Context, hold Hold) (Hold, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Hold{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, hold.UserName)
+	if err != nil {
+		return Hold{}, ErrUserDoesNotExist
+	}
+
+	available := user.Balance().Available
+	if available < hold.Sum {
+		return Hold{}, ErrNotEnoughPoints
+	}
+
+	hold.Status = HoldActive
+
+	err = tx.GetContext(ctx, &hold.ID, `
+		INSERT INTO holds (user_name, orderid, sum, status, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+	`, hold.UserName, hold.Order, hold.Sum, hold.Status, hold.CreatedAt, hold.ExpiresAt)
+	if err != nil {
+		return Hold{}, fmt.Errorf("failed to insert new hold: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET held = users.held + $2 WHERE name = $1`, hold.UserName, hold.Sum)
+	if err != nil {
+		return Hold{}, fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceHeld, hold.UserName).
+		withAmounts(available, available-hold.Sum).
+		withDetails(hold.Order)
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	return hold, tx.Commit()
+}
+
+func (d *SQLxDriver) GetHolds(ctx context.Context, userName string) ([]Hold, error) {
+	holds := []Hold{}
+
+	err := d.conn.SelectContext(ctx, &holds, `SELECT * FROM holds WHERE user_name=$1 ORDER BY created_at DESC`, userName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get holds: %w", err)
+	}
+
+	return holds, nil
+}
+
+// lockActiveHold locks the hold and its user, user row first like every
+// other balance change so concurrent transactions do not deadlock
+func lockActiveHold(ctx context.Context, tx *sqlx.Tx, userName string, id int) (User, Hold, error) {
+	user := User{}
+
+	err := tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, userName)
+	if err != nil {
+		return User{}, Hold{}, ErrHoldDoesNotExist
+	}
+
+	hold := Hold{}
+
+	err = tx.GetContext(ctx, &hold, `SELECT * FROM holds WHERE id=$1 AND user_name=$2 AND status=$3 FOR UPDATE`, id, userName, HoldActive)
+	if err != nil {
+		return User{}, Hold{}, ErrHoldDoesNotExist
+	}
+
+	return user, hold, nil
+}
+
+// releaseHold returns held points of a locked hold to available balance
+func releaseHold(ctx context.Context, tx *sqlx.Tx, user User, hold Hold, status HoldStatus, at time.Time) error {
+	_, err := tx.ExecContext(ctx, `UPDATE holds SET status = $2, resolved_at = $3 WHERE id = $1`, hold.ID, status, at)
+	if err != nil {
+		return fmt.Errorf("failed to update hold: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET held = users.held - $2 WHERE name = $1`, hold.UserName, hold.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	available := user.Balance().Available
+
+	event := NewAuditEvent(ctx, AuditBalanceHoldReleased, hold.UserName).
+		withAmounts(available, available+hold.Sum).
+		withDetails(string(status))
+
+	return appendAuditEvent(ctx, tx, event)
+}
+
+func (d *SQLxDriver) ConfirmHold(ctx context.Context, userName string, id int, at time.Time) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user, hold, err := lockActiveHold(ctx, tx, userName, id)
+	if err != nil {
+		return err
+	}
+
+	// Release right away, the job would do the same a bit later
+	if !at.Before(hold.ExpiresAt) {
+		err = releaseHold(ctx, tx, user, hold, HoldExpired, at)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		return ErrHoldExpired
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE holds SET status = $2, resolved_at = $3 WHERE id = $1`, hold.ID, HoldConfirmed, at)
+	if err != nil {
+		return fmt.Errorf("failed to update hold: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET held = users.held - $2 WHERE name = $1`, userName, hold.Sum)
+	if err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	err = insertWithdrawal(ctx, tx, user, Withdrawal{
+		RegisteredBy: userName,
+		Order:        hold.Order,
+		Sum:          hold.Sum,
+		ProcessedAt:  at,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) CancelHold(ctx context.Context, userName string, id int, at time.Time) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user, hold, err := lockActiveHold(ctx, tx, userName, id)
+	if err != nil {
+		return err
+	}
+
+	err = releaseHold(ctx, tx, user, hold, HoldCancelled, at)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) ReleaseExpiredHolds(ctx context.Context, at time.Time) (int, error) {
+	expired := []Hold{}
+
+	err := d.conn.SelectContext(ctx, &expired, `SELECT * FROM holds WHERE status=$1 AND expires_at <= $2`, HoldActive, at)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired holds: %w", err)
+	}
+
+	released := 0
+
+	// One transaction per hold keeps user rows locked only briefly
+	for _, candidate := range expired {
+		err = d.releaseExpiredHold(ctx, candidate, at)
+		if errors.Is(err, ErrHoldDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+
+		released++
+	}
+
+	return released, nil
+}
+
+func (d *SQLxDriver) releaseExpiredHold(ctx context.Context, candidate Hold, at time.Time) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Hold might have been resolved since it was selected
+	user, hold, err := lockActiveHold(ctx, tx, candidate.UserName, candidate.ID)
+	if err != nil {
+		return err
+	}
+
+	err = releaseHold(ctx, tx, user, hold, HoldExpired, at)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) GetWithdrawals(ctx context.Context, userName string, orderField string) ([]Withdrawal, error) {
+	query := fmt.Sprintf(`SELECT * FROM withdrawals WHERE registered_by=$1 ORDER BY %s`, orderField)
+
+	withdrawals := []Withdrawal{}
+
+	err := d.conn.SelectContext(ctx, &withdrawals, query, userName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get withdrawals")
+	}
+
+	for i := range withdrawals {
+		withdrawals[i].setRefundStatus()
+	}
+
+	return withdrawals, nil
+}
+
+// RefundWithdrawal credits back the latest withdrawal for refund order.
+// Zero refund sum refunds everything left.
+func (d *SQLxDriver) RefundWithdrawal(ctx context.Context, refund Refund) (Refund, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Refund{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	user := User{}
+
+	err = tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, refund.UserName)
+	if err != nil {
+		return Refund{}, ErrUserDoesNotExist
+	}
+
+	withdrawal := Withdrawal{}
+
+	err = tx.GetContext(ctx, &withdrawal, `
+		SELECT * FROM withdrawals WHERE registered_by=$1 AND orderid=$2
+		ORDER BY processed_at DESC LIMIT 1 FOR UPDATE
+	`, refund.UserName, refund.Order)
+	if err != nil {
+		return Refund{}, ErrWithdrawalDoesNotExist
+	}
+
+	if refund.Sum == 0 {
+		refund.Sum = withdrawal.Refundable()
+	}
+
+	if refund.Sum <= 0 || refund.Sum > withdrawal.Refundable() {
+		return Refund{}, ErrRefundExceedsWithdrawal
+	}
+
+	refund.WithdrawalID = withdrawal.ID
+
+	_, err = tx.ExecContext(ctx, `UPDATE withdrawals SET refunded = withdrawals.refunded + $2 WHERE id = $1`, withdrawal.ID, refund.Sum)
+	if err != nil {
+		return Refund{}, fmt.Errorf("failed to update withdrawal: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = users.current + $2, withdrawn = users.withdrawn - $2 WHERE name = $1`, refund.UserName, refund.Sum)
+	if err != nil {
+		return Refund{}, fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO refunds (withdrawal_id, user_name, orderid, sum, reason, actor, created_at)
+		VALUES (:withdrawal_id, :user_name, :orderid, :sum, :reason, :actor, :created_at)
+	`, refund)
+	if err != nil {
+		return Refund{}, fmt.Errorf("failed to insert refund: %w", err)
+	}
+
+	// Refunded points start a new lot rather than reviving spent ones
+	err = insertLot(ctx, tx, d.opts.newLot(refund.UserName, "refund:"+refund.Order, refund.Sum, refund.CreatedAt))
+	if err != nil {
+		return Refund{}, err
+	}
+
+	payload := newBalancePayload(WebhookBalanceRefunded, user, refund.Sum, refund.CreatedAt)
+	payload.Balance.Withdrawn -= refund.Sum
+	payload.Refund = &refund
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceRefunded, refund.UserName).
+		withAmounts(user.Current, user.Current+refund.Sum).
+		withDetails(refund.Order + ": " + refund.Reason)
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return refund, tx.Commit()
+}
+
+func (d *SQLxDriver) TransferPoints(ctx context.Context, transfer Transfer, dailyLimit float32) (Transfer, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Rows are locked in name order so opposite transfers can not deadlock
+	users := []User{}
+
+	err = tx.SelectContext(ctx, &users, `SELECT * FROM users WHERE name IN ($1, $2) ORDER BY name FOR UPDATE`, transfer.From, transfer.To)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to lock users: %w", err)
+	}
+
+	sender, recipient, err := transferParties(users, transfer)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	if dailyLimit > 0 {
+		var sent float32
+
+		err = tx.GetContext(ctx, &sent, `
+			SELECT coalesce(sum(sum), 0) FROM transfers WHERE from_user = $1 AND created_at > $2
+		`, transfer.From, transfer.CreatedAt.Add(-24*time.Hour))
+		if err != nil {
+			return Transfer{}, fmt.Errorf("failed to sum recent transfers: %w", err)
+		}
+
+		if sent+transfer.Sum > dailyLimit {
+			return Transfer{}, ErrTransferLimitExceeded
+		}
+	}
+
+	if sender.Balance().Available < transfer.Sum {
+		return Transfer{}, ErrNotEnoughPoints
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = current - $2 WHERE name = $1`, sender.Name, transfer.Sum)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to update sender balance: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET current = current + $2 WHERE name = $1`, recipient.Name, transfer.Sum)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to update recipient balance: %w", err)
+	}
+
+	lots := []PointLot{}
+
+	err = tx.SelectContext(ctx, &lots, `SELECT * FROM point_lots WHERE user_name=$1 AND remaining > 0 ORDER BY earned_at, id FOR UPDATE`, sender.Name)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to get point lots: %w", err)
+	}
+
+	changed, moved := moveLots(lots, transfer.Sum, recipient.Name, "transfer:"+sender.Name)
+
+	err = updateLots(ctx, tx, changed)
+	if err != nil {
+		return Transfer{}, err
+	}
+
+	for _, lot := range moved {
+		err = insertLot(ctx, tx, lot)
+		if err != nil {
+			return Transfer{}, err
+		}
+	}
+
+	err = tx.GetContext(ctx, &transfer.ID, `
+		INSERT INTO transfers (from_user, to_user, sum, created_at) VALUES ($1, $2, $3, $4) RETURNING id
+	`, transfer.From, transfer.To, transfer.Sum, transfer.CreatedAt)
+	if err != nil {
+		return Transfer{}, fmt.Errorf("failed to insert transfer: %w", err)
+	}
+
+	for _, payload := range transferPayloads(sender, recipient, transfer) {
+		err = enqueueWebhooks(ctx, tx, payload)
+		if err != nil {
+			return Transfer{}, err
+		}
+	}
+
+	for _, event := range transferAuditEvents(ctx, sender, recipient, transfer) {
+		err = appendAuditEvent(ctx, tx, event)
+		if err != nil {
+			return Transfer{}, err
+		}
+	}
+
+	return transfer, tx.Commit()
+}
+
+func (d *SQLxDriver) GetTransfers(ctx context.Context, userName string) ([]Transfer, error) {
+	transfers := []Transfer{}
+
+	err := d.conn.SelectContext(ctx, &transfers, `
+		SELECT * FROM transfers WHERE from_user = $1 OR to_user = $1 ORDER BY created_at DESC
+	`, userName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfers: %w", err)
+	}
+
+	return transfers, nil
+}
+
+func (d *SQLxDriver) CreateCampaign(ctx context.Context, campaign Campaign) (Campaign, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Campaign{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.GetContext(ctx, &campaign.ID, `
+		INSERT INTO campaigns (kind, code, name, points, budget, per_user_limit, starts_at, ends_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (code) DO NOTHING RETURNING id
+	`, campaign.Kind, campaign.Code, campaign.Name, campaign.Points, campaign.Budget, campaign.PerUserLimit,
+		campaign.StartsAt, campaign.EndsAt, campaign.CreatedBy, campaign.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Campaign{}, ErrCampaignExists
+	}
+	if err != nil {
+		return Campaign{}, fmt.Errorf("failed to insert campaign: %w", err)
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditCampaignCreated, campaign.Name).withDetails(string(campaign.Kind)))
+	if err != nil {
+		return Campaign{}, err
+	}
+
+	return campaign, tx.Commit()
+}
+
+func (d *SQLxDriver) GetCampaigns(ctx context.Context) ([]Campaign, error) {
+	campaigns := []Campaign{}
+
+	err := d.conn.SelectContext(ctx, &campaigns, `SELECT * FROM campaigns ORDER BY id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get campaigns: %w", err)
+	}
+
+	return campaigns, nil
+}
+
+func (d *SQLxDriver) RedeemPromo(ctx context.Context, code string, userName string, at time.Time) (Bonus, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Bonus{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	campaign := Campaign{}
+
+	// Campaign row is locked first so budget is spent one redemption at a time
+	err = tx.GetContext(ctx, &campaign, `SELECT * FROM campaigns WHERE code=$1 AND kind=$2 FOR UPDATE`, code, CampaignPromo)
+	if err != nil {
+		return Bonus{}, ErrCampaignDoesNotExist
+	}
+
+	bonus, err := d.grantBonus(ctx, tx, campaign, userName, at)
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	return bonus, tx.Commit()
+}
+
+func (d *SQLxDriver) GrantWelcomeBonus(ctx context.Context, userName string, at time.Time) (Bonus, error) {
+	campaignIDs := []int{}
+
+	err := d.conn.SelectContext(ctx, &campaignIDs, `
+		SELECT id FROM campaigns WHERE kind=$1 AND starts_at <= $2 AND (ends_at IS NULL OR ends_at > $2) ORDER BY id
+	`, CampaignWelcome, at)
+	if err != nil {
+		return Bonus{}, fmt.Errorf("failed to get welcome campaigns: %w", err)
+	}
+
+	// The first campaign with budget left wins
+	err = ErrCampaignDoesNotExist
+	for _, id := range campaignIDs {
+		var bonus Bonus
+
+		bonus, err = d.grantWelcomeBonus(ctx, id, userName, at)
+		if err == nil {
+			return bonus, nil
+		}
+	}
+
+	return Bonus{}, err
+}
+
+func (d *SQLxDriver) grantWelcomeBonus(ctx context.Context, campaignID int, userName string, at time.Time) (Bonus, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Bonus{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	campaign := Campaign{}
+
+	err = tx.GetContext(ctx, &campaign, `SELECT * FROM campaigns WHERE id=$1 FOR UPDATE`, campaignID)
+	if err != nil {
+		return Bonus{}, ErrCampaignDoesNotExist
+	}
+
+	bonus, err := d.grantBonus(ctx, tx, campaign, userName, at)
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	return bonus, tx.Commit()
+}
+
+// grantBonus credits campaign points to user if the campaign allows;
+// the campaign is locked by the caller
+func (d *SQLxDriver) grantBonus(ctx context.Context, tx *sqlx.Tx, campaign Campaign, userName string, at time.Time) (Bonus, error) {
+	user := User{}
+
+	err := tx.GetContext(ctx, &user, `SELECT * FROM users WHERE name=$1 FOR UPDATE`, userName)
+	if err != nil {
+		return Bonus{}, ErrUserDoesNotExist
+	}
+
+	var redeemed int
+
+	err = tx.GetContext(ctx, &redeemed, `SELECT count(*) FROM bonuses WHERE campaign_id=$1 AND user_name=$2`, campaign.ID, userName)
+	if err != nil {
+		return Bonus{}, fmt.Errorf("failed to count redemptions: %w", err)
+	}
+
+	err = campaign.check(at, redeemed)
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	bonus := campaign.bonus(userName, at)
+
+	_, err = tx.ExecContext(ctx, `UPDATE campaigns SET spent = spent + $2 WHERE id = $1`, campaign.ID, bonus.Points)
+	if err != nil {
+		return Bonus{}, fmt.Errorf("failed to update campaign: %w", err)
+	}
+
+	err = d.creditBonus(ctx, tx, user, bonus)
+	if err != nil {
+		return Bonus{}, err
+	}
+
+	return bonus, nil
+}
+
+// creditBonus adds bonus points to user locked by the caller
+func (d *SQLxDriver) creditBonus(ctx context.Context, tx *sqlx.Tx, user User, bonus Bonus) error {
+	_, err := tx.ExecContext(ctx, `UPDATE users SET current = current + $2 WHERE name = $1`, user.Name, bonus.Points)
+	if err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO bonuses (campaign_id, user_name, kind, campaign, points, created_at)
+		VALUES (:campaign_id, :user_name, :kind, :campaign, :points, :created_at)
+	`, bonus)
+	if err != nil {
+		return fmt.Errorf("failed to insert bonus: %w", err)
+	}
+
+	err = insertLot(ctx, tx, d.opts.newLot(user.Name, string(bonus.Kind)+":"+bonus.Campaign, bonus.Points, bonus.CreatedAt))
+	if err != nil {
+		return err
+	}
+
+	payload := newBalancePayload(WebhookBalanceBonus, user, bonus.Points, bonus.CreatedAt)
+	payload.Bonus = &bonus
+
+	err = enqueueWebhooks(ctx, tx, payload)
+	if err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(ctx, AuditBalanceBonus, user.Name).
+		withAmounts(user.Current, user.Current+bonus.Points).
+		withDetails(string(bonus.Kind) + ": " + bonus.Campaign)
+
+	return appendAuditEvent(ctx, tx, event)
+}
+
+func (d *SQLxDriver) GetBonuses(ctx context.Context, userName string) ([]Bonus, error) {
+	bonuses := []Bonus{}
+
+	err := d.conn.SelectContext(ctx, &bonuses, `SELECT * FROM bonuses WHERE user_name=$1 ORDER BY created_at DESC`, userName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bonuses: %w", err)
+	}
+
+	return bonuses, nil
+}
+
+func (d *SQLxDriver) GetReferralCode(ctx context.Context, userName string, candidate string) (string, error) {
+	var code string
+
+	// The candidate is only taken if user has no code yet
+	err := d.conn.GetContext(ctx, &code, `
+		UPDATE users SET referral_code = coalesce(referral_code, $2) WHERE name = $1 RETURNING referral_code
+	`, userName, candidate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserDoesNotExist
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to set referral code: %w", err)
+	}
+
+	return code, nil
+}
+
+func (d *SQLxDriver) GetUserByReferralCode(ctx context.Context, code string) (User, error) {
+	user := User{}
+
+	err := d.conn.GetContext(ctx, &user, `SELECT * FROM users WHERE referral_code=$1`, code)
+	if err != nil {
+		return User{}, ErrReferralCodeInvalid
+	}
+
+	return user, nil
+}
+
+func (d *SQLxDriver) CreateReferral(ctx context.Context, referral Referral) (Referral, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Referral{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	referrerIPs := []string{}
+
+	err = tx.SelectContext(ctx, &referrerIPs, `SELECT DISTINCT ip FROM audit_events WHERE actor=$1 AND ip <> ''`, referral.Referrer)
+	if err != nil {
+		return Referral{}, fmt.Errorf("failed to get referrer addresses: %w", err)
+	}
+
+	earlier := []Referral{}
+
+	err = tx.SelectContext(ctx, &earlier, `SELECT * FROM referrals WHERE referrer=$1`, referral.Referrer)
+	if err != nil {
+		return Referral{}, fmt.Errorf("failed to get referrals: %w", err)
+	}
+
+	referral = referral.screen(referrerIPs, earlier)
+
+	err = tx.GetContext(ctx, &referral.ID, `
+		INSERT INTO referrals (referrer, referee, status, reason, ip, device, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (referee) DO NOTHING RETURNING id
+	`, referral.Referrer, referral.Referee, referral.Status, referral.Reason, referral.IP, referral.Device, referral.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Referral{}, ErrUserExists
+	}
+	if err != nil {
+		return Referral{}, fmt.Errorf("failed to insert referral: %w", err)
+	}
+
+	event := NewAuditEvent(ctx, AuditReferralCreated, referral.Referee).withDetails(referral.String())
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return Referral{}, err
+	}
+
+	return referral, tx.Commit()
+}
+
+func (d *SQLxDriver) GetReferrals(ctx context.Context, referrer string) ([]Referral, error) {
+	referrals := []Referral{}
+
+	err := d.conn.SelectContext(ctx, &referrals, `SELECT * FROM referrals WHERE referrer=$1 ORDER BY created_at DESC`, referrer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get referrals: %w", err)
+	}
+
+	return referrals, nil
+}
+
+func (d *SQLxDriver) RewardReferral(ctx context.Context, referee string, referrerPoints float32, refereePoints float32, at time.Time) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	referral := Referral{}
+
+	// Referral row is locked first so concurrent orders reward once
+	err = tx.GetContext(ctx, &referral, `SELECT * FROM referrals WHERE referee=$1 AND status=$2 FOR UPDATE`, referee, ReferralPending)
+	if err != nil {
+		return ErrReferralDoesNotExist
+	}
+
+	users := []User{}
+
+	err = tx.SelectContext(ctx, &users, `
+		SELECT * FROM users WHERE name IN ($1, $2) ORDER BY name FOR UPDATE
+	`, referral.Referrer, referral.Referee)
+	if err != nil {
+		return fmt.Errorf("failed to lock users: %w", err)
+	}
+
+	referrer, refereeUser, reason := referralParties(users, referral)
+	if reason != "" {
+		_, err = tx.ExecContext(ctx, `UPDATE referrals SET status=$2, reason=$3 WHERE id=$1`, referral.ID, ReferralRejected, reason)
+		if err != nil {
+			return fmt.Errorf("failed to reject referral: %w", err)
+		}
+
+		return tx.Commit()
+	}
+
+	if referrerPoints > 0 {
+		err = d.creditBonus(ctx, tx, referrer, referralBonus(referrer.Name, referee, referrerPoints, at))
+		if err != nil {
+			return err
+		}
+	}
+
+	if refereePoints > 0 {
+		err = d.creditBonus(ctx, tx, refereeUser, referralBonus(referee, referral.Referrer, refereePoints, at))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE referrals SET status=$2, rewarded_at=$3 WHERE id=$1`, referral.ID, ReferralRewarded, at)
+	if err != nil {
+		return fmt.Errorf("failed to update referral: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) SaveSigningKey(ctx context.Context, key SigningKey) error {
+	_, err := d.conn.NamedExecContext(ctx, `INSERT INTO signing_keys (id, seed, created_at) VALUES (:id, :seed, :created_at) ON CONFLICT (id) DO NOTHING`, key)
+	if err != nil {
+		return fmt.Errorf("failed to insert new signing key: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) GetSigningKeys(ctx context.Context) ([]SigningKey, error) {
+	keys := []SigningKey{}
+
+	err := d.conn.SelectContext(ctx, &keys, `SELECT * FROM signing_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signing keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (d *SQLxDriver) DeleteSigningKeys(ctx context.Context, createdBefore time.Time) error {
+	_, err := d.conn.ExecContext(ctx, `DELETE FROM signing_keys WHERE created_at < $1`, createdBefore)
+	if err != nil {
+		return fmt.Errorf("failed to delete signing keys: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) SaveAPIKey(ctx context.Context, key APIKey) (int, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.GetContext(ctx, &key.ID, `
+		INSERT INTO api_keys (prefix, hash, name, scopes, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+	`, key.Prefix, key.Hash, key.Name, key.Scopes, key.CreatedBy, key.CreatedAt)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert new api key: %w", err)
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditAPIKeyCreated, key.Prefix).withDetails(key.Scopes))
+	if err != nil {
+		return 0, err
+	}
+
+	return key.ID, tx.Commit()
+}
+
+func (d *SQLxDriver) GetAPIKeyByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	key := APIKey{}
+
+	err := d.conn.GetContext(ctx, &key, `SELECT * FROM api_keys WHERE prefix=$1 AND revoked_at IS NULL`, prefix)
+	if err != nil {
+		return APIKey{}, ErrAPIKeyDoesNotExist
+	}
+
+	return key, nil
+}
+
+func (d *SQLxDriver) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	err := d.conn.SelectContext(ctx, &keys, `SELECT * FROM api_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (d *SQLxDriver) RevokeAPIKey(ctx context.Context, id int) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	prefix := ""
+
+	err = tx.GetContext(ctx, &prefix, `UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL RETURNING prefix`, id)
+	if err != nil {
+		return ErrAPIKeyDoesNotExist
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditAPIKeyRevoked, prefix))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertOutboxMessage records a domain event in the same tx as the change
+func insertOutboxMessage(ctx context.Context, tx *sqlx.Tx, payload EventPayload) error {
+	msg, err := newOutboxMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO outbox_messages (type, key, payload, created_at) VALUES (:type, :key, :payload, :created_at)
+	`, msg)
+	if err != nil {
+		return fmt.Errorf("failed to insert outbox message: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimOutboxMessages takes the oldest unpublished messages for lease. Only
+// one relay holds a claim at a time: messages are published in order and
+// a second relay working on later messages would overtake the first one.
+func (d *SQLxDriver) ClaimOutboxMessages(ctx context.Context, at time.Time, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, outboxClaimLockID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock outbox: %w", err)
+	}
+
+	var claimed bool
+
+	err = tx.GetContext(ctx, &claimed, `SELECT EXISTS (SELECT 1 FROM outbox_messages WHERE published_at IS NULL AND claimed_until > $1)`, at)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check outbox claims: %w", err)
+	}
+
+	if claimed {
+		return nil, nil
+	}
+
+	messages := []OutboxMessage{}
+
+	err = tx.SelectContext(ctx, &messages, `
+		WITH claimed AS (
+			UPDATE outbox_messages SET claimed_until = $2 WHERE id IN (
+				SELECT id FROM outbox_messages WHERE published_at IS NULL ORDER BY id LIMIT $3
+			) RETURNING *
+		)
+		SELECT * FROM claimed ORDER BY id
+	`, at, at.Add(lease), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox messages: %w", err)
+	}
+
+	return messages, tx.Commit()
+}
+
+func (d *SQLxDriver) MarkOutboxPublished(ctx context.Context, id int64, at time.Time) error {
+	_, err := d.conn.ExecContext(ctx, `UPDATE outbox_messages SET published_at = $2 WHERE id = $1`, id, at)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox message published: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) CreateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.GetContext(ctx, &webhook.ID, `
+		INSERT INTO webhooks (url, secret, events, created_by, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id
+	`, webhook.URL, webhook.Secret, webhook.Events, webhook.CreatedBy, webhook.CreatedAt)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("failed to insert webhook: %w", err)
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditWebhookCreated, webhook.URL).withDetails(webhook.Events))
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	return webhook, tx.Commit()
+}
+
+func (d *SQLxDriver) GetWebhooks(ctx context.Context) ([]Webhook, error) {
+	webhooks := []Webhook{}
+
+	err := d.conn.SelectContext(ctx, &webhooks, `SELECT * FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+
+	return webhooks, nil
+}
+
+func (d *SQLxDriver) DisableWebhook(ctx context.Context, id int) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	url := ""
+
+	err = tx.GetContext(ctx, &url, `UPDATE webhooks SET disabled_at = now() WHERE id = $1 AND disabled_at IS NULL RETURNING url`, id)
+	if err != nil {
+		return ErrWebhookDoesNotExist
+	}
+
+	err = appendAuditEvent(ctx, tx, NewAuditEvent(ctx, AuditWebhookDisabled, url))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// enqueueWebhooks writes payload to the outbox of every subscribed webhook
+// in the same tx as the change it reports
+func enqueueWebhooks(ctx context.Context, tx *sqlx.Tx, payload EventPayload) error {
+	webhooks := []Webhook{}
+
+	err := tx.SelectContext(ctx, &webhooks, `SELECT * FROM webhooks WHERE disabled_at IS NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to get webhooks: %w", err)
+	}
+
+	deliveries, err := newDeliveries(webhooks, payload)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		_, err = tx.NamedExecContext(ctx, `
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+			VALUES (:webhook_id, :event, :payload, :status, :next_attempt_at, :created_at)
+		`, delivery)
+		if err != nil {
+			return fmt.Errorf("failed to insert webhook delivery: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries takes due deliveries of active webhooks and puts
+// them off for lease so other workers skip them while they are being sent
+func (d *SQLxDriver) ClaimWebhookDeliveries(ctx context.Context, at time.Time, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	err := d.conn.SelectContext(ctx, &deliveries, `
+		UPDATE webhook_deliveries SET next_attempt_at = $2 WHERE id IN (
+			SELECT d.id FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status = $3 AND d.next_attempt_at <= $1 AND w.disabled_at IS NULL
+			ORDER BY d.next_attempt_at LIMIT $4
+			FOR UPDATE OF d SKIP LOCKED
+		) RETURNING *
+	`, at, at.Add(lease), WebhookPending, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+func (d *SQLxDriver) UpdateWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := d.conn.NamedExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = :status, attempts = :attempts, response_code = :response_code,
+			last_error = :last_error, next_attempt_at = :next_attempt_at, delivered_at = :delivered_at
+		WHERE id = :id
+	`, delivery)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook delivery: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) GetWebhookDeliveries(ctx context.Context, webhookID int, limit int, offset int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+
+	err := d.conn.SelectContext(ctx, &deliveries, `
+		SELECT * FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3
+	`, webhookID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook deliveries: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// appendAuditEvent links event to the chain tail within tx. Concurrent appends
+// are serialized by an advisory lock held until tx ends, so it should be
+// the last statement of tx to keep the lock short.
+func appendAuditEvent(ctx context.Context, tx *sqlx.Tx, event AuditEvent) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditChainLockID)
+	if err != nil {
+		return fmt.Errorf("failed to lock audit chain: %w", err)
+	}
+
+	err = tx.GetContext(ctx, &event.PrevHash, `SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to get audit chain tail: %w", err)
+	}
+
+	event.Hash = event.ComputeHash()
+
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT INTO audit_events (actor, action, target, amount_before, amount_after, details, request_id, ip, created_at, prev_hash, hash)
+		VALUES (:actor, :action, :target, :amount_before, :amount_after, :details, :request_id, :ip, :created_at, :prev_hash, :hash)
+	`, event)
+	if err != nil {
+		return fmt.Errorf("failed to insert audit event: %w", err)
+	}
+
+	return nil
+}
+
+func (d *SQLxDriver) SaveAuditEvent(ctx context.Context, event AuditEvent) error {
+	tx, err := d.conn.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = appendAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (d *SQLxDriver) GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+	if filter.Target != "" {
+		addCondition("target = $%d", filter.Target)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at < $%d", filter.To)
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(`SELECT * FROM audit_events WHERE %s ORDER BY id DESC LIMIT $%d OFFSET $%d`,
+		strings.Join(conditions, " AND "), len(args)-1, len(args))
+
+	events := []AuditEvent{}
+
+	err := d.conn.SelectContext(ctx, &events, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %w", err)
+	}
+
+	return events, nil
+}
+
+func (d *SQLxDriver) VerifyAuditLog(ctx context.Context) (int64, error) {
+	rows, err := d.conn.QueryxContext(ctx, `SELECT * FROM audit_events ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get audit events: %w", err)
+	}
+	defer rows.Close()
+
+	verifier := AuditChainVerifier{}
+
+	for rows.Next() {
+		event := AuditEvent{}
+
+		err = rows.StructScan(&event)
+		if err != nil {
+			return verifier.Checked, fmt.Errorf("failed to scan audit event: %w", err)
+		}
+
+		err = verifier.Next(event)
+		if err != nil {
+			return verifier.Checked, err
+		}
+	}
+
+	return verifier.Checked, rows.Err()
 }
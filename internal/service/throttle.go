@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/storage"
+)
+
+const (
+	loginKeyPrefix = "login:"
+	ipKeyPrefix    = "ip:"
+)
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// middleware.RealIP sets RemoteAddr without port
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func loginThrottleKeys(login string, ip string) []string {
+	return []string{loginKeyPrefix + login, ipKeyPrefix + ip}
+}
+
+// reserveLoginAttempt counts the attempt as failed before credentials are
+// checked, so concurrent guesses cannot slip past the limits. Throttled
+// attempts come with the longest wait and whether the login itself is
+// locked out.
+func (s *Service) reserveLoginAttempt(ctx context.Context, keys []string) (time.Duration, bool, error) {
+	policy := s.config.LoginThrottle
+
+	policies := make(map[string]storage.LoginPolicy, len(keys))
+	for _, key := range keys {
+		maxAttempts := policy.MaxAttempts
+		if strings.HasPrefix(key, ipKeyPrefix) {
+			maxAttempts = policy.IPMaxAttempts
+		}
+
+		policies[key] = storage.LoginPolicy{
+			FreeAttempts: policy.FreeAttempts,
+			MaxAttempts:  maxAttempts,
+			BaseDelay:    policy.BaseDelay,
+			Lockout:      policy.Lockout,
+		}
+	}
+
+	now := time.Now()
+
+	throttled, err := s.db.ReserveLoginAttempt(ctx, policies, now)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var (
+		retryAfter time.Duration
+		locked     bool
+	)
+
+	for _, attempt := range throttled {
+		wait, lockedOut := attempt.RetryAfter(policies[attempt.Key], now)
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+
+		if lockedOut && strings.HasPrefix(attempt.Key, loginKeyPrefix) {
+			locked = true
+		}
+	}
+
+	return retryAfter, locked, nil
+}
+
+// releaseLoginAttempt takes back the reservation of an attempt that did not fail
+func (s *Service) releaseLoginAttempt(ctx context.Context, keys []string) {
+	err := s.db.ReleaseLoginAttempt(ctx, keys)
+	if err != nil {
+		s.log.Errorf("failed to release login attempt due to: %s", err)
+	}
+}
+
+// forgiveLoginAttempts is called once the user is fully authenticated.
+// Only the login is forgiven: IP counter must not be reset by logging into own account.
+func (s *Service) forgiveLoginAttempts(ctx context.Context, keys []string) {
+	err := s.db.ResetLoginAttempts(ctx, keys[:1])
+	if err != nil {
+		s.log.Errorf("failed to reset login attempts due to: %s", err)
+	}
+
+	s.releaseLoginAttempt(ctx, keys[1:])
+}
+
+func writeRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+func (s *Service) handleUnlockUser() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		login := chi.URLParam(r, "login")
+
+		keys := []string{loginKeyPrefix + login}
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			keys = append(keys, ipKeyPrefix+ip)
+		}
+
+		err := s.db.ResetLoginAttempts(r.Context(), keys)
+		if err != nil {
+			s.log.Errorf("failed to reset login attempts due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to unlock user"}`))
+			return
+		}
+
+		s.audit(r.Context(), storage.AuditUserUnlocked, login, strings.Join(keys, ","))
+
+		w.Write([]byte(`{"status": "success", "message": "user unlocked"}`))
+	})
+}
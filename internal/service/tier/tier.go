@@ -0,0 +1,102 @@
+// Package tier defines loyalty tiers reached by points accrued within
+// a rolling window and the accrual multipliers they grant.
+package tier
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidTiers = errors.New("invalid tiers")
+
+type Tier struct {
+	Name       string  `json:"name"`
+	Threshold  float32 `json:"threshold"`
+	Multiplier float32 `json:"multiplier"`
+}
+
+// Tiers are ordered by threshold, the first one starts at zero
+type Tiers []Tier
+
+// Parse reads tiers in the name:threshold:multiplier form separated by commas,
+// e.g. "bronze:0:1,silver:1000:1.1,gold:5000:1.25"
+func Parse(s string) (Tiers, error) {
+	tiers := Tiers{}
+	names := map[string]bool{}
+
+	for _, spec := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(spec), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%w: %q is not name:threshold:multiplier", ErrInvalidTiers, spec)
+		}
+
+		threshold, err := strconv.ParseFloat(parts[1], 32)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("%w: bad threshold of %s", ErrInvalidTiers, parts[0])
+		}
+
+		multiplier, err := strconv.ParseFloat(parts[2], 32)
+		if err != nil || multiplier <= 0 {
+			return nil, fmt.Errorf("%w: bad multiplier of %s", ErrInvalidTiers, parts[0])
+		}
+
+		if names[parts[0]] {
+			return nil, fmt.Errorf("%w: %s is defined twice", ErrInvalidTiers, parts[0])
+		}
+		names[parts[0]] = true
+
+		tiers = append(tiers, Tier{parts[0], float32(threshold), float32(multiplier)})
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Threshold < tiers[j].Threshold })
+
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Threshold == tiers[i-1].Threshold {
+			return nil, fmt.Errorf("%w: %s and %s share a threshold", ErrInvalidTiers, tiers[i-1].Name, tiers[i].Name)
+		}
+	}
+
+	if tiers[0].Threshold != 0 {
+		return nil, fmt.Errorf("%w: the lowest tier must start at 0", ErrInvalidTiers)
+	}
+
+	return tiers, nil
+}
+
+// For returns the highest tier reached with accrued points
+func (t Tiers) For(accrued float32) Tier {
+	reached := t[0]
+
+	for _, tier := range t {
+		if accrued >= tier.Threshold {
+			reached = tier
+		}
+	}
+
+	return reached
+}
+
+// Get returns the tier by name
+func (t Tiers) Get(name string) (Tier, bool) {
+	for _, tier := range t {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+
+	return Tier{}, false
+}
+
+// Next returns the tier above the named one
+func (t Tiers) Next(name string) (Tier, bool) {
+	for i, tier := range t {
+		if tier.Name == name && i+1 < len(t) {
+			return t[i+1], true
+		}
+	}
+
+	return Tier{}, false
+}
@@ -0,0 +1,50 @@
+package tier
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tiers, err := Parse("gold:5000:1.25, bronze:0:1,silver:1000:1.1")
+	require.NoError(t, err)
+	require.Equal(t, Tiers{
+		{"bronze", 0, 1},
+		{"silver", 1000, 1.1},
+		{"gold", 5000, 1.25},
+	}, tiers)
+
+	invalid := []string{
+		"",
+		"bronze:0",
+		"bronze:0:1,silver:x:1.1",
+		"bronze:0:1,silver:1000:0",
+		"bronze:0:1,bronze:1000:1.1",
+		"bronze:0:1,silver:0:1.1",
+		"silver:1000:1.1",
+	}
+
+	for _, s := range invalid {
+		_, err = Parse(s)
+		require.True(t, errors.Is(err, ErrInvalidTiers), s)
+	}
+}
+
+func TestFor(t *testing.T) {
+	tiers, err := Parse("bronze:0:1,silver:1000:1.1,gold:5000:1.25")
+	require.NoError(t, err)
+
+	require.Equal(t, "bronze", tiers.For(0).Name)
+	require.Equal(t, "bronze", tiers.For(999.5).Name)
+	require.Equal(t, "silver", tiers.For(1000).Name)
+	require.Equal(t, "gold", tiers.For(100000).Name)
+
+	next, ok := tiers.Next("silver")
+	require.True(t, ok)
+	require.Equal(t, "gold", next.Name)
+
+	_, ok = tiers.Next("gold")
+	require.False(t, ok)
+}
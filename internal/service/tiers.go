@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type (
+	tierResponse struct {
+		Tier       string        `json:"tier"`
+		Multiplier float32       `json:"multiplier"`
+		Accrued    float32       `json:"accrued"`
+		Next       *tierProgress `json:"next,omitempty"`
+	}
+
+	tierProgress struct {
+		Tier      string  `json:"tier"`
+		Threshold float32 `json:"threshold"`
+		Remaining float32 `json:"remaining"`
+	}
+)
+
+// recalculateTiers periodically moves users between tiers by points
+// accrued within TierWindow
+func (s *Service) recalculateTiers(ctx context.Context) {
+	s.log.Infof("tier recalculation started")
+
+	ticker := time.NewTicker(s.config.TierRecalc)
+	defer ticker.Stop()
+
+	for {
+		s.updateTiers(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.log.Infof("tier recalculation stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) updateTiers(ctx context.Context) {
+	standings, err := s.db.GetTierStandings(ctx, time.Now().Add(-s.config.TierWindow))
+	if err != nil {
+		s.log.Errorf("tier recalculation failed to get standings: %s", err)
+		return
+	}
+
+	changed := 0
+
+	for _, standing := range standings {
+		reached := s.tiers.For(standing.Accrued)
+		if reached.Name == standing.Tier {
+			continue
+		}
+
+		err = s.db.SetUserTier(ctx, standing.UserName, reached.Name, reached.Multiplier)
+		if err != nil {
+			s.log.Errorf("tier recalculation failed to update tier of %s: %s", standing.UserName, err)
+			continue
+		}
+
+		changed++
+	}
+
+	if changed > 0 {
+		s.log.Infof("tier recalculation moved %d users", changed)
+	}
+}
+
+func (s *Service) handleTier() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		standing, err := s.db.GetTierStanding(r.Context(), userName, time.Now().Add(-s.config.TierWindow))
+		if err != nil {
+			s.log.Errorf("failed to get tier standing from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get tier"}`))
+			return
+		}
+
+		// Users not recalculated yet are shown the tier they are about to get
+		current, ok := s.tiers.Get(standing.Tier)
+		if !ok {
+			current = s.tiers.For(standing.Accrued)
+		}
+
+		res := tierResponse{
+			Tier:       current.Name,
+			Multiplier: current.Multiplier,
+			Accrued:    standing.Accrued,
+		}
+
+		if next, ok := s.tiers.Next(current.Name); ok {
+			res.Next = &tierProgress{next.Name, next.Threshold, next.Threshold - standing.Accrued}
+
+			if res.Next.Remaining < 0 {
+				res.Next.Remaining = 0
+			}
+		}
+
+		body, err := json.Marshal(res)
+		if err != nil {
+			s.log.Errorf("failed to marshal tier due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal tier"}`))
+			return
+		}
+
+		w.Write(body)
+	})
+}
@@ -0,0 +1,68 @@
+package token
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+type JWTEdDSAMaker struct {
+	keys *KeySet
+}
+
+func NewJWTEdDSAMaker(keys *KeySet) (Maker, error) {
+	return &JWTEdDSAMaker{keys}, nil
+}
+
+func (maker *JWTEdDSAMaker) CreateToken(username string, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	key, err := maker.keys.Signer()
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := NewPayload(username, duration, opts...)
+
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodEdDSA, payload)
+	jwtToken.Header["kid"] = key.ID
+
+	token, err := jwtToken.SignedString(key.PrivateKey)
+	return token, payload, err
+}
+
+func (maker *JWTEdDSAMaker) VerifyToken(token string) (*Payload, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		_, ok := token.Method.(*jwt.SigningMethodEd25519)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+
+		publicKey, ok := maker.keys.PublicKey(kid)
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+
+		return publicKey, nil
+	}
+
+	jwtToken, err := jwt.ParseWithClaims(token, &Payload{}, keyFunc)
+	if err != nil {
+		verr, ok := err.(*jwt.ValidationError)
+		if ok && errors.Is(verr.Inner, ErrExpiredToken) {
+			return nil, ErrExpiredToken
+		}
+		return nil, ErrInvalidToken
+	}
+
+	payload, ok := jwtToken.Claims.(*Payload)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,100 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+
+	"gophermart/internal/service/utils"
+)
+
+func newTestKeySet(t *testing.T) *KeySet {
+	key, err := GenerateSigningKey()
+	require.NoError(t, err)
+
+	return NewKeySet(time.Minute, key)
+}
+
+func TestJWTEdDSAMaker(t *testing.T) {
+	maker, err := NewJWTEdDSAMaker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	username := utils.RandomUserName()
+	duration := time.Minute
+
+	issuedAt := time.Now()
+	expiredAt := issuedAt.Add(duration)
+
+	token, payload, err := maker.CreateToken(username, duration)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.NotEmpty(t, payload)
+
+	payload, err = maker.VerifyToken(token)
+	require.NoError(t, err)
+
+	require.Equal(t, username, payload.Username)
+	require.WithinDuration(t, issuedAt, payload.IssuedAt, time.Second)
+	require.WithinDuration(t, expiredAt, payload.ExpiredAt, time.Second)
+}
+
+func TestExpiredJWTEdDSAToken(t *testing.T) {
+	maker, err := NewJWTEdDSAMaker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), -time.Minute)
+	require.NoError(t, err)
+
+	payload, err := maker.VerifyToken(token)
+	require.EqualError(t, err, ErrExpiredToken.Error())
+	require.Nil(t, payload)
+}
+
+func TestJWTEdDSATokenUnknownKey(t *testing.T) {
+	maker, err := NewJWTEdDSAMaker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), time.Minute)
+	require.NoError(t, err)
+
+	otherMaker, err := NewJWTEdDSAMaker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	payload, err := otherMaker.VerifyToken(token)
+	require.EqualError(t, err, ErrInvalidToken.Error())
+	require.Nil(t, payload)
+}
+
+func TestJWTEdDSARejectsHMAC(t *testing.T) {
+	keys := newTestKeySet(t)
+	key, err := keys.Signer()
+	require.NoError(t, err)
+
+	// HS256 signed with the public key must not pass as EdDSA
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, NewPayload(utils.RandomUserName(), time.Minute))
+	jwtToken.Header["kid"] = key.ID
+	token, err := jwtToken.SignedString([]byte(key.PublicKey()))
+	require.NoError(t, err)
+
+	maker, err := NewJWTEdDSAMaker(keys)
+	require.NoError(t, err)
+
+	payload, err := maker.VerifyToken(token)
+	require.EqualError(t, err, ErrInvalidToken.Error())
+	require.Nil(t, payload)
+}
+
+func TestJWTEdDSARoleClaim(t *testing.T) {
+	maker, err := NewJWTEdDSAMaker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), time.Minute, WithRole("admin"))
+	require.NoError(t, err)
+
+	payload, err := maker.VerifyToken(token)
+	require.NoError(t, err)
+	require.Equal(t, "admin", payload.Role)
+	require.False(t, payload.MFAPending)
+}
@@ -21,8 +21,8 @@ func NewJWTMaker(secretKey string) (Maker, error) {
 	return &JWTMaker{secretKey}, nil
 }
 
-func (maker *JWTMaker) CreateToken(username string, duration time.Duration) (string, *Payload, error) {
-	payload := NewPayload(username, duration)
+func (maker *JWTMaker) CreateToken(username string, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	payload := NewPayload(username, duration, opts...)
 
 	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, payload)
 	token, err := jwtToken.SignedString([]byte(maker.secretKey))
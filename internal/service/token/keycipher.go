@@ -0,0 +1,64 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+var ErrSealedKey = errors.New("failed to open sealed signing key")
+
+// KeyCipher encrypts signing key seeds before they are stored. Seeds are
+// sealed with AES-256-GCM under a key derived from the service secret and
+// bound to the key ID, so a sealed seed can not be moved to another key.
+type KeyCipher struct {
+	aead cipher.AEAD
+}
+
+func NewKeyCipher(secret string) (*KeyCipher, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("secret is required to encrypt signing keys")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyCipher{aead}, nil
+}
+
+// Seal returns the nonce followed by the encrypted seed
+func (c *KeyCipher) Seal(id string, seed []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return c.aead.Seal(nonce, nonce, seed, []byte(id)), nil
+}
+
+func (c *KeyCipher) Open(id string, sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, ErrSealedKey
+	}
+
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+
+	seed, err := c.aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return nil, ErrSealedKey
+	}
+
+	return seed, nil
+}
@@ -0,0 +1,40 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyCipher(t *testing.T) {
+	_, err := NewKeyCipher("")
+	require.Error(t, err)
+
+	keyCipher, err := NewKeyCipher("cuzyouwillneverknowthissecretkey")
+	require.NoError(t, err)
+
+	key, err := GenerateSigningKey()
+	require.NoError(t, err)
+
+	sealed, err := keyCipher.Seal(key.ID, key.PrivateKey.Seed())
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), string(key.PrivateKey.Seed()))
+
+	seed, err := keyCipher.Open(key.ID, sealed)
+	require.NoError(t, err)
+	require.Equal(t, key.PrivateKey.Seed(), []byte(seed))
+
+	// Sealed seed is bound to its key ID
+	_, err = keyCipher.Open("otherkey", sealed)
+	require.ErrorIs(t, err, ErrSealedKey)
+
+	// Plaintext seeds stored before encryption are not accepted
+	_, err = keyCipher.Open(key.ID, key.PrivateKey.Seed())
+	require.ErrorIs(t, err, ErrSealedKey)
+
+	otherCipher, err := NewKeyCipher("anothersecret")
+	require.NoError(t, err)
+
+	_, err = otherCipher.Open(key.ID, sealed)
+	require.ErrorIs(t, err, ErrSealedKey)
+}
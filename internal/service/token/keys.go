@@ -0,0 +1,164 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNoSigningKey = errors.New("no signing key available")
+
+// SigningKey is an Ed25519 key pair identified by its kid
+type SigningKey struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+	CreatedAt  time.Time
+}
+
+// GenerateSigningKey creates a new random Ed25519 signing key
+func GenerateSigningKey() (SigningKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to generate ed25519 key: %w", err)
+	}
+
+	return NewSigningKey(privateKey.Seed(), time.Now())
+}
+
+// NewSigningKey restores a signing key from its seed
+func NewSigningKey(seed []byte, createdAt time.Time) (SigningKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return SigningKey{}, fmt.Errorf("invalid seed size: must be exactly %d bytes", ed25519.SeedSize)
+	}
+
+	privateKey := ed25519.NewKeyFromSeed(seed)
+
+	return SigningKey{
+		ID:         keyID(privateKey.Public().(ed25519.PublicKey)),
+		PrivateKey: privateKey,
+		CreatedAt:  createdAt,
+	}, nil
+}
+
+func (k SigningKey) PublicKey() ed25519.PublicKey {
+	return k.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+func keyID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeySet holds every key tokens may be verified with.
+// The newest key which is older than activation delay is used for signing
+// so other replicas and JWKS consumers can learn about it beforehand.
+type KeySet struct {
+	mu         sync.RWMutex
+	keys       []SigningKey
+	activation time.Duration
+}
+
+func NewKeySet(activation time.Duration, keys ...SigningKey) *KeySet {
+	ks := &KeySet{activation: activation}
+	ks.Replace(keys)
+
+	return ks
+}
+
+// Replace swaps the whole key set, e.g. after reloading keys from DB
+func (ks *KeySet) Replace(keys []SigningKey) {
+	sorted := make([]SigningKey, len(keys))
+	copy(sorted, keys)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys = sorted
+}
+
+func (ks *KeySet) Keys() []SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]SigningKey, len(ks.keys))
+	copy(keys, ks.keys)
+
+	return keys
+}
+
+// Signer returns the key new tokens must be signed with
+func (ks *KeySet) Signer() (SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if len(ks.keys) == 0 {
+		return SigningKey{}, ErrNoSigningKey
+	}
+
+	activeBefore := time.Now().Add(-ks.activation)
+	for _, key := range ks.keys {
+		if !key.CreatedAt.After(activeBefore) {
+			return key, nil
+		}
+	}
+
+	// No key is published long enough yet (e.g. first start), so use the newest one
+	return ks.keys[0], nil
+}
+
+func (ks *KeySet) PublicKey(kid string) (ed25519.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.ID == kid {
+			return key.PublicKey(), true
+		}
+	}
+
+	return nil, false
+}
+
+// JWK is an Ed25519 public key in RFC 8037 format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.PublicKey()),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+
+	return jwks
+}
@@ -0,0 +1,60 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gophermart/internal/service/utils"
+)
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey, err := GenerateSigningKey()
+	require.NoError(t, err)
+	oldKey.CreatedAt = time.Now().Add(-time.Hour)
+
+	keys := NewKeySet(time.Minute, oldKey)
+	maker, err := NewPasetoV4Maker(keys)
+	require.NoError(t, err)
+
+	oldToken, _, err := maker.CreateToken(utils.RandomUserName(), time.Minute)
+	require.NoError(t, err)
+
+	newKey, err := GenerateSigningKey()
+	require.NoError(t, err)
+	keys.Replace([]SigningKey{oldKey, newKey})
+
+	// freshly generated key is published but not used for signing yet
+	signer, err := keys.Signer()
+	require.NoError(t, err)
+	require.Equal(t, oldKey.ID, signer.ID)
+
+	newKey.CreatedAt = time.Now().Add(-2 * time.Minute)
+	keys.Replace([]SigningKey{oldKey, newKey})
+
+	signer, err = keys.Signer()
+	require.NoError(t, err)
+	require.Equal(t, newKey.ID, signer.ID)
+
+	_, err = maker.VerifyToken(oldToken)
+	require.NoError(t, err)
+
+	jwks := keys.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, newKey.ID, jwks.Keys[0].KeyID)
+	require.Equal(t, "Ed25519", jwks.Keys[0].Curve)
+
+	keys.Replace([]SigningKey{newKey})
+
+	_, err = maker.VerifyToken(oldToken)
+	require.EqualError(t, err, ErrInvalidToken.Error())
+}
+
+func TestEmptyKeySet(t *testing.T) {
+	maker, err := NewJWTEdDSAMaker(NewKeySet(time.Minute))
+	require.NoError(t, err)
+
+	_, _, err = maker.CreateToken(utils.RandomUserName(), time.Minute)
+	require.ErrorIs(t, err, ErrNoSigningKey)
+}
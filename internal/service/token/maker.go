@@ -6,7 +6,7 @@ import (
 )
 
 type Maker interface {
-	CreateToken(username string, duration time.Duration) (string, *Payload, error)
+	CreateToken(username string, duration time.Duration, opts ...PayloadOption) (string, *Payload, error)
 	VerifyToken(token string) (*Payload, error)
 }
 
@@ -15,10 +15,25 @@ var makerMap = map[string]func(string) (Maker, error){
 	"jwt":    NewJWTMaker,
 }
 
-func NewTokenMaker(engine string, key string) (Maker, error) {
+var keySetMakerMap = map[string]func(*KeySet) (Maker, error){
+	"paseto-v4": NewPasetoV4Maker,
+	"jwt-eddsa": NewJWTEdDSAMaker,
+}
+
+// UsesKeySet reports whether engine signs tokens with asymmetric keys from a KeySet
+func UsesKeySet(engine string) bool {
+	_, ok := keySetMakerMap[engine]
+	return ok
+}
+
+func NewTokenMaker(engine string, key string, keys *KeySet) (Maker, error) {
+	if keySetMakerCreator, ok := keySetMakerMap[engine]; ok {
+		return keySetMakerCreator(keys)
+	}
+
 	makerCreator, ok := makerMap[engine]
 	if !ok {
-		return nil, fmt.Errorf(`token engine "%s" is not supported; use "jwt/paseto"`, engine)
+		return nil, fmt.Errorf(`token engine "%s" is not supported; use "paseto-v4/jwt-eddsa/jwt/paseto"`, engine)
 	}
 
 	maker, err := makerCreator(key)
@@ -26,8 +26,8 @@ func NewPasetoMaker(symmetricKey string) (Maker, error) {
 	return maker, nil
 }
 
-func (maker *PasetoMaker) CreateToken(username string, duration time.Duration) (string, *Payload, error) {
-	payload := NewPayload(username, duration)
+func (maker *PasetoMaker) CreateToken(username string, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	payload := NewPayload(username, duration, opts...)
 
 	token, err := maker.paseto.Encrypt(maker.symmetricKey, payload, nil)
 	return token, payload, err
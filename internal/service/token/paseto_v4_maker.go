@@ -0,0 +1,123 @@
+package token
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const pasetoV4PublicHeader = "v4.public."
+
+// PasetoV4Maker issues PASETO v4.public tokens signed with Ed25519.
+// The kid of the signing key is carried in the token footer.
+type PasetoV4Maker struct {
+	keys *KeySet
+}
+
+type pasetoFooter struct {
+	KeyID string `json:"kid"`
+}
+
+func NewPasetoV4Maker(keys *KeySet) (Maker, error) {
+	return &PasetoV4Maker{keys}, nil
+}
+
+func (maker *PasetoV4Maker) CreateToken(username string, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	key, err := maker.keys.Signer()
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := NewPayload(username, duration, opts...)
+
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	footer, err := json.Marshal(pasetoFooter{key.ID})
+	if err != nil {
+		return "", nil, err
+	}
+
+	signature := ed25519.Sign(key.PrivateKey, preAuthEncode([]byte(pasetoV4PublicHeader), message, footer, nil))
+
+	token := pasetoV4PublicHeader +
+		base64.RawURLEncoding.EncodeToString(append(message, signature...)) +
+		"." + base64.RawURLEncoding.EncodeToString(footer)
+
+	return token, payload, nil
+}
+
+func (maker *PasetoV4Maker) VerifyToken(token string) (*Payload, error) {
+	if !strings.HasPrefix(token, pasetoV4PublicHeader) {
+		return nil, ErrInvalidToken
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, pasetoV4PublicHeader), ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	signed, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(signed) < ed25519.SignatureSize {
+		return nil, ErrInvalidToken
+	}
+
+	footer, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	pf := pasetoFooter{}
+	if err := json.Unmarshal(footer, &pf); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	publicKey, ok := maker.keys.PublicKey(pf.KeyID)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	message := signed[:len(signed)-ed25519.SignatureSize]
+	signature := signed[len(signed)-ed25519.SignatureSize:]
+
+	if !ed25519.Verify(publicKey, preAuthEncode([]byte(pasetoV4PublicHeader), message, footer, nil), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	payload := &Payload{}
+	if err := json.Unmarshal(message, payload); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	err = payload.Valid()
+	if err != nil {
+		return nil, ErrExpiredToken
+	}
+
+	return payload, nil
+}
+
+// preAuthEncode implements PASETO PAE
+func preAuthEncode(pieces ...[]byte) []byte {
+	buf := bytes.Buffer{}
+
+	le64 := func(n int) {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(n)&^(1<<63))
+		buf.Write(b)
+	}
+
+	le64(len(pieces))
+	for _, piece := range pieces {
+		le64(len(piece))
+		buf.Write(piece)
+	}
+
+	return buf.Bytes()
+}
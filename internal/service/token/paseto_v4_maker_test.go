@@ -0,0 +1,78 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gophermart/internal/service/utils"
+)
+
+func TestPasetoV4Maker(t *testing.T) {
+	maker, err := NewPasetoV4Maker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	username := utils.RandomUserName()
+	duration := time.Minute
+
+	issuedAt := time.Now()
+	expiredAt := issuedAt.Add(duration)
+
+	token, payload, err := maker.CreateToken(username, duration)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.NotEmpty(t, payload)
+	require.Contains(t, token, pasetoV4PublicHeader)
+
+	payload, err = maker.VerifyToken(token)
+	require.NoError(t, err)
+
+	require.Equal(t, username, payload.Username)
+	require.WithinDuration(t, issuedAt, payload.IssuedAt, time.Second)
+	require.WithinDuration(t, expiredAt, payload.ExpiredAt, time.Second)
+}
+
+func TestExpiredPasetoV4Token(t *testing.T) {
+	maker, err := NewPasetoV4Maker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), -time.Minute)
+	require.NoError(t, err)
+
+	payload, err := maker.VerifyToken(token)
+	require.EqualError(t, err, ErrExpiredToken.Error())
+	require.Nil(t, payload)
+}
+
+func TestTamperedPasetoV4Token(t *testing.T) {
+	maker, err := NewPasetoV4Maker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), time.Minute)
+	require.NoError(t, err)
+
+	tampered := []byte(token)
+	i := len(pasetoV4PublicHeader) + 5
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+
+	payload, err := maker.VerifyToken(string(tampered))
+	require.EqualError(t, err, ErrInvalidToken.Error())
+	require.Nil(t, payload)
+}
+
+func TestPasetoV4MFAPendingToken(t *testing.T) {
+	maker, err := NewPasetoV4Maker(newTestKeySet(t))
+	require.NoError(t, err)
+
+	token, _, err := maker.CreateToken(utils.RandomUserName(), time.Minute, WithMFAPending())
+	require.NoError(t, err)
+
+	payload, err := maker.VerifyToken(token)
+	require.NoError(t, err)
+	require.True(t, payload.MFAPending)
+}
@@ -11,17 +11,43 @@ var (
 )
 
 type Payload struct {
-	Username  string
-	IssuedAt  time.Time
-	ExpiredAt time.Time
+	Username   string
+	Role       string `json:",omitempty"`
+	MFAPending bool   `json:",omitempty"`
+	IssuedAt   time.Time
+	ExpiredAt  time.Time
 }
 
-func NewPayload(username string, duration time.Duration) *Payload {
-	return &Payload{
+// PayloadOption sets optional claims of a new token
+type PayloadOption func(*Payload)
+
+// WithMFAPending marks a token issued after password check only;
+// it is good for nothing but passing the second factor
+func WithMFAPending() PayloadOption {
+	return func(payload *Payload) {
+		payload.MFAPending = true
+	}
+}
+
+// WithRole embeds user role into token
+func WithRole(role string) PayloadOption {
+	return func(payload *Payload) {
+		payload.Role = role
+	}
+}
+
+func NewPayload(username string, duration time.Duration, opts ...PayloadOption) *Payload {
+	payload := &Payload{
 		Username:  username,
 		IssuedAt:  time.Now(),
 		ExpiredAt: time.Now().Add(duration),
 	}
+
+	for _, opt := range opts {
+		opt(payload)
+	}
+
+	return payload
 }
 
 func (payload *Payload) Valid() error {
@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 6238 Appendix B vectors for SHA1 truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+
+	for unix, expected := range vectors {
+		code, err := Code(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		require.Equal(t, expected, code, "time %d", unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	code, err := Code(secret, now.Add(-Period*time.Second))
+	require.NoError(t, err)
+
+	step, ok := Validate(secret, code, now, 1)
+	require.True(t, ok)
+	require.Equal(t, Step(now)-1, step)
+
+	_, ok = Validate(secret, code, now, 0)
+	require.False(t, ok)
+
+	_, ok = Validate(secret, "12345", now, 1)
+	require.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Gophermart", "alice", "JBSWY3DPEHPK3PXP")
+
+	require.True(t, strings.HasPrefix(uri, "otpauth://totp/Gophermart:alice?"))
+	require.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	require.Contains(t, uri, "issuer=Gophermart")
+}
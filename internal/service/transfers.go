@@ -0,0 +1,110 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"gophermart/internal/service/storage"
+)
+
+type transferRequest struct {
+	To  string  `json:"to"`
+	Sum float32 `json:"sum"`
+}
+
+func (s *Service) handleTransfer() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		request := transferRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.To == "" || request.Sum <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "recipient and positive sum are required"}`))
+			return
+		}
+
+		if request.To == userName {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status": "error", "message": "can not transfer to yourself"}`))
+			return
+		}
+
+		transfer, err := s.db.TransferPoints(r.Context(), storage.Transfer{
+			From:      userName,
+			To:        request.To,
+			Sum:       request.Sum,
+			CreatedAt: time.Now(),
+		}, s.config.TransferDailyLimit)
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrUserDoesNotExist):
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "recipient not found"}`))
+			case errors.Is(err, storage.ErrNotEnoughPoints):
+				w.WriteHeader(http.StatusPaymentRequired)
+				w.Write([]byte(`{"status": "error", "message": "not enough points to transfer"}`))
+			case errors.Is(err, storage.ErrTransferLimitExceeded):
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"status": "error", "message": "daily transfer limit exceeded"}`))
+			default:
+				s.log.Errorf("failed to transfer points due to: %s", err)
+
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"status": "error", "message": "failed to transfer"}`))
+			}
+			return
+		}
+
+		res, err := json.Marshal(transfer)
+		if err != nil {
+			s.log.Errorf("failed to marshal transfer due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal transfer"}`))
+			return
+		}
+
+		s.log.Infof("user %s transferred %v points to %s", userName, transfer.Sum, transfer.To)
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleTransfers() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userName := getUserNameFromRequest(r)
+
+		transfers, err := s.db.GetTransfers(r.Context(), userName)
+		if err != nil {
+			s.log.Errorf("failed to get transfers from DB due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get transfers"}`))
+			return
+		}
+
+		if len(transfers) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		res, err := json.Marshal(transfers)
+		if err != nil {
+			s.log.Errorf("failed to marshal transfers due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal transfers"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"gophermart/internal/service/signature"
+	"gophermart/internal/service/storage"
+)
+
+const (
+	webhookSignatureHeader = "X-Gophermart-Signature"
+	webhookEventHeader     = "X-Gophermart-Event"
+	webhookDeliveryHeader  = "X-Gophermart-Delivery"
+
+	// webhookBatch is how many deliveries a worker claims at once, they are
+	// kept from other workers for webhookLease while being sent
+	webhookBatch = 20
+	webhookLease = 5 * time.Minute
+)
+
+var webhookEvents = map[string]bool{
+	storage.WebhookOrderUpdated:       true,
+	storage.WebhookOrderRevised:       true,
+	storage.WebhookBalanceWithdrawn:   true,
+	storage.WebhookBalanceAdjusted:    true,
+	storage.WebhookBalanceRefunded:    true,
+	storage.WebhookBalanceExpired:     true,
+	storage.WebhookBalanceTransferOut: true,
+	storage.WebhookBalanceTransferIn:  true,
+	storage.WebhookBalanceBonus:       true,
+}
+
+type (
+	webhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	webhookResponse struct {
+		storage.Webhook
+		Secret string `json:"secret"`
+	}
+)
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// deliverWebhooks sends due outbox entries to partners
+func (s *Service) deliverWebhooks(ctx context.Context) {
+	s.log.Infof("webhook delivery started")
+
+	ticker := time.NewTicker(s.config.WebhookInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infof("webhook delivery stopped")
+			return
+		case <-ticker.C:
+			deliveries, err := s.db.ClaimWebhookDeliveries(ctx, time.Now(), webhookBatch, webhookLease)
+			if err != nil {
+				s.log.Errorf("webhook delivery failed to claim deliveries: %s", err)
+				continue
+			}
+
+			if len(deliveries) == 0 {
+				continue
+			}
+
+			webhooks, err := s.db.GetWebhooks(ctx)
+			if err != nil {
+				s.log.Errorf("webhook delivery failed to get webhooks: %s", err)
+				continue
+			}
+
+			byID := make(map[int]storage.Webhook, len(webhooks))
+			for _, webhook := range webhooks {
+				byID[webhook.ID] = webhook
+			}
+
+			for _, delivery := range deliveries {
+				delivery = s.deliverWebhook(ctx, byID[delivery.WebhookID], delivery)
+
+				err = s.db.UpdateWebhookDelivery(ctx, delivery)
+				if err != nil {
+					s.log.Errorf("webhook delivery failed to save delivery %d: %s", delivery.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// deliverWebhook posts a signed payload, any 2xx response counts as delivered
+func (s *Service) deliverWebhook(ctx context.Context, webhook storage.Webhook, delivery storage.WebhookDelivery) storage.WebhookDelivery {
+	body := []byte(delivery.Payload)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return delivery.Failed(time.Now(), 0, err.Error(), s.config.WebhookMaxAttempts, s.config.WebhookBackoff)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, delivery.Event)
+	request.Header.Set(webhookDeliveryHeader, strconv.Itoa(delivery.ID))
+	request.Header.Set(webhookSignatureHeader, signature.Sign(webhook.Secret, time.Now(), body))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		s.log.Warnf("webhook %d delivery %d failed: %s", webhook.ID, delivery.ID, err)
+		return delivery.Failed(time.Now(), 0, err.Error(), s.config.WebhookMaxAttempts, s.config.WebhookBackoff)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		s.log.Warnf("webhook %d delivery %d got status %d", webhook.ID, delivery.ID, response.StatusCode)
+		return delivery.Failed(time.Now(), response.StatusCode, fmt.Sprintf("unexpected status %d", response.StatusCode), s.config.WebhookMaxAttempts, s.config.WebhookBackoff)
+	}
+
+	return delivery.Delivered(time.Now(), response.StatusCode)
+}
+
+func (s *Service) handleAdminCreateWebhook() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		request := webhookRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || len(request.Events) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "url and events are required"}`))
+			return
+		}
+
+		endpoint, err := url.Parse(request.URL)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "url must be absolute http(s) url"}`))
+			return
+		}
+
+		for _, event := range request.Events {
+			if !webhookEvents[event] {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status": "error", "message": "unknown event"}`))
+				return
+			}
+		}
+
+		secret, err := newWebhookSecret()
+		if err != nil {
+			s.log.Errorf("failed to generate webhook secret due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create webhook"}`))
+			return
+		}
+
+		webhook, err := s.db.CreateWebhook(r.Context(), storage.Webhook{
+			URL:       endpoint.String(),
+			Secret:    secret,
+			Events:    strings.Join(request.Events, ","),
+			CreatedBy: getUserNameFromRequest(r),
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			s.log.Errorf("failed to save webhook due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to create webhook"}`))
+			return
+		}
+
+		// Partners need the secret to check signatures, it is shown only once
+		res, err := json.Marshal(webhookResponse{webhook, secret})
+		if err != nil {
+			s.log.Errorf("failed to marshal webhook due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal webhook"}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminWebhooks() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		webhooks, err := s.db.GetWebhooks(r.Context())
+		if err != nil {
+			s.log.Errorf("failed to get webhooks due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get webhooks"}`))
+			return
+		}
+
+		res, err := json.Marshal(webhooks)
+		if err != nil {
+			s.log.Errorf("failed to marshal webhooks due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal webhooks"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}
+
+func (s *Service) handleAdminDisableWebhook() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "invalid webhook id"}`))
+			return
+		}
+
+		err = s.db.DisableWebhook(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, storage.ErrWebhookDoesNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"status": "error", "message": "webhook not found"}`))
+				return
+			}
+
+			s.log.Errorf("failed to disable webhook due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to disable webhook"}`))
+			return
+		}
+
+		w.Write([]byte(`{"status": "success", "message": "webhook disabled"}`))
+	})
+}
+
+func (s *Service) handleAdminWebhookDeliveries() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status": "error", "message": "invalid webhook id"}`))
+			return
+		}
+
+		limit := queryInt(r, "limit", adminSearchDefaultLimit)
+		if limit == 0 || limit > adminSearchMaxLimit {
+			limit = adminSearchMaxLimit
+		}
+
+		deliveries, err := s.db.GetWebhookDeliveries(r.Context(), id, limit, queryInt(r, "offset", 0))
+		if err != nil {
+			s.log.Errorf("failed to get webhook deliveries due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to get webhook deliveries"}`))
+			return
+		}
+
+		res, err := json.Marshal(deliveries)
+		if err != nil {
+			s.log.Errorf("failed to marshal webhook deliveries due to: %s", err)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "error", "message": "failed to marshal webhook deliveries"}`))
+			return
+		}
+
+		w.Write(res)
+	})
+}